@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+func browseCommand(args []string) {
+	// Browses the plan, the sub ini instructions and the payloads of a
+	// package in a terminal UI
+
+	flag := newFlagSet("browse", "<path>")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	b := newBrowser(parseIniTree(flag.Arg(0)))
+
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	check(err)
+
+	// Alternate screen without cursor, log lines would tear the screen
+	os.Stdout.WriteString("\033[?1049h\033[?25l")
+	log.SetOutput(io.Discard)
+	defer func() {
+		os.Stdout.WriteString("\033[?25h\033[?1049l")
+		restore()
+		log.SetOutput(os.Stderr)
+	}()
+
+	key := make([]byte, 32)
+	for {
+		b.width, b.height, err = terminalSize(fd)
+		if err != nil || b.width == 0 {
+			b.width, b.height = 80, 24
+		}
+		b.render(os.Stdout)
+
+		// Searching payloads takes a moment, the status says so first
+		if b.pending != "" {
+			b.search(b.pending)
+			b.pending = ""
+			continue
+		}
+
+		n, err := os.Stdin.Read(key)
+		if err != nil || !b.key(string(key[:n])) {
+			return
+		}
+	}
+}
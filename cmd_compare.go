@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func compareCommand(args []string) {
+	// Compares an extraction with a dump of a real device
+
+	flag := newFlagSet("compare", "[-json] <path> <extracted> <dump folder or tarball>")
+	asJSON := flag.Bool("json", false, "print the comparison as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	comparison, err := unpacker.Compare(parseIniTree(flag.Arg(0)), flag.Arg(1), flag.Arg(2))
+	check(err)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(comparison))
+		return
+	}
+
+	comparison.WriteText(os.Stdout)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func indexCommand(args []string) {
+	// Adds every package below the given folders to the corpus database
+
+	flag := newFlagSet("index", "[-db file] <folder>...")
+	db := flag.String("db", unpacker.CorpusFilename, "corpus database")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	corpus, err := unpacker.LoadCorpus(*db)
+	check(err)
+
+	for _, folder := range flag.Args() {
+		found, err := unpacker.FindPackages(folder)
+		check(err)
+
+		for _, main := range found {
+			pkg, err := unpacker.IndexPackage(unpacker.ParseIniTree(main))
+			if err != nil {
+				log.Printf("[!] %s: %s", main, err)
+				continue
+			}
+			corpus.Add(pkg)
+			log.Printf("[+] Indexed %s from %s, %d payloads", pkg.Name, pkg.Source, len(pkg.Files))
+		}
+	}
+
+	check(corpus.Save(*db))
+}
+
+func queryCommand(args []string) {
+	// Searches the corpus database, prints the matching packages with what
+	// matched
+
+	flag := newFlagSet("query", "[-db file] [-json] [-hash sha256] [-step text] [-path text] [-id PackageID]")
+	db := flag.String("db", unpacker.CorpusFilename, "corpus database")
+	asJSON := flag.Bool("json", false, "print the matches as JSON")
+	var query unpacker.CorpusQuery
+	flag.StringVar(&query.Hash, "hash", "", "SHA-256 of a shipped file, or a prefix of it")
+	flag.StringVar(&query.Step, "step", "", "instruction name, main step folder or part of the arguments of a step")
+	flag.StringVar(&query.Path, "path", "", "part of a path on the target")
+	flag.Int64Var(&query.PackageID, "id", 0, "PackageID")
+	flag.Parse(args)
+
+	if query == (unpacker.CorpusQuery{}) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	corpus, err := unpacker.LoadCorpus(*db)
+	check(err)
+
+	matches := corpus.Query(query)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(matches))
+		return
+	}
+
+	for _, match := range matches {
+		fmt.Printf("%s (%s)\n", match.Name, match.Source)
+		for _, line := range match.Matches {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func debugCommand(args []string) {
+	// Steps through the plan of a package interactively, type help for the
+	// commands
+
+	flag := newFlagSet("debug", "[-break folder] <path>")
+	breakAt := flag.String("break", "", "stop before the main steps of this folder or region")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	debugger := unpacker.NewDebugger(parseIniTree(flag.Arg(0)))
+	if *breakAt != "" {
+		debugger.Break(*breakAt)
+	}
+
+	check(debugger.Run(os.Stdin, os.Stdout))
+}
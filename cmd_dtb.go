@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func dtbCommand(args []string) {
+	// Decodes the device trees of a DTB, FIT image, bootloader or flash dump
+	// into device tree source
+
+	flag := newFlagSet("dtb", "<file>")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	check(err)
+
+	found := unpacker.FindFDTs(data)
+	if len(found) == 0 {
+		log.Fatalf("[!] No device tree found in %s", flag.Arg(0))
+	}
+
+	for i, fdt := range found {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("// offset 0x%x\n", fdt.Offset)
+		check(fdt.Root.WriteDTS(os.Stdout))
+	}
+}
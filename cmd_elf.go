@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func elfCommand(args []string) {
+	// Lists the ELF files of an extraction
+
+	flag := newFlagSet("elf", "[-json] <path> <extracted>")
+	asJSON := flag.Bool("json", false, "print the inventory as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	infos, err := unpacker.InventoryELF(parseIniTree(flag.Arg(0)), flag.Arg(1))
+	check(err)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(infos))
+		return
+	}
+
+	check(unpacker.WriteELFTable(infos, os.Stdout))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func envCommand(args []string) {
+	// Prints the U-Boot environments of an env image, bootloader or flash
+	// dump
+
+	flag := newFlagSet("env", "[-json] <file>")
+	asJSON := flag.Bool("json", false, "print the environments as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	check(err)
+
+	envs := unpacker.FindUBootEnvs(data)
+	if len(envs) == 0 {
+		log.Fatalf("[!] No U-Boot environment found in %s", flag.Arg(0))
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(envs))
+		return
+	}
+
+	for i, env := range envs {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		kind := "saved"
+		if env.Default {
+			kind = "default"
+		} else if env.Redundant {
+			kind = fmt.Sprintf("redundant, flags %d", env.Flags)
+		}
+		fmt.Printf("# offset 0x%x, size 0x%x, %s\n", env.Offset, env.Size, kind)
+		env.WriteText(os.Stdout)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func flashmapCommand(args []string) {
+	// Infers the flash layout of a package and optionally assembles sparse
+	// full flash images from its payloads
+
+	flag := newFlagSet("flashmap", "[-json] [-o dir] <path>")
+	asJSON := flag.Bool("json", false, "print the flash map as JSON")
+	output := flag.String("o", "", "write a sparse image per flash device to this folder")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	tree := parseIniTree(flag.Arg(0))
+	flash := unpacker.InferFlashMap(tree)
+
+	if *output != "" {
+		check(os.MkdirAll(*output, 0755))
+		created, err := flash.WriteImages(tree, *output)
+		check(err)
+		for _, name := range created {
+			log.Printf("[+] Wrote %s", name)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(flash))
+		return
+	}
+
+	check(flash.WriteText(os.Stdout))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func flowCommand(args []string) {
+	// Prints what happens to every file copied by a package
+
+	flag := newFlagSet("flow", "[-json] <path>")
+	asJSON := flag.Bool("json", false, "print the data flow as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	flow := unpacker.BuildDataFlow(parseIniTree(flag.Arg(0)))
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(flow))
+		return
+	}
+
+	flow.WriteText(os.Stdout)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func gcCommand(args []string) {
+	// Removes the files of a store no extraction links to anymore
+
+	flag := newFlagSet("gc", "<store>")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	store, err := unpacker.OpenStore(flag.Arg(0))
+	check(err)
+
+	stats, err := store.GC()
+	check(err)
+
+	log.Printf("[+] Removed %d of %d files, freed %d bytes", stats.Removed, stats.Blobs, stats.Freed)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func graphCommand(args []string) {
+	// Writes the execution plan as Graphviz or Mermaid graph
+
+	flag := newFlagSet("graph", "[-format dot|mermaid] [-max n] [-o file] <path>")
+	format := flag.String("format", "dot", "graph format, dot or mermaid")
+	max := flag.Int("max", 20, "instructions shown per sub ini, 0 shows all")
+	output := flag.String("o", "", "write the graph to this file instead of stdout")
+	flag.Parse(args)
+
+	writers := map[string]func([]*unpacker.Ini, io.Writer, unpacker.GraphOptions) error{
+		"dot":     unpacker.WriteDOT,
+		"mermaid": unpacker.WriteMermaid,
+	}
+	write, exists := writers[*format]
+
+	if flag.NArg() < 1 || !exists {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	tree := parseIniTree(flag.Arg(0))
+	options := unpacker.GraphOptions{MaxInstructions: *max}
+
+	if *output == "" {
+		check(write(tree, os.Stdout, options))
+		return
+	}
+
+	check(writeFile(*output, func(out io.Writer) error {
+		return write(tree, out, options)
+	}))
+}
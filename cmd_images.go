@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func imagesCommand(args []string) {
+	// Identifies the kernel, bootloader and other images of the binary.ini
+	// files of a package
+
+	flag := newFlagSet("images", "[-json] <path>")
+	asJSON := flag.Bool("json", false, "print the images as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	entries := unpacker.IdentifyImages(parseIniTree(flag.Arg(0)))
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(entries))
+		return
+	}
+
+	unpacker.WriteImages(entries, os.Stdout)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func partitionsCommand(args []string) {
+	// Maps the partitions of the ImageUpdate steps of a package to the flash
+	// and eMMC layout found in its images
+
+	flag := newFlagSet("partitions", "[-json] <path>")
+	asJSON := flag.Bool("json", false, "print the partitions as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	partitions, mappings := unpacker.MapPartitions(parseIniTree(flag.Arg(0)))
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(struct {
+			Partitions []unpacker.Partition        `json:"partitions"`
+			Mappings   []unpacker.PartitionMapping `json:"mappings"`
+		}{partitions, mappings}))
+		return
+	}
+
+	check(unpacker.WritePartitions(partitions, mappings, os.Stdout))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func validateCommand(args []string) {
+	// Prints the validation findings of a package, exits with 2 if there are
+	// errors
+
+	flag := newFlagSet("validate", "<path>")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, finding := range unpacker.Validate(parseIniTree(flag.Arg(0))) {
+		if finding.Step != nil {
+			fmt.Printf("%s: %s (%s)\n", finding.Severity, finding.Message, finding.Step)
+		} else {
+			fmt.Printf("%s: %s\n", finding.Severity, finding.Message)
+		}
+		failed = failed || finding.Severity == unpacker.SeverityError
+	}
+
+	if failed {
+		os.Exit(2)
+	}
+}
+
+func reportCommand(args []string) {
+	// Writes the inventory report of a package
+
+	flag := newFlagSet("report", "[-md file] [-html file] [-extracted folder] <path>")
+	markdown := flag.String("md", "", "write the Markdown report to this file")
+	html := flag.String("html", "", "write the HTML report to this file")
+	extracted := flag.String("extracted", "", "extraction of the package, adds sizes and hashes")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 || *markdown == "" && *html == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	report, err := unpacker.NewReport(parseIniTree(flag.Arg(0)), *extracted)
+	check(err)
+
+	check(report.WriteFiles(*markdown, *html))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func sbomCommand(args []string) {
+	// Writes the SBOM of an extraction as CycloneDX and/or SPDX
+
+	flag := newFlagSet("sbom", "[-cyclonedx file] [-spdx file] <path> <extracted>")
+	cyclonedx := flag.String("cyclonedx", "", "write the CycloneDX JSON to this file")
+	spdx := flag.String("spdx", "", "write the SPDX JSON to this file")
+	flag.Parse(args)
+
+	if flag.NArg() < 2 || *cyclonedx == "" && *spdx == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	sbom, err := unpacker.BuildSBOM(parseIniTree(flag.Arg(0)), flag.Arg(1))
+	check(err)
+
+	if *cyclonedx != "" {
+		check(writeFile(*cyclonedx, sbom.WriteCycloneDX))
+	}
+	if *spdx != "" {
+		check(writeFile(*spdx, sbom.WriteSPDX))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func secretsCommand(args []string) {
+	// Lists credentials, keys and certificates of a package and, if given,
+	// its extraction
+
+	flag := newFlagSet("secrets", "[-json] <path> [extracted]")
+	asJSON := flag.Bool("json", false, "print the secrets as JSON")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	secrets, err := unpacker.ScanSecrets(parseIniTree(flag.Arg(0)), flag.Arg(1))
+	check(err)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		check(encoder.Encode(secrets))
+		return
+	}
+
+	unpacker.WriteSecrets(secrets, os.Stdout)
+}
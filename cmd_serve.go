@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func serveCommand(args []string) {
+	// Serves the ini tree, the findings and the files of a package, and of
+	// its extraction if given, on a local web UI and JSON API
+
+	flag := newFlagSet("serve", "[-addr host:port] <path> [extracted]")
+	addr := flag.String("addr", "127.0.0.1:8080", "address to listen on")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	handler, err := unpacker.NewServer(parseIniTree(flag.Arg(0)), flag.Arg(1))
+	check(err)
+
+	log.Printf("[+] Serving on http://%s/", *addr)
+	check(http.ListenAndServe(*addr, handler))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+func watchCommand(args []string) {
+	// Processes every package dropped into a folder: validation findings,
+	// extraction and report are written next to the package
+
+	flag := newFlagSet("watch", "[flags] <folder>")
+	w := unpacker.NewWatcher("")
+	flag.DurationVar(&w.Settle, "settle", w.Settle, "how long a package must stay unchanged before it's processed")
+	flag.DurationVar(&w.Interval, "interval", w.Interval, "time between scans of the folder")
+	flag.IntVar(&w.Jobs, "jobs", w.Jobs, "number of packages processed at the same time")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of files extracted in parallel per package")
+	storeDir := flag.String("store", "", "keep files once by content in this store and hardlink them")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	w.Dir = flag.Arg(0)
+
+	extract := unpacker.Config{Workers: *workers}
+	if *storeDir != "" {
+		var err error
+		extract.Store, err = unpacker.OpenStore(*storeDir)
+		check(err)
+	}
+
+	// Packages being processed are finished on Ctrl-C, queued ones are picked
+	// up by the next watch
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Print("[+] Stopping after the running packages")
+		close(stop)
+	}()
+
+	log.Printf("[+] Watching %s", w.Dir)
+
+	check(w.Run(stop, func(dir string) {
+		log.Printf("[+] Processing %s", dir)
+		status := unpacker.ProcessPackage(dir, extract)
+		if status.Error != "" {
+			log.Printf("[!] %s: %s", dir, status.Error)
+			return
+		}
+		log.Printf("[+] Processed %s: %d errors, %d warnings", dir, status.Errors, status.Warnings)
+	}))
+}
@@ -1,15 +1,42 @@
 package main
 
 import (
+	"flag"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
-	"time"
+	"runtime"
 
 	"github.com/sjossi/upupandaway/unpacker"
 )
 
+// commands are the subcommands of the CLI. Without a known subcommand the
+// arguments are passed to extract, so `upupandaway <path>` keeps working.
+var commands = map[string]func(args []string){
+	"extract":    extractCommand,
+	"compare":    compareCommand,
+	"validate":   validateCommand,
+	"report":     reportCommand,
+	"graph":      graphCommand,
+	"flow":       flowCommand,
+	"secrets":    secretsCommand,
+	"elf":        elfCommand,
+	"sbom":       sbomCommand,
+	"images":     imagesCommand,
+	"dtb":        dtbCommand,
+	"env":        envCommand,
+	"partitions": partitionsCommand,
+	"flashmap":   flashmapCommand,
+	"debug":      debugCommand,
+	"browse":     browseCommand,
+	"serve":      serveCommand,
+	"index":      indexCommand,
+	"query":      queryCommand,
+	"gc":         gcCommand,
+	"watch":      watchCommand,
+}
+
 func main() {
 	// Currently runs a hacky "extract all" for the provided directory.
 	//
@@ -18,28 +45,149 @@ func main() {
 
 	log.Print("[+] Welcome to .up .up and away")
 
-	if len(os.Args) < 2 {
-		log.Printf("[!] Usage: %s %s", filepath.Base(os.Args[0]), "<path>")
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	extractCommand(os.Args[1:])
+}
+
+func newFlagSet(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		log.Printf("[!] Usage: %s %s %s", filepath.Base(os.Args[0]), name, usage)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+func parseIniTree(upDir string) []*unpacker.Ini {
+	return unpacker.ParseIniTree(filepath.Join(upDir, "main_instructions.ini"))
+}
+
+func extractCommand(args []string) {
+	flag := newFlagSet("extract", "[flags] <path>")
+
+	progress := flag.Bool("progress", false, "show a progress bar instead of per file logs")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of files extracted in parallel")
+	fsync := flag.Bool("sync", false, "fsync every extracted file")
+	resume := flag.Bool("resume", false, "continue an interrupted extraction")
+	outDir := flag.String("o", ".", "folder the package folder is created in")
+	mode := flag.String("mode", "refuse", "if the output exists: refuse, overwrite or merge")
+	layered := flag.Bool("layers", false, "write one layer per main ini step plus a merged view")
+	ociFile := flag.String("oci", "", "also export the result as OCI image tarball to this file")
+	tarFile := flag.String("tar", "", "also export the filesystem with inferred owners and modes as tar")
+	cpioFile := flag.String("cpio", "", "same as -tar, but as newc cpio archive")
+	flash := flag.Bool("flash", false, "emulate dd, flashcp, nandwrite and flash_erase on virtual devices in dev/")
+	storeDir := flag.String("store", "", "keep files once by content in this store and hardlink them")
+	flag.Parse(args)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	upDir := os.Args[1]
+	upDir := flag.Arg(0)
+
+	outputMode, err := unpacker.ParseOutputMode(*mode)
+	check(err)
 
-	mainInstructions := filepath.Join(upDir, "main_instructions.ini")
-	iniTree := unpacker.ParseIniTree(mainInstructions)
+	iniTree := parseIniTree(upDir)
 
-	// Extracts to extracted_ folder with timestamp within the supplied root folder
-	// TODO: keep track of it in a configuration object
-	toBase := filepath.Join(upDir, "./extracted_"+time.Now().Format("20060102150405")+"")
+	// Extracts to up_<PackageID> in the output folder, so running twice on
+	// the same package ends up in the same place
+	config := &unpacker.Config{
+		ToBase:  unpacker.OutputPath(iniTree, *outDir),
+		Workers: *workers,
+		Sync:    *fsync,
+		Resume:  *resume,
+		Mode:    outputMode,
+		Layered: *layered,
+	}
+
+	if *storeDir != "" {
+		config.Store, err = unpacker.OpenStore(*storeDir)
+		check(err)
+	}
 
 	// TODO: add logging configuration to configuration object
 
-	log.Printf("[+] Extracting to %s", toBase)
+	log.Printf("[+] Extracting to %s", config.ToBase)
+
+	if *progress {
+		bar := newProgressBar(os.Stderr)
+		config.Progress = bar.Update
+
+		// The bar redraws the same line, log lines in between would tear it
+		log.SetOutput(bar)
+		defer bar.Done()
+	}
+
+	err = unpacker.ExtractTree(iniTree, config)
+	if err != nil {
+		log.Fatalf("[!] Extraction failed: %q", err)
+	}
 
-	for _, ini := range iniTree {
-		if strings.HasPrefix(ini.Filename, "files.ini") || strings.HasPrefix(ini.Filename, "execute.ini") {
-			log.Printf("[+] Extracting %s", ini.Filename)
-			unpacker.ExtractFiles(ini, toBase)
+	if *flash {
+		for _, command := range unpacker.EmulateFlashTools(iniTree, unpacker.FilesystemRoot(config.ToBase)) {
+			if command.Error != "" {
+				log.Printf("[!] %s: %s: %s", command.Step, command.Command, command.Error)
+				continue
+			}
+			log.Printf("[+] %s: %d bytes at 0x%x of %s", command.Command, command.Length, command.Offset, command.Device)
 		}
 	}
+
+	if *ociFile != "" {
+		log.Printf("[+] Exporting OCI image to %s", *ociFile)
+		check(writeFile(*ociFile, func(out io.Writer) error {
+			return unpacker.ExportOCI(iniTree, config.ToBase, out, unpacker.OCIOptions{})
+		}))
+	}
+
+	archives := map[string]unpacker.ArchiveFormat{
+		*tarFile:  unpacker.TarArchive,
+		*cpioFile: unpacker.CpioArchive,
+	}
+	for filename, format := range archives {
+		if filename == "" {
+			continue
+		}
+
+		log.Printf("[+] Exporting filesystem to %s", filename)
+		check(writeFile(filename, func(out io.Writer) error {
+			return unpacker.ExportArchive(iniTree, config.ToBase, out, format)
+		}))
+	}
+}
+
+func check(err error) {
+	if err != nil {
+		log.Fatalf("[!] %s", err)
+	}
+}
+
+func writeFile(filename string, write func(io.Writer) error) error {
+	// Writes to a temporary file first, so a failed export doesn't leave a
+	// truncated file behind
+
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+const progressBarWidth = 40
+
+// progressBar renders unpacker.Progress updates as a single terminal line. It
+// doubles as an io.Writer so log output can be printed above the bar.
+type progressBar struct {
+	out   io.Writer
+	last  unpacker.Progress
+	line  string
+	mutex sync.Mutex
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out}
+}
+
+func (bar *progressBar) Update(p unpacker.Progress) {
+	bar.mutex.Lock()
+	defer bar.mutex.Unlock()
+
+	// Redrawing 800 times for a files.ini is slow on some terminals, only
+	// redraw on visible changes
+	if p.StepNo == bar.last.StepNo && int(p.Percent*10) == int(bar.last.Percent*10) && p.SubStep != p.SubCount {
+		return
+	}
+	bar.last = p
+
+	filled := int(p.Percent / 100 * progressBarWidth)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	bar.line = fmt.Sprintf("[%s%s] %5.1f%% %d/%d %s/%s %d/%d",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		p.Percent, int64(p.Done), p.Total, p.Folder, p.Filename, p.SubStep, p.SubCount)
+
+	fmt.Fprintf(bar.out, "\r\033[K%s", bar.line)
+}
+
+// Write clears the bar, prints the log line and redraws the bar below it
+func (bar *progressBar) Write(b []byte) (int, error) {
+	bar.mutex.Lock()
+	defer bar.mutex.Unlock()
+
+	fmt.Fprint(bar.out, "\r\033[K")
+	n, err := bar.out.Write(b)
+	if bar.line != "" {
+		fmt.Fprint(bar.out, bar.line)
+	}
+
+	return n, err
+}
+
+// Done moves the cursor past the bar
+func (bar *progressBar) Done() {
+	bar.mutex.Lock()
+	defer bar.mutex.Unlock()
+
+	if bar.line != "" {
+		fmt.Fprintln(bar.out)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+const (
+	getTermios = syscall.TCGETS
+	setTermios = syscall.TCSETS
+)
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+var errNoTerminal = errors.New("the terminal UI is only supported on Linux and macOS")
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errNoTerminal
+}
+
+func terminalSize(fd int) (int, int, error) {
+	return 0, 0, errNoTerminal
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/sjossi/upupandaway/unpacker"
+)
+
+// Panes of the browser, left to right
+const (
+	planPane = iota
+	instructionPane
+	previewPane
+)
+
+// browser is the state of the terminal UI: the main ini plan, the
+// instructions of the selected main step and a preview of the selected
+// instruction. The preview pane has no cursor, its cursor is the first
+// visible line.
+type browser struct {
+	plan   []unpacker.PlanStep
+	focus  int
+	cursor [3]int
+	scroll [3]int
+
+	preview    []string
+	previewKey [3]int
+
+	searching bool
+	input     string
+	// pending is a search to run after the next redraw
+	pending string
+	query   string
+	hits    []unpacker.SearchHit
+	hit     int
+	status  string
+
+	width, height int
+}
+
+func newBrowser(tree []*unpacker.Ini) *browser {
+	return &browser{
+		plan:       unpacker.ExecutionPlan(tree),
+		previewKey: [3]int{-1, -1, -1},
+		status:     "tab/arrows: move  /: search  n/N: next/previous hit  q: quit",
+	}
+}
+
+func (b *browser) planLines() []string {
+	lines := make([]string, 0, len(b.plan))
+	for _, step := range b.plan {
+		lines = append(lines, fmt.Sprintf("%3d %s%s %s", step.StepNo, strings.Repeat("  ", len(step.Regions)),
+			step.Instruction.InstructionStep, strings.Join(step.Instruction.Arguments, ", ")))
+	}
+
+	return lines
+}
+
+func (b *browser) selectedIni() *unpacker.Ini {
+	if b.cursor[planPane] >= len(b.plan) {
+		return nil
+	}
+
+	return b.plan[b.cursor[planPane]].Ini
+}
+
+func (b *browser) instructionLines() []string {
+	ini := b.selectedIni()
+	if ini == nil {
+		return []string{"(no sub ini)"}
+	}
+
+	lines := make([]string, 0, len(ini.Instructions.Instructions))
+	for _, instruction := range ini.Instructions.Instructions {
+		lines = append(lines, fmt.Sprintf("%3d %-11s %s", instruction.StepNo, instruction.InstructionStep,
+			strings.Join(instruction.Arguments, ", ")))
+	}
+
+	return lines
+}
+
+func (b *browser) previewLines(width int) []string {
+	// The preview of the selected instruction, cached since payloads can be
+	// large
+
+	key := [3]int{b.cursor[planPane], b.cursor[instructionPane], width}
+	if key == b.previewKey {
+		return b.preview
+	}
+	b.previewKey = key
+
+	ini := b.selectedIni()
+	if ini == nil || b.cursor[instructionPane] >= len(ini.Instructions.Instructions) {
+		b.preview = nil
+		return b.preview
+	}
+
+	instruction := ini.Instructions.Instructions[b.cursor[instructionPane]]
+	b.preview = []string{fmt.Sprintf("%s:%d %s", filepath.Join(ini.Folder, ini.Filename), instruction.StepNo, instruction.InstructionStep), ""}
+
+	if instruction.InstructionStep == unpacker.Execute {
+		b.preview = append(b.preview, wrap(strings.Join(instruction.Arguments, " "), width)...)
+	} else if payload := unpacker.InstructionPayload(ini, instruction); payload != "" {
+		relative, _ := filepath.Rel(ini.RootDir, payload)
+		b.preview = append(b.preview, relative)
+		b.preview = append(b.preview, unpacker.PreviewPayload(payload)...)
+	} else {
+		b.preview = append(b.preview, strings.Join(instruction.Arguments, ", "))
+	}
+
+	return b.preview
+}
+
+func (b *browser) move(delta int) {
+	lines := [3]int{len(b.plan), len(b.instructionLines()), len(b.preview)}
+
+	position := b.cursor[b.focus] + delta
+	if position >= lines[b.focus] {
+		position = lines[b.focus] - 1
+	}
+	if position < 0 {
+		position = 0
+	}
+	b.cursor[b.focus] = position
+
+	// Selecting something else resets the panes to the right
+	for pane := b.focus + 1; pane < len(b.cursor); pane++ {
+		b.cursor[pane], b.scroll[pane] = 0, 0
+	}
+}
+
+func (b *browser) search(query string) {
+	b.query = query
+	b.hits = unpacker.SearchPlan(b.plan, query)
+	b.hit = 0
+
+	if len(b.hits) == 0 {
+		b.status = fmt.Sprintf("no match for %q", query)
+		return
+	}
+	b.jump()
+}
+
+func (b *browser) jump() {
+	// Selects the current hit and scrolls the preview to the first matching
+	// line
+
+	hit := b.hits[b.hit]
+	b.cursor = [3]int{hit.Plan, 0, 0}
+	b.scroll = [3]int{b.scroll[planPane], 0, 0}
+	b.focus = planPane
+
+	if hit.Instruction >= 0 {
+		b.cursor[instructionPane] = hit.Instruction
+		b.focus = instructionPane
+
+		lower := strings.ToLower(b.query)
+		for i, line := range b.previewLines(b.previewWidth()) {
+			if i > 0 && strings.Contains(strings.ToLower(line), lower) {
+				b.cursor[previewPane] = i
+				break
+			}
+		}
+	}
+
+	b.status = fmt.Sprintf("%d/%d %s: %s", b.hit+1, len(b.hits), hit.Match, hit.Text)
+}
+
+func (b *browser) key(key string) bool {
+	// Handles a key press, returns false to quit
+
+	if b.searching {
+		switch {
+		case key == "\r":
+			b.searching = false
+			b.pending = b.input
+			b.status = fmt.Sprintf("searching for %q", b.input)
+		case key == "\x1b" || key == "\x03":
+			b.searching = false
+		case key == "\x7f" || key == "\b":
+			if runes := []rune(b.input); len(runes) > 0 {
+				b.input = string(runes[:len(runes)-1])
+			}
+		case !strings.HasPrefix(key, "\x1b"):
+			for _, r := range key {
+				if unicode.IsPrint(r) {
+					b.input += string(r)
+				}
+			}
+		}
+		return true
+	}
+
+	page := b.height - 3
+	if page < 1 {
+		page = 1
+	}
+
+	switch key {
+	case "q", "\x03":
+		return false
+	case "\t", "l", "\x1b[C", "\r":
+		if b.focus < previewPane {
+			b.focus++
+		}
+	case "\x1b[Z", "h", "\x1b[D":
+		if b.focus > planPane {
+			b.focus--
+		}
+	case "j", "\x1b[B":
+		b.move(1)
+	case "k", "\x1b[A":
+		b.move(-1)
+	case " ", "\x1b[6~":
+		b.move(page)
+	case "\x1b[5~":
+		b.move(-page)
+	case "g":
+		b.move(-b.cursor[b.focus])
+	case "G":
+		b.move(len(b.plan) + len(b.instructionLines()) + len(b.preview))
+	case "/":
+		b.searching, b.input = true, ""
+	case "n", "N":
+		if len(b.hits) > 0 {
+			if key == "n" {
+				b.hit = (b.hit + 1) % len(b.hits)
+			} else {
+				b.hit = (b.hit + len(b.hits) - 1) % len(b.hits)
+			}
+			b.jump()
+		}
+	}
+
+	return true
+}
+
+func (b *browser) widths() [3]int {
+	first, second := b.width*30/100, b.width*35/100
+	return [3]int{first, second, b.width - first - second - 2}
+}
+
+func (b *browser) previewWidth() int {
+	return b.widths()[previewPane]
+}
+
+func (b *browser) render(out io.Writer) {
+	// Draws the whole screen: pane titles, the three panes and a status line
+
+	widths := b.widths()
+	rows := b.height - 2
+	if rows < 1 {
+		rows = 1
+	}
+
+	panes := [3][]string{b.planLines(), b.instructionLines(), b.previewLines(widths[previewPane])}
+	titles := [3]string{"Plan", "Instructions", "Preview"}
+
+	// Keep the cursors visible, the preview scrolls with its cursor
+	b.scroll[previewPane] = b.cursor[previewPane]
+	for pane := planPane; pane < previewPane; pane++ {
+		if b.cursor[pane] < b.scroll[pane] {
+			b.scroll[pane] = b.cursor[pane]
+		}
+		if b.cursor[pane] >= b.scroll[pane]+rows {
+			b.scroll[pane] = b.cursor[pane] - rows + 1
+		}
+	}
+
+	var screen strings.Builder
+	screen.WriteString("\033[H")
+
+	for pane, title := range titles {
+		if pane > 0 {
+			screen.WriteString("│")
+		}
+		style := "\033[1m"
+		if pane == b.focus {
+			style = "\033[1;4m"
+		}
+		screen.WriteString(style + fit(title, widths[pane]) + "\033[0m")
+	}
+	screen.WriteString("\r\n")
+
+	for row := 0; row < rows; row++ {
+		for pane, lines := range panes {
+			if pane > 0 {
+				screen.WriteString("│")
+			}
+
+			i := b.scroll[pane] + row
+			line := ""
+			if i < len(lines) {
+				line = lines[i]
+			}
+
+			cell := fit(line, widths[pane])
+			switch {
+			case pane == previewPane || i != b.cursor[pane]:
+				screen.WriteString(cell)
+			case pane == b.focus:
+				screen.WriteString("\033[7m" + cell + "\033[0m")
+			default:
+				screen.WriteString("\033[1m" + cell + "\033[0m")
+			}
+		}
+		screen.WriteString("\r\n")
+	}
+
+	status := b.status
+	if b.searching {
+		status = "/" + b.input
+	}
+	screen.WriteString("\033[7m" + fit(status, b.width) + "\033[0m")
+
+	io.WriteString(out, screen.String())
+}
+
+func fit(s string, width int) string {
+	// Cuts or pads s to width columns, control characters would break the
+	// layout and are replaced
+
+	if width <= 0 {
+		return ""
+	}
+
+	runes := []rune(s)
+	for i, r := range runes {
+		if !unicode.IsPrint(r) {
+			runes[i] = '.'
+		}
+	}
+
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+
+	return string(runes) + strings.Repeat(" ", width-len(runes))
+}
+
+func wrap(s string, width int) []string {
+	if width <= 0 {
+		return []string{s}
+	}
+
+	lines := make([]string, 0)
+	runes := []rune(s)
+	for len(runes) > width {
+		lines = append(lines, string(runes[:width]))
+		runes = runes[width:]
+	}
+
+	return append(lines, string(runes))
+}
@@ -0,0 +1,292 @@
+package unpacker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat selects the output of ExportArchive
+type ArchiveFormat int
+
+const (
+	TarArchive ArchiveFormat = iota
+	// CpioArchive is the "newc" format used by initramfs
+	CpioArchive
+)
+
+// archiveEntry is a single path of the reconstructed filesystem
+type archiveEntry struct {
+	name  string
+	mode  os.FileMode
+	uid   int
+	gid   int
+	uname string
+	gname string
+	link  string
+	file  string
+	size  int64
+}
+
+func FilesystemRoot(toBase string) string {
+	// FilesystemRoot is the folder with the reconstructed filesystem of an
+	// extraction: the merged view for layered output, toBase otherwise
+
+	merged := filepath.Join(toBase, MergedDir)
+	if info, err := os.Stat(merged); err == nil && info.IsDir() {
+		return merged
+	}
+
+	return toBase
+}
+
+func ExportArchive(tree []*Ini, toBase string, out io.Writer, format ArchiveFormat) error {
+	// ExportArchive writes the reconstructed filesystem as tar or cpio with
+	// the modes, owners and symlinks the update's scripts would leave behind,
+	// see InferMetadata. Timestamps are zeroed so the archive can be diffed.
+
+	root := FilesystemRoot(toBase)
+	entries, err := archiveEntries(root, InferMetadata(tree, root))
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case CpioArchive:
+		return writeCpio(out, entries)
+	default:
+		return writeTar(out, entries)
+	}
+}
+
+func archiveEntries(root string, meta Metadata) ([]*archiveEntry, error) {
+	entries := make(map[string]*archiveEntry)
+	users := readIDs(filepath.Join(root, "etc/passwd"))
+	groups := readIDs(filepath.Join(root, "etc/group"))
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if rel == MarkerFilename {
+			return nil
+		}
+
+		entry := &archiveEntry{name: filepath.ToSlash(rel), file: path}
+
+		switch {
+		case info.IsDir():
+			entry.mode = os.ModeDir | 0755
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.link, err = os.Readlink(path)
+			entry.mode = os.ModeSymlink | 0777
+		default:
+			entry.mode = defaultMode(path)
+			entry.size = info.Size()
+		}
+
+		entries[entry.name] = entry
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for path, fileMeta := range meta {
+		name := strings.TrimPrefix(path, "/")
+
+		if fileMeta.Symlink != "" {
+			// ln -sf replaces whatever was there
+			entries[name] = &archiveEntry{name: name, mode: os.ModeSymlink | 0777, link: fileMeta.Symlink}
+		}
+
+		entry, exists := entries[name]
+		if !exists {
+			continue
+		}
+
+		if fileMeta.Mode != nil && entry.mode&os.ModeSymlink == 0 {
+			entry.mode = entry.mode&os.ModeType | *fileMeta.Mode
+		}
+		if fileMeta.Uid != nil {
+			entry.uid = *fileMeta.Uid
+		}
+		if fileMeta.Gid != nil {
+			entry.gid = *fileMeta.Gid
+		}
+	}
+
+	// Symlinks can point into folders that were never extracted
+	for name := range entries {
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			if _, exists := entries[dir]; !exists {
+				entries[dir] = &archiveEntry{name: dir, mode: os.ModeDir | 0755}
+			}
+		}
+	}
+
+	sorted := make([]*archiveEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.uname = nameOf(entry.uid, users)
+		entry.gname = nameOf(entry.gid, groups)
+		sorted = append(sorted, entry)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+
+	return sorted, nil
+}
+
+func writeTar(out io.Writer, entries []*archiveEntry) error {
+	tw := tar.NewWriter(out)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:    entry.name,
+			Mode:    int64(unixMode(entry.mode) & 07777),
+			Uid:     entry.uid,
+			Gid:     entry.gid,
+			Uname:   entry.uname,
+			Gname:   entry.gname,
+			ModTime: time.Unix(0, 0),
+		}
+
+		switch {
+		case entry.mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		case entry.mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.link
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = entry.size
+		}
+
+		err := tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			err = copyEntry(tw, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeCpio(out io.Writer, entries []*archiveEntry) error {
+	// Writes the SVR4 "newc" format without checksums
+
+	for i, entry := range entries {
+		size := entry.size
+		if entry.mode&os.ModeSymlink != 0 {
+			size = int64(len(entry.link))
+		} else if entry.mode.IsDir() {
+			size = 0
+		}
+
+		err := writeCpioHeader(out, entry.name, uint32(i+1), unixMode(entry.mode), entry.uid, entry.gid, size)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.mode&os.ModeSymlink != 0:
+			_, err = io.WriteString(out, entry.link)
+		case entry.mode.IsDir():
+		default:
+			err = copyEntry(out, entry)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = writePadding(out, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeCpioHeader(out, "TRAILER!!!", 0, 0, 0, 0, 0)
+}
+
+func writeCpioHeader(out io.Writer, name string, ino uint32, mode uint32, uid int, gid int, size int64) error {
+	nlink := 1
+	if mode&0170000 == 0040000 {
+		nlink = 2
+	}
+
+	_, err := fmt.Fprintf(out, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		ino, mode, uid, gid, nlink, 0, size, 0, 0, 0, 0, len(name)+1, 0, name)
+	if err != nil {
+		return err
+	}
+
+	// The 110 byte header and the name are padded to 4 bytes together
+	return writePadding(out, int64(110+len(name)+1))
+}
+
+func writePadding(out io.Writer, size int64) error {
+	if padding := (4 - size%4) % 4; padding > 0 {
+		_, err := out.Write(make([]byte, padding))
+		return err
+	}
+
+	return nil
+}
+
+func copyEntry(out io.Writer, entry *archiveEntry) error {
+	file, err := os.Open(entry.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyN(out, file, entry.size)
+
+	return err
+}
+
+func unixMode(mode os.FileMode) uint32 {
+	// Converts a Go file mode to the st_mode bits used in archives
+
+	unix := uint32(mode & os.ModePerm)
+
+	switch {
+	case mode.IsDir():
+		unix |= 0040000
+	case mode&os.ModeSymlink != 0:
+		unix |= 0120000
+	default:
+		unix |= 0100000
+	}
+
+	if mode&os.ModeSetuid != 0 {
+		unix |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		unix |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		unix |= 01000
+	}
+
+	return unix
+}
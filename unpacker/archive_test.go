@@ -0,0 +1,65 @@
+package unpacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportArchive(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := ExportArchive(tree, config.ToBase, &out, TarArchive); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(&out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[header.Name] = header
+	}
+
+	if h := headers["usr/share/app/a.txt"]; h == nil || h.Mode != 04755 {
+		t.Errorf("chmod not applied: %+v", h)
+	}
+	if h := headers["usr/share/app/b.txt"]; h == nil || h.Uid != 1000 || h.Gid != 1000 || h.Mode != 0600 {
+		t.Errorf("chown not applied: %+v", h)
+	}
+	if h := headers["usr/bin/a"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "/usr/share/app/a.txt" {
+		t.Errorf("symlink missing: %+v", h)
+	}
+	if h := headers["usr/bin/"]; h == nil || h.Typeflag != tar.TypeDir {
+		t.Errorf("parent folder of symlink missing: %+v", h)
+	}
+	if h := headers["tmp/setup.sh"]; h != nil {
+		t.Errorf("removed script is part of the archive: %+v", h)
+	}
+	if _, exists := headers[MarkerFilename]; exists {
+		t.Error("marker is part of the archive")
+	}
+
+	out.Reset()
+	if err := ExportArchive(tree, config.ToBase, &out, CpioArchive); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out.String(), "070701") || !strings.Contains(out.String(), "TRAILER!!!\x00") || out.Len()%4 != 0 {
+		t.Error("not a newc cpio archive")
+	}
+}
@@ -0,0 +1,160 @@
+package unpacker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// SearchHit is a step of the plan matching a search
+type SearchHit struct {
+	// Plan is the index of the main step in the execution plan
+	Plan int
+	// Instruction is the index of the instruction in the sub ini of the main
+	// step, -1 if the main step itself matches
+	Instruction int
+	// Match is path, execute or content
+	Match string
+	Text  string
+}
+
+// previewHexSize is the part of a binary payload shown as hex dump
+const previewHexSize = 4096
+
+func InstructionPayload(ini *Ini, instruction Instruction) string {
+	// InstructionPayload returns the payload file a Copy or ImageUpdate step
+	// reads, empty for other steps
+
+	switch {
+	case instruction.InstructionStep == Copy && isExtractable(ini) && len(instruction.Arguments) > 0:
+		return sourcePath(ini, instruction.Arguments[0])
+	case instruction.InstructionStep == ImageUpdate && len(instruction.Arguments) > 1:
+		return sourcePath(ini, instruction.Arguments[1])
+	}
+
+	return ""
+}
+
+func SearchPlan(plan []PlanStep, query string) []SearchHit {
+	// SearchPlan searches the arguments of all steps, the commands of
+	// Execute steps and the content of the payloads, ignoring case
+
+	hits := make([]SearchHit, 0)
+	if query == "" {
+		return hits
+	}
+	needle := bytes.ToLower([]byte(query))
+
+	matches := func(s string) bool {
+		return bytes.Contains(bytes.ToLower([]byte(s)), needle)
+	}
+
+	for i, step := range plan {
+		if arguments := strings.Join(step.Instruction.Arguments, ", "); matches(arguments) {
+			hits = append(hits, SearchHit{Plan: i, Instruction: -1, Match: "path", Text: arguments})
+		}
+
+		if step.Ini == nil {
+			continue
+		}
+
+		for j, instruction := range step.Ini.Instructions.Instructions {
+			arguments := strings.Join(instruction.Arguments, ", ")
+			if matches(arguments) {
+				match := "path"
+				if instruction.InstructionStep == Execute {
+					match = "execute"
+				}
+				hits = append(hits, SearchHit{Plan: i, Instruction: j, Match: match, Text: arguments})
+			}
+
+			payload := InstructionPayload(step.Ini, instruction)
+			if payload == "" {
+				continue
+			}
+
+			content, err := readPreview(payload, maxScanSize)
+			if err != nil {
+				continue
+			}
+			if offset := bytes.Index(bytes.ToLower(content), needle); offset >= 0 {
+				text := fmt.Sprintf("binary content at 0x%x", offset)
+				if isText(content) {
+					text = shorten(string(lineAt(content, offset)), 120)
+				}
+				hits = append(hits, SearchHit{Plan: i, Instruction: j, Match: "content", Text: text})
+			}
+		}
+	}
+
+	return hits
+}
+
+func PreviewPayload(from string) []string {
+	// PreviewPayload describes a payload for display: pictures with their
+	// format and dimensions, firmware images as identified by IdentifyImage
+	// followed by a hex dump, text as is
+
+	data, err := readPreview(from, maxScanSize)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	lines := []string{fmt.Sprintf("%d bytes", len(data))}
+	if len(data) == 0 {
+		return lines
+	}
+
+	if config, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return append(lines, fmt.Sprintf("%s image, %dx%d", strings.ToUpper(format), config.Width, config.Height))
+	}
+
+	if isText(data) {
+		return append(lines, strings.Split(strings.ReplaceAll(string(data), "\t", "    "), "\n")...)
+	}
+
+	if info := IdentifyImage(data); info.Format != "unknown" {
+		var description strings.Builder
+		writeImageInfo(&description, info, "")
+		lines = append(lines, strings.Split(strings.TrimSuffix(description.String(), "\n"), "\n")...)
+	}
+
+	if len(data) > previewHexSize {
+		data = data[:previewHexSize]
+	}
+
+	return append(lines, strings.Split(strings.TrimSuffix(hex.Dump(data), "\n"), "\n")...)
+}
+
+func readPreview(from string, limit int64) ([]byte, error) {
+	payload, err := openPayload(from)
+	if err != nil {
+		return nil, err
+	}
+	defer payload.Close()
+
+	return io.ReadAll(io.LimitReader(payload, limit))
+}
+
+func isText(data []byte) bool {
+	// Judged by the start, like file(1) does
+
+	head := data
+	if len(head) > 8192 {
+		head = head[:8192]
+	}
+
+	// A cut in the middle of a multibyte rune at the end is fine
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+
+	return len(head) > 0 && utf8.Valid(head) && !bytes.ContainsRune(head, 0)
+}
@@ -0,0 +1,57 @@
+package unpacker
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchPlan(t *testing.T) {
+	plan := ExecutionPlan(ParseIniTree(writeSyntheticPackage(t)))
+
+	got := SearchPlan(plan, "CHMOD 4755")
+	want := []SearchHit{{Plan: 0, Instruction: 0, Match: "content", Text: "chmod 4755 /usr/share/app/a.txt"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("content search: got %+v, want %+v", got, want)
+	}
+
+	got = SearchPlan(plan, "setup.sh")
+	if len(got) != 3 || got[0].Match != "path" || got[1].Match != "execute" || got[1].Instruction != 1 {
+		t.Errorf("path search: got %+v", got)
+	}
+
+	if hits := SearchPlan(plan, "reinstall"); len(hits) != 2 || hits[0].Instruction != -1 {
+		t.Errorf("main step search: got %+v", hits)
+	}
+}
+
+func TestPreviewPayload(t *testing.T) {
+	dir := t.TempDir()
+
+	file, err := os.Create(filepath.Join(dir, "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(file, image.NewGray(image.Rect(0, 0, 32, 16)))
+	file.Close()
+
+	os.WriteFile(filepath.Join(dir, "script.sh"), []byte("#!/bin/sh\n\techo hi\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "kernel"), uImage("Linux-4.14", 2, 0, []byte{0, 1, 2}), 0644)
+
+	if lines := PreviewPayload(filepath.Join(dir, "logo.png")); len(lines) != 2 || lines[1] != "PNG image, 32x16" {
+		t.Errorf("unexpected picture preview %q", lines)
+	}
+
+	if lines := PreviewPayload(filepath.Join(dir, "script.sh")); !reflect.DeepEqual(lines, []string{"19 bytes", "#!/bin/sh", "    echo hi", ""}) {
+		t.Errorf("unexpected text preview %q", lines)
+	}
+
+	lines := PreviewPayload(filepath.Join(dir, "kernel"))
+	if len(lines) < 3 || !strings.HasPrefix(lines[1], "uImage, 67 bytes") || !strings.HasPrefix(lines[len(lines)-1], "00000040  00 01 02") {
+		t.Errorf("unexpected binary preview %q", lines)
+	}
+}
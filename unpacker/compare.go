@@ -0,0 +1,261 @@
+package unpacker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Difference is a single path that differs between the reconstruction and a
+// device dump, with the steps of the package that touch it
+type Difference struct {
+	Path   string    `json:"path"`
+	Reason string    `json:"reason"`
+	Steps  []StepRef `json:"steps,omitempty"`
+}
+
+// Comparison is the result of Compare
+type Comparison struct {
+	Matching      int          `json:"matching"`
+	OnlyExtracted []Difference `json:"only_extracted"`
+	OnlyDump      []Difference `json:"only_dump"`
+	Mismatched    []Difference `json:"mismatched"`
+	// BySubIni counts the differences touched by every sub ini, a high count
+	// points to a step the simulation doesn't get right yet
+	BySubIni map[string]int `json:"by_sub_ini"`
+}
+
+// fsEntry is a file or symlink of one side of a comparison
+type fsEntry struct {
+	hash string
+	size int64
+	link string
+}
+
+func Compare(tree []*Ini, extracted string, dump string) (*Comparison, error) {
+	// Compare compares the filesystem reconstructed in extracted with a dump
+	// of a real device, either a folder or a (gzipped) tarball. Only files
+	// and symlinks are compared, folders don't carry content.
+
+	ours, err := readFolderEntries(FilesystemRoot(extracted))
+	if err != nil {
+		return nil, err
+	}
+
+	var theirs map[string]fsEntry
+	if info, err := os.Stat(dump); err == nil && info.IsDir() {
+		theirs, err = readFolderEntries(dump)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		theirs, err = readTarEntries(dump)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	provenance := BuildProvenance(tree)
+	comparison := &Comparison{
+		OnlyExtracted: make([]Difference, 0),
+		OnlyDump:      make([]Difference, 0),
+		Mismatched:    make([]Difference, 0),
+		BySubIni:      make(map[string]int),
+	}
+
+	difference := func(path string, reason string) Difference {
+		d := Difference{Path: path, Reason: reason, Steps: provenance.For(path)}
+
+		seen := make(map[string]bool)
+		for _, ref := range d.Steps {
+			name := filepath.Join(ref.Folder, ref.Filename)
+			if !seen[name] {
+				comparison.BySubIni[name]++
+				seen[name] = true
+			}
+		}
+
+		return d
+	}
+
+	for _, path := range sortedKeys(ours) {
+		ourEntry := ours[path]
+		theirEntry, exists := theirs[path]
+
+		switch {
+		case !exists:
+			comparison.OnlyExtracted = append(comparison.OnlyExtracted, difference(path, "missing in dump"))
+		case ourEntry.link != theirEntry.link:
+			reason := fmt.Sprintf("link %q, dump %q", ourEntry.link, theirEntry.link)
+			comparison.Mismatched = append(comparison.Mismatched, difference(path, reason))
+		case ourEntry.hash != theirEntry.hash:
+			reason := fmt.Sprintf("content differs, %d bytes, dump %d bytes", ourEntry.size, theirEntry.size)
+			comparison.Mismatched = append(comparison.Mismatched, difference(path, reason))
+		default:
+			comparison.Matching++
+		}
+	}
+
+	for _, path := range sortedKeys(theirs) {
+		if _, exists := ours[path]; !exists {
+			comparison.OnlyDump = append(comparison.OnlyDump, difference(path, "missing in extraction"))
+		}
+	}
+
+	return comparison, nil
+}
+
+func (comparison *Comparison) WriteText(w io.Writer) {
+	// WriteText writes a human readable report
+
+	fmt.Fprintf(w, "matching: %d, only extracted: %d, only dump: %d, mismatched: %d\n",
+		comparison.Matching, len(comparison.OnlyExtracted), len(comparison.OnlyDump), len(comparison.Mismatched))
+
+	sections := []struct {
+		title       string
+		differences []Difference
+	}{
+		{"Mismatched", comparison.Mismatched},
+		{"Only in extraction", comparison.OnlyExtracted},
+		{"Only in dump", comparison.OnlyDump},
+	}
+
+	for _, section := range sections {
+		if len(section.differences) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		for _, d := range section.differences {
+			fmt.Fprintf(w, "  %s: %s\n", d.Path, d.Reason)
+			for _, ref := range d.Steps {
+				fmt.Fprintf(w, "    %s\n", ref)
+			}
+		}
+	}
+
+	if len(comparison.BySubIni) > 0 {
+		fmt.Fprintf(w, "\nDifferences per sub ini:\n")
+
+		names := sortedKeys(comparison.BySubIni)
+		sort.SliceStable(names, func(i, j int) bool {
+			return comparison.BySubIni[names[i]] > comparison.BySubIni[names[j]]
+		})
+		for _, name := range names {
+			fmt.Fprintf(w, "  %5d %s\n", comparison.BySubIni[name], name)
+		}
+	}
+}
+
+func readFolderEntries(root string) (map[string]fsEntry, error) {
+	entries := make(map[string]fsEntry)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || info.IsDir() || rel == MarkerFilename {
+			return err
+		}
+		name := "/" + filepath.ToSlash(rel)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			entries[name] = fsEntry{link: link}
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			// Device nodes, fifos and sockets of a dump
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		entry, err := hashEntry(file)
+		entries[name] = entry
+
+		return err
+	})
+
+	return entries, err
+}
+
+func readTarEntries(filename string) (map[string]fsEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	entries := make(map[string]fsEntry)
+	tr := tar.NewReader(reader)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Clean("/" + header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			entries[name] = fsEntry{link: header.Linkname}
+		case tar.TypeReg:
+			entries[name], err = hashEntry(tr)
+			if err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			// Hardlinks have the content of the file they point to
+			entries[name] = entries[filepath.Clean("/"+header.Linkname)]
+		}
+	}
+
+	return entries, nil
+}
+
+func hashEntry(reader io.Reader) (fsEntry, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+
+	return fsEntry{hash: hex.EncodeToString(hash.Sum(nil)), size: size}, err
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,59 @@
+package unpacker
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// A device that ran the update: a.txt has the content of the first Copy,
+	// /data/marker is missing and there's a file we never saw
+	dump := filepath.Join(t.TempDir(), "dump.tar")
+	file, _ := os.Create(dump)
+	tw := tar.NewWriter(file)
+	for name, content := range map[string]string{
+		"usr/share/app/a.txt": "first a\n",
+		"usr/share/app/b.txt": "b\n",
+		"etc/hostname":        "headunit\n",
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	file.Close()
+
+	comparison, err := Compare(tree, config.ToBase, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if comparison.Matching != 1 {
+		t.Errorf("expected b.txt to match, got %d matches", comparison.Matching)
+	}
+
+	if len(comparison.Mismatched) != 1 || comparison.Mismatched[0].Path != "/usr/share/app/a.txt" || len(comparison.Mismatched[0].Steps) != 2 {
+		t.Errorf("unexpected mismatches: %+v", comparison.Mismatched)
+	}
+
+	if len(comparison.OnlyExtracted) != 1 || comparison.OnlyExtracted[0].Path != "/data/marker" {
+		t.Fatalf("unexpected extraction only files: %+v", comparison.OnlyExtracted)
+	}
+
+	steps := comparison.OnlyExtracted[0].Steps
+	if len(steps) != 1 || steps[0].InstructionStep != Create {
+		t.Errorf("unexpected provenance of /data/marker: %+v", steps)
+	}
+
+	if len(comparison.OnlyDump) != 1 || comparison.OnlyDump[0].Path != "/etc/hostname" {
+		t.Errorf("unexpected dump only files: %+v", comparison.OnlyDump)
+	}
+}
@@ -0,0 +1,211 @@
+package unpacker
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// copyBufferSize is the buffer used per running copy. Payloads are streamed
+// through it, so memory use doesn't depend on the size of an image.
+const copyBufferSize = 1 << 20
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+func openPayload(from string) (io.ReadCloser, error) {
+	// openPayload opens a payload of the package, falling back to the
+	// implicit .gz the packages use for most files. Closing the returned
+	// reader closes the underlying file as well.
+
+	file, err := os.Open(from)
+	if err == nil {
+		return file, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err = os.Open(from + ".gz")
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &gzipPayload{Reader: gz, file: file}, nil
+}
+
+func payloadSize(from string) (int64, error) {
+	// payloadSize returns the size of a payload once decompressed. Plain
+	// files are stat'ed, gzipped ones are read through once.
+
+	info, err := os.Stat(from)
+	if err == nil {
+		return info.Size(), nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	payload, err := openPayload(from)
+	if err != nil {
+		return 0, err
+	}
+	defer payload.Close()
+
+	return io.Copy(io.Discard, payload)
+}
+
+// rangeReader reads a range of a file and closes the whole file
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+func readRange(file io.ReadCloser, size int64, skip int64, count int64) (io.ReadCloser, int64, error) {
+	// readRange returns the count bytes of file after skip, all of them for a
+	// count of 0, and their length. Files are read through a section, only
+	// gzipped payloads are read from the start. Closing the returned reader
+	// closes file.
+
+	if skip < 0 || skip > size {
+		skip = size
+	}
+	length := size - skip
+	if count > 0 && count < length {
+		length = count
+	}
+
+	if at, ok := file.(io.ReaderAt); ok {
+		return rangeReader{io.NewSectionReader(at, skip, length), file}, length, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, file, skip); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return rangeReader{io.LimitReader(file, length), file}, length, nil
+}
+
+// gzipPayload closes both the decompressor and the file below it
+type gzipPayload struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (payload *gzipPayload) Close() error {
+	err := payload.Reader.Close()
+	if fileErr := payload.file.Close(); err == nil {
+		err = fileErr
+	}
+
+	return err
+}
+
+func copyFile(from string, to string, fsync bool) (err error) {
+	// copyFile streams a payload to its target, decompressing it if needed.
+	// Every handle is closed before returning, so running hundreds of copies
+	// doesn't run out of file descriptors.
+
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+
+	reader, err := openPayload(from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	err = unlinkTarget(to)
+	if err != nil {
+		return err
+	}
+
+	writer, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if file, ok := reader.(*os.File); ok {
+		// Plain files can be copied by the kernel without a buffer
+		_, err = io.Copy(writer, file)
+	} else {
+		buffer := copyBuffers.Get().(*[]byte)
+		// Hide ReadFrom, it would bring its own buffer
+		_, err = io.CopyBuffer(struct{ io.Writer }{writer}, reader, *buffer)
+		copyBuffers.Put(buffer)
+	}
+	if err != nil {
+		return err
+	}
+
+	if fsync {
+		err = writer.Sync()
+	}
+
+	return err
+}
+
+func unlinkTarget(to string) error {
+	// Targets may be hardlinks into a Store, they are replaced instead of
+	// written through. Folders are left alone, writing the file fails on
+	// them as before.
+
+	info, err := os.Lstat(to)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+
+	return os.Remove(to)
+}
+
+func breakLink(path string) error {
+	// Gives a file that may be a hardlink into a Store its own copy of the
+	// content, for the few places that write to extracted files in place.
+	// Where link counts aren't available every file is copied.
+
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if links, err := linkCount(info); err == nil && links < 2 {
+		return nil
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	temporary.Close()
+
+	err = copyFile(path, temporary.Name(), false)
+	if err == nil {
+		err = os.Chmod(temporary.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(temporary.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temporary.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,44 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	root := filepath.Dir(writeSyntheticPackage(t))
+	out := t.TempDir()
+
+	openBefore := countOpenFiles(t)
+
+	for i := 0; i < 50; i++ {
+		err := copyFile(filepath.Join(root, "resources/f0002.dat"), filepath.Join(out, "deep/b.txt"), i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if openAfter := countOpenFiles(t); openAfter > openBefore {
+		t.Errorf("leaked file descriptors: %d before, %d after", openBefore, openAfter)
+	}
+
+	content, err := os.ReadFile(filepath.Join(out, "deep/b.txt"))
+	if err != nil || string(content) != "b\n" {
+		t.Errorf("unexpected content %q: %v", content, err)
+	}
+
+	err = copyFile(filepath.Join(root, "resources/missing.dat"), filepath.Join(out, "missing"), false)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func countOpenFiles(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd to count file descriptors")
+	}
+
+	return len(entries)
+}
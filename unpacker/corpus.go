@@ -0,0 +1,302 @@
+package unpacker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CorpusFilename is the default database of indexed packages
+const CorpusFilename = "upupandaway-corpus.json"
+
+// Corpus is a database of many packages, stored as a single JSON file
+type Corpus struct {
+	Packages []CorpusPackage `json:"packages"`
+}
+
+// CorpusPackage is everything indexed of a single package
+type CorpusPackage struct {
+	Name       string    `json:"name"`
+	PackageID  int64     `json:"package_id"`
+	UPType     string    `json:"up_type,omitempty"`
+	SubUPType  string    `json:"sub_up_type,omitempty"`
+	Source     string    `json:"source"`
+	MainSHA256 string    `json:"main_instructions_sha256"`
+	Indexed    time.Time `json:"indexed"`
+	// SubInis are the sub inis as folder/filename
+	SubInis []string `json:"sub_inis"`
+	// Instructions are the steps of the main ini followed by those of all
+	// sub inis
+	Instructions []StepRef `json:"instructions"`
+	// Outputs are the paths on the target touched by the package
+	Outputs []string     `json:"outputs"`
+	Files   []CorpusFile `json:"files"`
+}
+
+// CorpusFile is a payload shipped by a package, hashed decompressed
+type CorpusFile struct {
+	// Target is the path a Copy writes to or the partition of an ImageUpdate
+	Target  string  `json:"target,omitempty"`
+	Payload string  `json:"payload"`
+	Size    int64   `json:"size"`
+	SHA256  string  `json:"sha256"`
+	Step    StepRef `json:"step"`
+}
+
+// CorpusQuery selects packages, a package has to match every criterion that
+// is set
+type CorpusQuery struct {
+	// Hash is a SHA-256 of a payload or a prefix of it
+	Hash string
+	// Step is an instruction name like ImageUpdate, or part of the arguments
+	// of a step, which includes the folders of the main steps
+	Step string
+	// Path is part of an output path
+	Path string
+	// PackageID is the exact PackageID
+	PackageID int64
+}
+
+// CorpusMatch is a package matching a query with what matched
+type CorpusMatch struct {
+	Name      string   `json:"name"`
+	PackageID int64    `json:"package_id"`
+	Source    string   `json:"source"`
+	Matches   []string `json:"matches"`
+}
+
+func LoadCorpus(filename string) (*Corpus, error) {
+	// LoadCorpus reads a corpus, a missing file is an empty corpus
+
+	corpus := &Corpus{Packages: make([]CorpusPackage, 0)}
+
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return corpus, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return corpus, json.Unmarshal(content, corpus)
+}
+
+func (corpus *Corpus) Save(filename string) error {
+	// Save replaces the file only once the new content is on disk, so an
+	// interrupted index run keeps the old database. The corpus has a single
+	// writer: runs saving the same file at the same time don't corrupt it,
+	// but the last one wins and the packages indexed by the others are lost.
+
+	content, err := json.MarshalIndent(corpus, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Only left over if something failed
+		os.Remove(temporary.Name())
+	}()
+
+	_, err = temporary.Write(append(content, '\n'))
+	if err == nil {
+		err = temporary.Sync()
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// CreateTemp makes files 0600
+		err = os.Chmod(temporary.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporary.Name(), filename)
+}
+
+func FindPackages(root string) ([]string, error) {
+	// FindPackages returns the main_instructions.ini of every package below
+	// root
+
+	found := make([]string, 0)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Name() == "main_instructions.ini" {
+			found = append(found, path)
+		}
+		return nil
+	})
+
+	return found, err
+}
+
+func IndexPackage(tree []*Ini) (CorpusPackage, error) {
+	// IndexPackage collects the identity, the instructions, the output paths
+	// and the payload hashes of a package. Payloads are hashed as they end up
+	// on the device, so .gz payloads are hashed decompressed and match a
+	// hash taken from a device or an extraction.
+
+	main := tree[0]
+
+	marker, err := NewMarker(tree)
+	if err != nil {
+		return CorpusPackage{}, err
+	}
+
+	pkg := CorpusPackage{
+		Name:         PackageName(tree),
+		PackageID:    marker.PackageID,
+		UPType:       marker.UPType,
+		SubUPType:    marker.SubUPType,
+		Source:       marker.Source,
+		MainSHA256:   marker.MainSHA256,
+		Indexed:      time.Now().UTC().Truncate(time.Second),
+		SubInis:      make([]string, 0),
+		Instructions: make([]StepRef, 0),
+		Outputs:      BuildProvenance(tree).Paths(),
+		Files:        make([]CorpusFile, 0),
+	}
+
+	mainFile := &Ini{Filename: filepath.Base(main.Filename)}
+	for _, instruction := range main.Instructions.Instructions {
+		pkg.Instructions = append(pkg.Instructions, newStepRef(mainFile, instruction))
+	}
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+		pkg.SubInis = append(pkg.SubInis, filepath.ToSlash(filepath.Join(ini.Folder, ini.Filename)))
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+			pkg.Instructions = append(pkg.Instructions, ref)
+
+			payload := InstructionPayload(ini, instruction)
+			if payload == "" {
+				continue
+			}
+
+			// A Copy without target is broken, its payload is still indexed
+			// so it's found by hash
+			file := CorpusFile{Step: ref}
+			if instruction.InstructionStep != Copy {
+				file.Target = instruction.Arguments[0]
+			} else if len(instruction.Arguments) > 1 {
+				file.Target = devicePath(instruction.Arguments[1])
+			}
+			relative, _ := filepath.Rel(main.RootDir, payload)
+			file.Payload = filepath.ToSlash(relative)
+
+			reader, err := openPayload(payload)
+			if err != nil {
+				// Packages with missing payloads are still worth indexing,
+				// validate reports them
+				continue
+			}
+			entry, err := hashEntry(reader)
+			reader.Close()
+			if err != nil {
+				continue
+			}
+			file.Size, file.SHA256 = entry.size, entry.hash
+
+			pkg.Files = append(pkg.Files, file)
+		}
+	}
+
+	return pkg, nil
+}
+
+func (corpus *Corpus) Add(pkg CorpusPackage) {
+	// Add indexes a package, replacing an earlier index of the same folder
+
+	replaced := false
+	for i := range corpus.Packages {
+		if corpus.Packages[i].Source == pkg.Source {
+			corpus.Packages[i], replaced = pkg, true
+		}
+	}
+	if !replaced {
+		corpus.Packages = append(corpus.Packages, pkg)
+	}
+
+	sort.SliceStable(corpus.Packages, func(i, j int) bool {
+		a, b := corpus.Packages[i], corpus.Packages[j]
+		if a.PackageID != b.PackageID {
+			return a.PackageID < b.PackageID
+		}
+		return a.Source < b.Source
+	})
+}
+
+func (corpus *Corpus) Query(query CorpusQuery) []CorpusMatch {
+	// Query returns the matching packages ordered by PackageID, with a line
+	// for every payload, step or path that matched
+
+	hash := strings.ToLower(query.Hash)
+	step := strings.ToLower(query.Step)
+	path := strings.ToLower(query.Path)
+
+	result := make([]CorpusMatch, 0)
+
+	for _, pkg := range corpus.Packages {
+		if query.PackageID != 0 && pkg.PackageID != query.PackageID {
+			continue
+		}
+
+		match := CorpusMatch{Name: pkg.Name, PackageID: pkg.PackageID, Source: pkg.Source, Matches: make([]string, 0)}
+		matches := true
+
+		if hash != "" {
+			found := make([]string, 0)
+			for _, file := range pkg.Files {
+				if strings.HasPrefix(file.SHA256, hash) {
+					found = append(found, file.SHA256+" "+file.Target+" from "+file.Payload)
+				}
+			}
+			matches = matches && len(found) > 0
+			match.Matches = append(match.Matches, found...)
+		}
+
+		if step != "" {
+			found := make([]string, 0)
+			for _, ref := range pkg.Instructions {
+				if strings.ToLower(ref.Instruction) == step ||
+					strings.Contains(strings.ToLower(strings.Join(ref.Arguments, ", ")), step) {
+					found = append(found, ref.String())
+				}
+			}
+			matches = matches && len(found) > 0
+			match.Matches = append(match.Matches, found...)
+		}
+
+		if path != "" {
+			found := make([]string, 0)
+			for _, output := range pkg.Outputs {
+				if strings.Contains(strings.ToLower(output), path) {
+					found = append(found, output)
+				}
+			}
+			matches = matches && len(found) > 0
+			match.Matches = append(match.Matches, found...)
+		}
+
+		if matches {
+			result = append(result, match)
+		}
+	}
+
+	return result
+}
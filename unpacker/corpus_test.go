@@ -0,0 +1,100 @@
+package unpacker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCorpus(t *testing.T) {
+	first := writeSyntheticPackage(t)
+
+	// A second version runs its script from a passwdupdate folder and ships a
+	// new b.txt
+	second := writeSyntheticPackage(t)
+	dir := filepath.Dir(second)
+	main, _ := os.ReadFile(second)
+	main = []byte(strings.ReplaceAll(string(main), "1587449549", "1587449550"))
+	main = []byte(strings.ReplaceAll(string(main), "bootstrap", "passwdupdate"))
+	os.WriteFile(second, main, 0644)
+	os.Rename(filepath.Join(dir, "bootstrap"), filepath.Join(dir, "passwdupdate"))
+	writeFiles(t, dir, map[string]string{"resources/f0002.dat": "new b\n"})
+
+	corpus, err := LoadCorpus(filepath.Join(t.TempDir(), CorpusFilename))
+	if err != nil || len(corpus.Packages) != 0 {
+		t.Fatalf("missing corpus: got %v %v", corpus, err)
+	}
+
+	for _, path := range []string{second, first, first} {
+		pkg, err := IndexPackage(ParseIniTree(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus.Add(pkg)
+	}
+
+	if len(corpus.Packages) != 2 || corpus.Packages[0].PackageID != 1587449549 {
+		t.Fatalf("unexpected packages %+v", corpus.Packages)
+	}
+
+	filename := filepath.Join(t.TempDir(), CorpusFilename)
+	if err := corpus.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	corpus, err = LoadCorpus(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b.txt is shipped gzipped, it's found by the hash of its content
+	hash := sha256.Sum256([]byte("b\n"))
+	matches := corpus.Query(CorpusQuery{Hash: hex.EncodeToString(hash[:])[:12]})
+	if len(matches) != 1 || matches[0].PackageID != 1587449549 || len(matches[0].Matches) != 1 ||
+		!strings.HasSuffix(matches[0].Matches[0], " /usr/share/app/b.txt from resources/f0002.dat") {
+		t.Errorf("hash query: got %+v", matches)
+	}
+
+	if matches := corpus.Query(CorpusQuery{Step: "PasswdUpdate"}); len(matches) != 1 || matches[0].PackageID != 1587449550 {
+		t.Errorf("step query: got %+v", matches)
+	}
+
+	if matches := corpus.Query(CorpusQuery{Step: "imageupdate", Path: "/data/marker"}); len(matches) != 2 || len(matches[1].Matches) != 3 {
+		t.Errorf("combined query: got %+v", matches)
+	}
+
+	if matches := corpus.Query(CorpusQuery{Path: "/data", PackageID: 1587449550}); len(matches) != 1 || matches[0].PackageID != 1587449550 {
+		t.Errorf("package query: got %+v", matches)
+	}
+}
+
+func TestIndexPackageBrokenCopy(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	root := filepath.Dir(main)
+
+	writeFiles(t, root, map[string]string{
+		"resources/files.ini": "[Instructions]\nCount = 1\n1 = Copy, resources/f0001.dat\n",
+	})
+
+	pkg, err := IndexPackage(ParseIniTree(main))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkg.Files) != 3 || pkg.Files[2].Target != "" || pkg.Files[2].Payload != "resources/f0001.dat" {
+		t.Errorf("unexpected files %+v", pkg.Files)
+	}
+
+	// Saving leaves nothing but the database behind
+	dir := t.TempDir()
+	corpus := &Corpus{Packages: []CorpusPackage{pkg}}
+	for i := 0; i < 2; i++ {
+		if err := corpus.Save(filepath.Join(dir, CorpusFilename)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("unexpected files after saving %v", entries)
+	}
+}
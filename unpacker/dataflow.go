@@ -0,0 +1,311 @@
+package unpacker
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Flow follows a single file copied by the package: which later steps run
+// it, mention it otherwise and remove it again
+type Flow struct {
+	Path string  `json:"path"`
+	Copy StepRef `json:"copy"`
+	// Script is true for a target ending in .sh or a payload starting with #!
+	Script  bool      `json:"script"`
+	Run     []StepRef `json:"run,omitempty"`
+	Used    []StepRef `json:"used,omitempty"`
+	Removed []StepRef `json:"removed,omitempty"`
+}
+
+// DataFlow is the result of BuildDataFlow
+type DataFlow struct {
+	Flows    []*Flow   `json:"flows"`
+	Findings []Finding `json:"findings"`
+}
+
+// interpreters run the script given as first argument that isn't a flag
+var interpreters = map[string]bool{"sh": true, "bash": true, "ash": true, "dash": true, "source": true, ".": true}
+
+func BuildDataFlow(tree []*Ini) *DataFlow {
+	// BuildDataFlow links every Copy target to the Execute steps running or
+	// mentioning it and the Remove, RemoveFolderContent and rm removing it,
+	// across the whole tree in package order, see virtualFS. It flags scripts
+	// that are run but never copied, scripts copied but never run and files
+	// copied to /tmp that are left behind.
+
+	flow := &DataFlow{Flows: make([]*Flow, 0), Findings: make([]Finding, 0)}
+	fs := newVirtualFS()
+
+	add := func(severity Severity, ref StepRef, format string, args ...interface{}) {
+		flow.Findings = append(flow.Findings, Finding{Severity: severity, Message: fmt.Sprintf(format, args...), Step: &ref})
+	}
+
+	remove := func(files []*VirtualFile, ref StepRef) {
+		for _, file := range files {
+			if file.flow != nil {
+				file.flow.Removed = append(file.flow.Removed, ref)
+			}
+		}
+	}
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+
+			if instruction.InstructionStep != Execute {
+				added, removed := fs.apply(ini, instruction)
+				remove(removed, ref)
+
+				if added != nil && instruction.InstructionStep == Copy {
+					f := &Flow{Path: added.Path, Copy: ref, Script: strings.HasSuffix(added.Path, ".sh")}
+					if !f.Script {
+						f.Script = payloadIsScript(sourcePath(ini, instruction.Arguments[0]))
+					}
+					added.flow = f
+					flow.Flows = append(flow.Flows, f)
+				}
+				continue
+			}
+
+			for _, command := range shellCommands(strings.Join(instruction.Arguments, " ")) {
+				program, args := commandProgram(command)
+
+				if program != "" {
+					if f := fs.flow(program); f != nil {
+						appendRef(&f.Run, ref)
+					} else if fs.removed[program] {
+						add(SeverityWarning, ref, "%s is run after it was removed", program)
+					} else if strings.HasSuffix(program, ".sh") || isBelow(program, "/tmp") {
+						add(SeverityWarning, ref, "%s is run but never copied", program)
+					}
+				}
+
+				if filepath.Base(command[0]) == "rm" {
+					remove(fs.command(command), ref)
+					continue
+				}
+
+				for _, word := range args {
+					if !strings.HasPrefix(word, "/") {
+						continue
+					}
+					if f := fs.flow(filepath.Clean(word)); f != nil {
+						appendRef(&f.Used, ref)
+					}
+				}
+			}
+		}
+	}
+
+	for _, f := range flow.Flows {
+		if f.Script && len(f.Run) == 0 {
+			add(SeverityInfo, f.Copy, "script %s is copied but never run", f.Path)
+		}
+		if isBelow(f.Path, "/tmp") && len(f.Removed) == 0 && fs.flow(f.Path) == f {
+			add(SeverityInfo, f.Copy, "temporary file %s is left behind", f.Path)
+		}
+	}
+
+	return flow
+}
+
+// VirtualFile is a file the package puts on the device
+type VirtualFile struct {
+	Path string
+	// Source is the payload in the package, empty for Create
+	Source string
+	// Size is -1 until the payload was read, see Debugger
+	Size int64
+	Step StepRef
+
+	// flow follows a copied file through BuildDataFlow
+	flow *Flow
+}
+
+// virtualFS is the filesystem of the device as far as the package changes
+// it: the files copied and created by the steps, until steps or rm commands
+// remove them again. BuildDataFlow and the Debugger apply steps to it in
+// package order, the same way applyStep does on a real filesystem.
+type virtualFS struct {
+	Files map[string]*VirtualFile
+	// removed are the paths that existed and were removed again
+	removed map[string]bool
+}
+
+func newVirtualFS() *virtualFS {
+	return &virtualFS{Files: make(map[string]*VirtualFile), removed: make(map[string]bool)}
+}
+
+func packageFiles(tree []*Ini) map[string]*VirtualFile {
+	// The files an extraction of tree leaves, known from the package alone
+
+	fs := newVirtualFS()
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+		for _, instruction := range ini.Instructions.Instructions {
+			fs.apply(ini, instruction)
+		}
+	}
+
+	return fs.Files
+}
+
+func (fs *virtualFS) apply(ini *Ini, instruction Instruction) (*VirtualFile, []*VirtualFile) {
+	// Applies a Copy, Create, Remove or RemoveFolderContent step and returns
+	// the file it added and the files it removed. Execute steps are applied
+	// command by command, see command.
+
+	target, err := stepTarget(ini, instruction)
+	if err != nil || target == "" {
+		return nil, nil
+	}
+
+	file := &VirtualFile{Path: target, Step: newStepRef(ini, instruction)}
+
+	switch instruction.InstructionStep {
+	case Copy:
+		file.Size = -1
+		file.Source, _ = filepath.Rel(ini.RootDir, sourcePath(ini, instruction.Arguments[0]))
+	case Create:
+		// Like createFile an existing file is kept
+		if fs.Files[target] != nil {
+			return nil, nil
+		}
+	case Remove:
+		return nil, fs.remove(target, true, true)
+	case RemoveFolderContent:
+		return nil, fs.remove(target, false, true)
+	}
+
+	fs.Files[target] = file
+	delete(fs.removed, target)
+
+	return file, nil
+}
+
+func (fs *virtualFS) command(command []string) []*VirtualFile {
+	// Applies a shell command of an Execute step and returns the files it
+	// removed. Only rm changes the filesystem as far as it is known.
+
+	if filepath.Base(command[0]) != "rm" {
+		return nil
+	}
+
+	removed := make([]*VirtualFile, 0)
+	flags, paths := splitFlags(command[1:], false)
+	for _, path := range paths {
+		removed = append(removed, fs.remove(devicePath(path), true, strings.ContainsAny(flags, "rR"))...)
+	}
+
+	return removed
+}
+
+func (fs *virtualFS) remove(path string, self bool, below bool) []*VirtualFile {
+	// Removes path itself and/or the files below it, in path order
+
+	removed := make([]*VirtualFile, 0)
+	for _, target := range sortedKeys(fs.Files) {
+		if self && target == path || below && isBelow(target, path) {
+			removed = append(removed, fs.Files[target])
+			delete(fs.Files, target)
+			fs.removed[target] = true
+		}
+	}
+
+	return removed
+}
+
+func (fs *virtualFS) flow(path string) *Flow {
+	if file := fs.Files[path]; file != nil {
+		return file.flow
+	}
+
+	return nil
+}
+
+func commandProgram(command []string) (string, []string) {
+	// commandProgram returns the device path of the program a command runs
+	// and the remaining arguments. Commands found in $PATH like echo return
+	// an empty program.
+
+	program, args := command[0], command[1:]
+
+	if interpreters[filepath.Base(program)] {
+		for i, arg := range args {
+			if !strings.HasPrefix(arg, "-") {
+				return devicePath(arg), args[i+1:]
+			}
+		}
+		return "", args
+	}
+
+	if !strings.Contains(program, "/") {
+		return "", args
+	}
+
+	return devicePath(program), args
+}
+
+func appendRef(refs *[]StepRef, ref StepRef) {
+	// An Execute step can mention the same file in several commands
+
+	if n := len(*refs); n > 0 && (*refs)[n-1].MainStepNo == ref.MainStepNo && (*refs)[n-1].StepNo == ref.StepNo {
+		return
+	}
+
+	*refs = append(*refs, ref)
+}
+
+func isBelow(path string, folder string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(folder, "/")+"/")
+}
+
+func payloadIsScript(from string) bool {
+	payload, err := openPayload(from)
+	if err != nil {
+		return false
+	}
+	defer payload.Close()
+
+	head := make([]byte, 2)
+	n, _ := io.ReadFull(payload, head)
+
+	return isScript(head[:n])
+}
+
+func (flow *DataFlow) WriteText(w io.Writer) {
+	// WriteText writes every flow with its steps, followed by the findings
+
+	for _, f := range flow.Flows {
+		fmt.Fprintf(w, "%s\n  copied  %s\n", f.Path, f.Copy)
+
+		steps := []struct {
+			name string
+			refs []StepRef
+		}{
+			{"run", f.Run},
+			{"used", f.Used},
+			{"removed", f.Removed},
+		}
+		for _, step := range steps {
+			for _, ref := range step.refs {
+				fmt.Fprintf(w, "  %-7s %s\n", step.name, ref)
+			}
+		}
+	}
+
+	if len(flow.Findings) > 0 {
+		fmt.Fprintf(w, "\nFindings:\n")
+	}
+	for _, finding := range flow.Findings {
+		fmt.Fprintf(w, "  %s: %s (%s)\n", finding.Severity, finding.Message, finding.Step)
+	}
+}
@@ -0,0 +1,64 @@
+package unpacker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildDataFlow(t *testing.T) {
+	flow := BuildDataFlow(ParseIniTree(writeSyntheticPackage(t)))
+
+	if len(flow.Findings) != 0 {
+		t.Errorf("synthetic package should have no findings: %+v", flow.Findings)
+	}
+
+	setup := flow.Flows[0]
+	if setup.Path != "/tmp/setup.sh" || !setup.Script || len(setup.Run) != 1 || setup.Run[0].StepNo != 2 ||
+		len(setup.Removed) != 1 || setup.Removed[0].StepNo != 4 {
+		t.Errorf("unexpected flow of setup.sh: %+v", setup)
+	}
+
+	instruction := func(stepNo int, step InstructionStep, arguments ...string) Instruction {
+		return Instruction{StepNo: stepNo, InstructionStep: step, Arguments: arguments}
+	}
+
+	tree := []*Ini{{}, {
+		Folder:   "scripts",
+		Filename: "execute.ini",
+		Step:     Instruction{StepNo: 1},
+		Instructions: Instructions{Instructions: []Instruction{
+			instruction(1, Copy, "e0000000001.dat", "compactwnn_dictionary.sh"),
+			instruction(2, Copy, "e0000000002.dat", "unused.sh"),
+			instruction(3, Copy, "e0000000003.dat", "data.tar"),
+			instruction(4, Execute, "sh -e compactwnn_dictionary.sh && tar xf /tmp/data.tar -C /"),
+			instruction(5, Execute, "/tmp/missing.sh; echo done"),
+			instruction(6, Execute, "rm -f /tmp/compactwnn_dictionary.sh"),
+			instruction(7, Execute, "/tmp/compactwnn_dictionary.sh"),
+		}},
+	}}
+
+	flow = BuildDataFlow(tree)
+
+	if len(flow.Flows[0].Run) != 1 || len(flow.Flows[0].Removed) != 1 || flow.Flows[0].Removed[0].StepNo != 6 {
+		t.Errorf("unexpected flow of compactwnn_dictionary.sh: %+v", flow.Flows[0])
+	}
+	if len(flow.Flows[2].Used) != 1 || flow.Flows[2].Used[0].StepNo != 4 {
+		t.Errorf("unexpected flow of data.tar: %+v", flow.Flows[2])
+	}
+
+	messages := make([]string, 0)
+	for _, finding := range flow.Findings {
+		messages = append(messages, finding.Message)
+	}
+
+	want := []string{
+		"/tmp/missing.sh is run but never copied",
+		"/tmp/compactwnn_dictionary.sh is run after it was removed",
+		"script /tmp/unused.sh is copied but never run",
+		"temporary file /tmp/unused.sh is left behind",
+		"temporary file /tmp/data.tar is left behind",
+	}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("got findings %#v, want %#v", messages, want)
+	}
+}
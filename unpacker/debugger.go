@@ -0,0 +1,330 @@
+package unpacker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Debugger walks the execution plan of a package like the device would,
+// one instruction at a time, and applies every step to a virtual filesystem
+type Debugger struct {
+	tree []*Ini
+	plan []PlanStep
+	// position is the index of the current main step in plan, sub the index
+	// of the next instruction of its sub ini
+	position int
+	sub      int
+
+	breakpoints map[string]bool
+	fs          *virtualFS
+	// Files is the virtual filesystem by absolute path on the device, the
+	// files of fs
+	Files map[string]*VirtualFile
+	// Images are the payloads written by ImageUpdate by partition
+	Images map[string]StepRef
+}
+
+const debuggerHelp = `step, s              run the next instruction, entering sub inis
+next, n              run the rest of the current main step
+continue, c          run until a breakpoint or the end
+break, b [folder]    stop before main steps of a folder or BreakPoint region, list breakpoints without folder
+delete, d <folder>   remove a breakpoint
+print fs [path]      list the virtual filesystem below path
+print images         list the images written by ImageUpdate
+show instruction     show the current instruction
+show plan            show the main steps and the current position
+quit, q              leave the debugger
+`
+
+func NewDebugger(tree []*Ini) *Debugger {
+	// NewDebugger stops before the first main step. BreakPoint markers always
+	// stop continue, further breakpoints are set by folder.
+
+	fs := newVirtualFS()
+
+	return &Debugger{
+		tree:        tree,
+		plan:        ExecutionPlan(tree),
+		breakpoints: make(map[string]bool),
+		fs:          fs,
+		Files:       fs.Files,
+		Images:      make(map[string]StepRef),
+	}
+}
+
+func (d *Debugger) Finished() bool {
+	return d.position >= len(d.plan)
+}
+
+func (d *Debugger) Break(folder string) {
+	d.breakpoints[folder] = true
+}
+
+func (d *Debugger) Step(out io.Writer) {
+	// Step runs a single instruction: the next one of the current sub ini, or
+	// the main step itself if it has no sub ini
+
+	if d.Finished() {
+		fmt.Fprintln(out, "the package has finished")
+		return
+	}
+
+	step := d.plan[d.position]
+	ini := step.Ini
+
+	if ini == nil {
+		fmt.Fprintf(out, "%s\n", mainStepText(step))
+		if step.Instruction.InstructionStep == BreakPoint && len(step.Instruction.Arguments) > 1 {
+			fmt.Fprintf(out, "  %s of region %s\n", step.Instruction.Arguments[1], step.Instruction.Arguments[0])
+		}
+		d.advance()
+		return
+	}
+
+	if d.sub == 0 {
+		fmt.Fprintf(out, "%s\n", mainStepText(step))
+	}
+
+	if d.sub < len(ini.Instructions.Instructions) {
+		instruction := ini.Instructions.Instructions[d.sub]
+		fmt.Fprintf(out, "  %s\n", newStepRef(ini, instruction))
+		d.apply(ini, instruction, out)
+		d.sub++
+	}
+
+	if d.sub >= len(ini.Instructions.Instructions) {
+		d.advance()
+	}
+}
+
+func (d *Debugger) Next(out io.Writer) {
+	// Next runs the rest of the current main step
+
+	if d.Finished() {
+		fmt.Fprintln(out, "the package has finished")
+		return
+	}
+
+	for position := d.position; d.position == position; {
+		d.Step(out)
+	}
+}
+
+func (d *Debugger) Continue(out io.Writer) {
+	// Continue runs main steps until the next one is a BreakPoint marker or
+	// has a breakpoint set on its folder
+
+	if d.Finished() {
+		fmt.Fprintln(out, "the package has finished")
+		return
+	}
+
+	d.Next(out)
+	for !d.Finished() && !d.stopsAt(d.plan[d.position]) {
+		d.Next(out)
+	}
+
+	if d.Finished() {
+		fmt.Fprintln(out, "the package has finished")
+	} else {
+		fmt.Fprintf(out, "stopped before %s\n", mainStepText(d.plan[d.position]))
+	}
+}
+
+func (d *Debugger) stopsAt(step PlanStep) bool {
+	if step.Instruction.InstructionStep == BreakPoint {
+		return true
+	}
+
+	return len(step.Instruction.Arguments) > 0 && d.breakpoints[step.Instruction.Arguments[0]]
+}
+
+func (d *Debugger) advance() {
+	d.position++
+	d.sub = 0
+}
+
+func (d *Debugger) apply(ini *Ini, instruction Instruction, out io.Writer) {
+	// Applies an instruction of a sub ini to the virtual filesystem, see
+	// virtualFS. Execute steps also apply the commands of the scripts they
+	// run.
+
+	args := instruction.Arguments
+
+	switch instruction.InstructionStep {
+	case ImageUpdate:
+		if len(args) > 0 {
+			d.Images[args[0]] = newStepRef(ini, instruction)
+		}
+	case Execute:
+		commands := shellCommands(strings.Join(args, " "))
+		for _, command := range commands {
+			program, _ := commandProgram(command)
+			if file := d.Files[program]; file != nil && file.Source != "" {
+				if script, err := readPayload(filepath.Join(ini.RootDir, file.Source)); err == nil && isScript(script) {
+					fmt.Fprintf(out, "    runs %s\n", program)
+					commands = append(commands, shellCommands(string(script))...)
+				}
+			}
+		}
+
+		for _, command := range commands {
+			printRemoved(d.fs.command(command), out)
+		}
+	default:
+		added, removed := d.fs.apply(ini, instruction)
+		if added != nil && added.Source != "" {
+			if payload, err := openPayload(filepath.Join(ini.RootDir, added.Source)); err == nil {
+				added.Size, _ = io.Copy(io.Discard, payload)
+				payload.Close()
+			}
+		}
+		printRemoved(removed, out)
+	}
+}
+
+func printRemoved(files []*VirtualFile, out io.Writer) {
+	for _, file := range files {
+		fmt.Fprintf(out, "    removes %s\n", file.Path)
+	}
+}
+
+func mainStepText(step PlanStep) string {
+	text := fmt.Sprintf("main %d %s %s", step.StepNo, step.Instruction.InstructionStep, strings.Join(step.Instruction.Arguments, ", "))
+	if len(step.Regions) > 0 {
+		text += " [" + strings.Join(step.Regions, " > ") + "]"
+	}
+
+	return text
+}
+
+func (d *Debugger) ShowInstruction(out io.Writer) {
+	if d.Finished() {
+		fmt.Fprintln(out, "the package has finished")
+		return
+	}
+
+	step := d.plan[d.position]
+	fmt.Fprintln(out, mainStepText(step))
+
+	if step.Ini != nil && d.sub < len(step.Ini.Instructions.Instructions) {
+		instruction := step.Ini.Instructions.Instructions[d.sub]
+		fmt.Fprintf(out, "  next %s\n", newStepRef(step.Ini, instruction))
+	}
+}
+
+func (d *Debugger) ShowPlan(out io.Writer) {
+	for i, step := range d.plan {
+		marker := "  "
+		if i == d.position {
+			marker = "=>"
+		}
+		if d.stopsAt(step) {
+			marker += "*"
+		} else {
+			marker += " "
+		}
+		fmt.Fprintf(out, "%s %s\n", marker, mainStepText(step))
+	}
+}
+
+func (d *Debugger) PrintFS(path string, out io.Writer) {
+	// PrintFS lists the files at or below path with their size and the step
+	// that wrote them
+
+	path = filepath.Join("/", path)
+	found := false
+
+	for _, name := range sortedKeys(d.Files) {
+		if name != path && !isBelow(name, path) {
+			continue
+		}
+		found = true
+
+		file := d.Files[name]
+		source := file.Source
+		if source == "" {
+			source = "(created)"
+		}
+		fmt.Fprintf(out, "%-40s %8d  %s  %s:%d\n", name, file.Size, source,
+			filepath.Join(file.Step.Folder, file.Step.Filename), file.Step.StepNo)
+	}
+
+	if !found {
+		fmt.Fprintf(out, "no files below %s\n", path)
+	}
+}
+
+func (d *Debugger) Run(in io.Reader, out io.Writer) error {
+	// Run reads commands from in until quit or the end of the input, see
+	// debuggerHelp
+
+	scanner := bufio.NewScanner(in)
+	d.ShowInstruction(out)
+
+	for {
+		fmt.Fprint(out, "(up) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		argument := strings.Join(words[1:], " ")
+
+		switch words[0] {
+		case "step", "s":
+			d.Step(out)
+		case "next", "n":
+			d.Next(out)
+		case "continue", "c":
+			d.Continue(out)
+		case "break", "b":
+			if argument == "" {
+				for _, folder := range sortedKeys(d.breakpoints) {
+					fmt.Fprintln(out, folder)
+				}
+				continue
+			}
+			d.Break(argument)
+		case "delete", "d":
+			delete(d.breakpoints, argument)
+		case "print", "p":
+			switch {
+			case len(words) > 1 && words[1] == "fs":
+				path := "/"
+				if len(words) > 2 {
+					path = words[2]
+				}
+				d.PrintFS(path, out)
+			case len(words) > 1 && words[1] == "images":
+				for _, partition := range sortedKeys(d.Images) {
+					fmt.Fprintf(out, "%-16s %s\n", partition, d.Images[partition])
+				}
+			default:
+				fmt.Fprintln(out, "print fs [path] or print images")
+			}
+		case "show":
+			switch argument {
+			case "instruction":
+				d.ShowInstruction(out)
+			case "plan":
+				d.ShowPlan(out)
+			default:
+				fmt.Fprintln(out, "show instruction or show plan")
+			}
+		case "help", "h", "?":
+			fmt.Fprint(out, debuggerHelp)
+		case "quit", "q", "exit":
+			return nil
+		default:
+			fmt.Fprintf(out, "unknown command %s, try help\n", words[0])
+		}
+	}
+}
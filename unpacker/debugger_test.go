@@ -0,0 +1,36 @@
+package unpacker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebugger(t *testing.T) {
+	debugger := NewDebugger(ParseIniTree(writeSyntheticPackage(t)))
+
+	var out strings.Builder
+	commands := "show instruction\ns\ns\nprint fs /tmp\nn\nb resources\nc\nprint images\nc\nc\nprint fs /usr\nq\n"
+	if err := debugger.Run(strings.NewReader(commands), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"main 1 Execute bootstrap, execute.ini\n  next bootstrap/execute.ini:1 Copy e0000000001.dat, setup.sh\n",
+		"    runs /tmp/setup.sh\n",
+		"/tmp/setup.sh                                 165  bootstrap/e0000000001.dat  bootstrap/execute.ini:1\n",
+		"    removes /tmp/setup.sh\n",
+		"stopped before main 4 FileUpdate resources, files.ini [reinstall]\n",
+		"kernel           linux1/binary.ini:1 ImageUpdate kernel, linux1.img\n",
+		"stopped before main 5 BreakPoint reinstall, End\n",
+		"the package has finished\n",
+		"/usr/share/app/a.txt                            9  resources/f0003.dat  resources/files.ini:4\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+
+	if !debugger.Finished() || len(debugger.Files) != 3 || debugger.Files["/tmp/setup.sh"] != nil {
+		t.Errorf("unexpected final state: %+v", debugger.Files)
+	}
+}
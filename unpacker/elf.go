@@ -0,0 +1,288 @@
+package unpacker
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// ELFInfo describes a single ELF file of an extraction
+type ELFInfo struct {
+	Path         string `json:"path"`
+	Architecture string `json:"architecture"`
+	Bits         int    `json:"bits"`
+	Endianness   string `json:"endianness"`
+	Type         string `json:"type"`
+	// Interpreter is the dynamic loader, empty for static binaries
+	Interpreter string   `json:"interpreter,omitempty"`
+	Needed      []string `json:"needed,omitempty"`
+	SONAME      string   `json:"soname,omitempty"`
+	Static      bool     `json:"static"`
+	// Stripped is true if the file has no .symtab
+	Stripped bool   `json:"stripped"`
+	BuildID  string `json:"build_id,omitempty"`
+	// Symbols are the notable functions the file imports or defines
+	Symbols []string  `json:"symbols,omitempty"`
+	Steps   []StepRef `json:"steps,omitempty"`
+}
+
+// notableSymbols are functions worth a second look when auditing a binary:
+// command execution, privilege changes, unsafe string handling and code
+// loading
+var notableSymbols = map[string]bool{
+	"system": true, "popen": true, "execl": true, "execle": true, "execlp": true, "execv": true,
+	"execve": true, "execvp": true, "fork": true, "setuid": true, "setgid": true, "seteuid": true,
+	"setresuid": true, "chroot": true, "ptrace": true, "mprotect": true, "dlopen": true,
+	"strcpy": true, "strcat": true, "sprintf": true, "vsprintf": true, "gets": true,
+	"inet_addr": true, "socket": true, "bind": true, "listen": true, "connect": true,
+	"EVP_DecryptInit_ex": true, "AES_set_decrypt_key": true, "RSA_public_decrypt": true,
+}
+
+// architectures maps ELF machines to the names used by GOARCH and most
+// distributions
+var architectures = map[elf.Machine]string{
+	elf.EM_386:     "386",
+	elf.EM_X86_64:  "amd64",
+	elf.EM_ARM:     "arm",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_MIPS:    "mips",
+	elf.EM_PPC:     "ppc",
+	elf.EM_PPC64:   "ppc64",
+	elf.EM_RISCV:   "riscv",
+	elf.EM_SH:      "sh",
+}
+
+var elfTypes = map[elf.Type]string{
+	elf.ET_REL:  "relocatable",
+	elf.ET_EXEC: "executable",
+	elf.ET_DYN:  "shared object",
+	elf.ET_CORE: "core",
+}
+
+func InventoryELF(tree []*Ini, extracted string) ([]ELFInfo, error) {
+	// InventoryELF describes every ELF file of an extraction, sorted by path,
+	// with the steps of the package that wrote it
+
+	provenance := BuildProvenance(tree)
+	root := FilesystemRoot(extracted)
+	infos := make([]ELFInfo, 0)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() || info.Size() < 4 {
+			return nil
+		}
+
+		isELF, err := hasELFMagic(path)
+		if err != nil || !isELF {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := "/" + filepath.ToSlash(rel)
+
+		elfInfo, err := readELF(path)
+		if err != nil {
+			// Truncated or otherwise broken files are still worth listing
+			elfInfo = &ELFInfo{Type: "invalid: " + err.Error()}
+		}
+		elfInfo.Path = name
+		elfInfo.Steps = provenance.For(name)
+
+		infos = append(infos, *elfInfo)
+
+		return nil
+	})
+
+	return infos, err
+}
+
+func hasELFMagic(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, nil
+	}
+
+	return string(magic) == elf.ELFMAG, nil
+}
+
+func readELF(path string) (*ELFInfo, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := &ELFInfo{
+		Architecture: architectures[file.Machine],
+		Bits:         32,
+		Endianness:   "little",
+		Type:         elfTypes[file.Type],
+		Stripped:     file.Section(".symtab") == nil,
+	}
+
+	if info.Architecture == "" {
+		info.Architecture = strings.ToLower(strings.TrimPrefix(file.Machine.String(), "EM_"))
+	}
+	if file.Class == elf.ELFCLASS64 {
+		info.Bits = 64
+	}
+	if file.ByteOrder == binary.BigEndian {
+		info.Endianness = "big"
+	} else if file.Machine == elf.EM_MIPS {
+		info.Architecture = "mipsle"
+	}
+	if info.Type == "" {
+		info.Type = file.Type.String()
+	}
+
+	dynamic := false
+	for _, prog := range file.Progs {
+		switch prog.Type {
+		case elf.PT_INTERP:
+			interpreter, err := io.ReadAll(prog.Open())
+			if err != nil {
+				return nil, err
+			}
+			info.Interpreter = string(bytes.TrimRight(interpreter, "\x00"))
+		case elf.PT_DYNAMIC:
+			dynamic = true
+		}
+	}
+	info.Static = info.Interpreter == "" && !dynamic
+
+	if dynamic {
+		// Errors mean there is no dynamic section, which is the case for a
+		// stripped section header table
+		info.Needed, _ = file.ImportedLibraries()
+		if sonames, _ := file.DynString(elf.DT_SONAME); len(sonames) > 0 {
+			info.SONAME = sonames[0]
+		}
+	}
+
+	info.BuildID = buildID(file)
+	info.Symbols = elfSymbols(file)
+
+	return info, nil
+}
+
+func buildID(file *elf.File) string {
+	// Reads the GNU build ID note, from the section if there is one and from
+	// the program headers otherwise
+
+	readers := make([]io.Reader, 0)
+	if section := file.Section(".note.gnu.build-id"); section != nil {
+		readers = append(readers, section.Open())
+	}
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_NOTE {
+			readers = append(readers, prog.Open())
+		}
+	}
+
+	for _, reader := range readers {
+		notes, err := io.ReadAll(reader)
+		if err != nil {
+			continue
+		}
+
+		for len(notes) >= 12 {
+			nameSize := int(file.ByteOrder.Uint32(notes[0:4]))
+			descSize := int(file.ByteOrder.Uint32(notes[4:8]))
+			noteType := file.ByteOrder.Uint32(notes[8:12])
+
+			nameEnd := 12 + (nameSize+3)&^3
+			descEnd := nameEnd + (descSize+3)&^3
+			if descEnd > len(notes) || nameSize > len(notes) || descSize > len(notes) {
+				break
+			}
+
+			name := string(bytes.TrimRight(notes[12:12+nameSize], "\x00"))
+			if name == "GNU" && noteType == 3 {
+				// NT_GNU_BUILD_ID
+				return hex.EncodeToString(notes[nameEnd : nameEnd+descSize])
+			}
+
+			notes = notes[descEnd:]
+		}
+	}
+
+	return ""
+}
+
+func elfSymbols(file *elf.File) []string {
+	// Notable symbols from the dynamic symbol table and, if the file isn't
+	// stripped, the full symbol table. Versioned names like system@GLIBC_2.0
+	// are reduced to the function name.
+
+	found := make(map[string]bool)
+
+	for _, read := range []func() ([]elf.Symbol, error){file.DynamicSymbols, file.Symbols} {
+		symbols, err := read()
+		if err != nil {
+			continue
+		}
+
+		for _, symbol := range symbols {
+			name := strings.SplitN(symbol.Name, "@", 2)[0]
+			if notableSymbols[name] && elf.ST_TYPE(symbol.Info) != elf.STT_OBJECT {
+				found[name] = true
+			}
+		}
+	}
+
+	return sortedKeys(found)
+}
+
+func WriteELFTable(infos []ELFInfo, w io.Writer) error {
+	// WriteELFTable writes the inventory as aligned table with one line per
+	// file
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(table, "PATH\tARCH\tBITS\tENDIAN\tTYPE\tINTERPRETER\tNEEDED\tSTRIPPED\tBUILD ID\tSYMBOLS\tSTEPS")
+	for _, info := range infos {
+		steps := make([]string, 0, len(info.Steps))
+		for _, ref := range info.Steps {
+			steps = append(steps, fmt.Sprintf("%s:%d", filepath.Join(ref.Folder, ref.Filename), ref.StepNo))
+		}
+
+		interpreter := info.Interpreter
+		if info.Static {
+			interpreter = "static"
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n", info.Path, info.Architecture, info.Bits,
+			info.Endianness, info.Type, dash(interpreter), dash(strings.Join(info.Needed, ",")), info.Stripped,
+			dash(info.BuildID), dash(strings.Join(info.Symbols, ",")), dash(strings.Join(steps, ",")))
+	}
+
+	return table.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
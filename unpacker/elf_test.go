@@ -0,0 +1,101 @@
+package unpacker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// minimalELF builds a big endian 32 bit MIPS executable with nothing but a
+// GNU build ID note
+func minimalELF(buildID []byte) []byte {
+	var b bytes.Buffer
+	be := binary.BigEndian
+
+	shstrtab := "\x00.note.gnu.build-id\x00.shstrtab\x00"
+	note := new(bytes.Buffer)
+	binary.Write(note, be, []uint32{4, uint32(len(buildID)), 3})
+	note.WriteString("GNU\x00")
+	note.Write(buildID)
+
+	noteOffset := 52
+	strtabOffset := noteOffset + note.Len()
+	shoff := (strtabOffset + len(shstrtab) + 3) &^ 3
+
+	b.Write([]byte{0x7f, 'E', 'L', 'F', 1, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	binary.Write(&b, be, []uint16{2, 8})                             // type, machine
+	binary.Write(&b, be, []uint32{1, 0x400000, 0, uint32(shoff), 0}) // version, entry, phoff, shoff, flags
+	binary.Write(&b, be, []uint16{52, 32, 0, 40, 3, 2})              // ehsize, phentsize, phnum, shentsize, shnum, shstrndx
+
+	b.Write(note.Bytes())
+	b.WriteString(shstrtab)
+	b.Write(make([]byte, shoff-b.Len()))
+
+	binary.Write(&b, be, make([]uint32, 10))
+	binary.Write(&b, be, []uint32{1, 7, 2, 0, uint32(noteOffset), uint32(note.Len()), 0, 0, 4, 0})
+	binary.Write(&b, be, []uint32{20, 3, 0, 0, uint32(strtabOffset), uint32(len(shstrtab)), 0, 0, 1, 0})
+
+	return b.Bytes()
+}
+
+func TestInventoryELF(t *testing.T) {
+	extracted := t.TempDir()
+
+	self, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, extracted, map[string]string{
+		"bin/mips":       string(minimalELF([]byte{0xde, 0xad, 0xbe, 0xef})),
+		"usr/bin/tool":   string(self),
+		"usr/share/text": "ELF is mentioned but not at the start",
+		"usr/lib/broken": "\x7fELF\x01",
+	})
+
+	tree := []*Ini{{}, {
+		Folder:   "resources",
+		Filename: "files.ini",
+		Step:     Instruction{StepNo: 1},
+		Instructions: Instructions{Instructions: []Instruction{
+			{StepNo: 3, InstructionStep: Copy, Arguments: []string{"resources/f0003.dat", "/bin/mips"}},
+		}},
+	}}
+
+	infos, err := InventoryELF(tree, extracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 3 {
+		t.Fatalf("expected 3 ELF files, got %+v", infos)
+	}
+
+	mips := infos[0]
+	if mips.Path != "/bin/mips" || mips.Architecture != "mips" || mips.Bits != 32 || mips.Endianness != "big" ||
+		mips.Type != "executable" || !mips.Static || !mips.Stripped || mips.BuildID != "deadbeef" {
+		t.Errorf("unexpected info for the MIPS binary: %+v", mips)
+	}
+	if len(mips.Steps) != 1 || mips.Steps[0].StepNo != 3 {
+		t.Errorf("MIPS binary points to the wrong steps: %+v", mips.Steps)
+	}
+
+	if infos[1].Path != "/usr/bin/tool" || infos[1].Architecture != runtime.GOARCH {
+		t.Errorf("unexpected info for the test binary: %+v", infos[1])
+	}
+
+	if !strings.HasPrefix(infos[2].Type, "invalid") {
+		t.Errorf("truncated ELF should be invalid: %+v", infos[2])
+	}
+
+	var table bytes.Buffer
+	if err := WriteELFTable(infos, &table); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table.String(), "resources/files.ini:3") {
+		t.Errorf("table is missing the provenance:\n%s", table.String())
+	}
+}
@@ -0,0 +1,323 @@
+package unpacker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FDTMagic starts every flattened device tree, DTBs as well as FIT images
+const FDTMagic = 0xd00dfeed
+
+// FDT structure block tokens
+const (
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtNop       = 4
+	fdtEnd       = 9
+)
+
+// FDTNode is a node of a flattened device tree
+type FDTNode struct {
+	Name       string
+	Properties []FDTProperty
+	Children   []*FDTNode
+}
+
+// FDTProperty is a property of a node with its raw value
+type FDTProperty struct {
+	Name  string
+	Value []byte
+}
+
+func ParseFDT(data []byte) (*FDTNode, error) {
+	// ParseFDT decodes a flattened device tree blob into its root node
+
+	if len(data) < 40 || binary.BigEndian.Uint32(data) != FDTMagic {
+		return nil, errors.New("no device tree magic")
+	}
+
+	header := make([]uint32, 10)
+	binary.Read(bytes.NewReader(data[:40]), binary.BigEndian, header)
+	totalSize, structOffset, stringsOffset := header[1], header[2], header[3]
+	stringsSize, structSize := header[8], header[9]
+
+	if int64(totalSize) > int64(len(data)) || int64(structOffset)+int64(structSize) > int64(totalSize) ||
+		int64(stringsOffset)+int64(stringsSize) > int64(totalSize) {
+		return nil, fmt.Errorf("device tree of %d bytes is truncated to %d bytes", totalSize, len(data))
+	}
+
+	structure := data[structOffset : structOffset+structSize]
+	names := data[stringsOffset : stringsOffset+stringsSize]
+
+	var root *FDTNode
+	stack := make([]*FDTNode, 0)
+	offset := 0
+
+	u32 := func() (uint32, error) {
+		if offset+4 > len(structure) {
+			return 0, errors.New("device tree structure is truncated")
+		}
+		value := binary.BigEndian.Uint32(structure[offset:])
+		offset += 4
+		return value, nil
+	}
+
+	for {
+		token, err := u32()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token {
+		case fdtBeginNode:
+			end := bytes.IndexByte(structure[offset:], 0)
+			if end < 0 {
+				return nil, errors.New("unterminated node name")
+			}
+			node := &FDTNode{Name: string(structure[offset : offset+end])}
+			offset = align4(offset + end + 1)
+
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, errors.New("device tree has several root nodes")
+				}
+				root = node
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			}
+			stack = append(stack, node)
+		case fdtEndNode:
+			if len(stack) == 0 {
+				return nil, errors.New("unbalanced end of node")
+			}
+			stack = stack[:len(stack)-1]
+		case fdtProp:
+			length, err := u32()
+			if err != nil {
+				return nil, err
+			}
+			nameOffset, err := u32()
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 || offset+int(length) > len(structure) || int(nameOffset) >= len(names) {
+				return nil, errors.New("invalid property")
+			}
+
+			name := names[nameOffset:]
+			if end := bytes.IndexByte(name, 0); end >= 0 {
+				name = name[:end]
+			}
+
+			node := stack[len(stack)-1]
+			node.Properties = append(node.Properties, FDTProperty{
+				Name:  string(name),
+				Value: structure[offset : offset+int(length)],
+			})
+			offset = align4(offset + int(length))
+		case fdtNop:
+		case fdtEnd:
+			if root == nil {
+				return nil, errors.New("device tree has no root node")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("unknown device tree token %d", token)
+		}
+	}
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// FDTSize returns the totalsize of the device tree header at the start of
+// data
+func FDTSize(data []byte) int {
+	if len(data) < 8 || binary.BigEndian.Uint32(data) != FDTMagic {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint32(data[4:]))
+}
+
+// FoundFDT is a device tree found inside a larger image
+type FoundFDT struct {
+	Offset int
+	Root   *FDTNode
+}
+
+// maxFDTs limits the device trees searched in a single image
+const maxFDTs = 64
+
+func FindFDTs(data []byte) []FoundFDT {
+	// FindFDTs finds the device trees in an image like a bootloader, a
+	// kernel with appended DTB or a flash dump
+
+	found := make([]FoundFDT, 0)
+	magic := []byte{0xd0, 0x0d, 0xfe, 0xed}
+
+	for offset := 0; len(found) < maxFDTs; offset += len(magic) {
+		i := bytes.Index(data[offset:], magic)
+		if i < 0 {
+			break
+		}
+		offset += i
+
+		if root, err := ParseFDT(data[offset:]); err == nil {
+			found = append(found, FoundFDT{offset, root})
+		}
+	}
+
+	return found
+}
+
+func (node *FDTNode) Child(name string) *FDTNode {
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+
+	return nil
+}
+
+func (node *FDTNode) Property(name string) []byte {
+	for _, property := range node.Properties {
+		if property.Name == name {
+			return property.Value
+		}
+	}
+
+	return nil
+}
+
+func (node *FDTNode) String(name string) string {
+	// String returns the first string of a property
+
+	value := node.Property(name)
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+
+	return string(value)
+}
+
+func (node *FDTNode) Strings(name string) []string {
+	// Strings returns a string list property like compatible
+
+	value := bytes.TrimRight(node.Property(name), "\x00")
+	if len(value) == 0 {
+		return nil
+	}
+
+	result := make([]string, 0)
+	for _, s := range bytes.Split(value, []byte{0}) {
+		result = append(result, string(s))
+	}
+
+	return result
+}
+
+func (node *FDTNode) Uint(name string) (uint64, bool) {
+	// Uint reads a property of one or two cells
+
+	value := node.Property(name)
+
+	switch len(value) {
+	case 4:
+		return uint64(binary.BigEndian.Uint32(value)), true
+	case 8:
+		return binary.BigEndian.Uint64(value), true
+	}
+
+	return 0, false
+}
+
+func (node *FDTNode) WriteDTS(w io.Writer) error {
+	// WriteDTS writes the tree in device tree source syntax. Values are shown
+	// as strings if they look like ones, as cells if their length is a
+	// multiple of 4 and as bytes otherwise. Long binary values like the
+	// images of a FIT are abbreviated.
+
+	var b strings.Builder
+	b.WriteString("/dts-v1/;\n\n")
+	writeDTSNode(&b, node, 0)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeDTSNode(b *strings.Builder, node *FDTNode, depth int) {
+	indent := strings.Repeat("\t", depth)
+
+	name := node.Name
+	if depth == 0 {
+		name = "/"
+	}
+	fmt.Fprintf(b, "%s%s {\n", indent, name)
+
+	for _, property := range node.Properties {
+		if len(property.Value) == 0 {
+			fmt.Fprintf(b, "%s\t%s;\n", indent, property.Name)
+			continue
+		}
+		fmt.Fprintf(b, "%s\t%s = %s;\n", indent, property.Name, dtsValue(property.Value))
+	}
+
+	for i, child := range node.Children {
+		if i > 0 || len(node.Properties) > 0 {
+			b.WriteString("\n")
+		}
+		writeDTSNode(b, child, depth+1)
+	}
+
+	fmt.Fprintf(b, "%s};\n", indent)
+}
+
+func dtsValue(value []byte) string {
+	if len(value) > 256 {
+		return fmt.Sprintf("[/* %d bytes */]", len(value))
+	}
+
+	if isDTSStrings(value) {
+		parts := make([]string, 0)
+		for _, s := range bytes.Split(value[:len(value)-1], []byte{0}) {
+			parts = append(parts, strconv.Quote(string(s)))
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	if len(value)%4 == 0 {
+		cells := make([]string, 0, len(value)/4)
+		for i := 0; i < len(value); i += 4 {
+			cells = append(cells, fmt.Sprintf("0x%x", binary.BigEndian.Uint32(value[i:])))
+		}
+		return "<" + strings.Join(cells, " ") + ">"
+	}
+
+	return "[" + strings.TrimSpace(fmt.Sprintf("% x", value)) + "]"
+}
+
+func isDTSStrings(value []byte) bool {
+	// NUL terminated, printable and without empty strings
+
+	if value[len(value)-1] != 0 || value[0] == 0 || bytes.Contains(value, []byte{0, 0}) {
+		return false
+	}
+
+	for _, c := range value[:len(value)-1] {
+		if c != 0 && (c < 0x20 || c > 0x7e) {
+			return false
+		}
+	}
+
+	return true
+}
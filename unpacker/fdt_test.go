@@ -0,0 +1,117 @@
+package unpacker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildFDT serializes a tree into a device tree blob
+func buildFDT(root *FDTNode) []byte {
+	var structure, names bytes.Buffer
+	nameOffsets := make(map[string]int)
+
+	pad := func() {
+		for structure.Len()%4 != 0 {
+			structure.WriteByte(0)
+		}
+	}
+
+	var write func(node *FDTNode)
+	write = func(node *FDTNode) {
+		binary.Write(&structure, binary.BigEndian, uint32(fdtBeginNode))
+		structure.WriteString(node.Name + "\x00")
+		pad()
+
+		for _, property := range node.Properties {
+			offset, exists := nameOffsets[property.Name]
+			if !exists {
+				offset = names.Len()
+				nameOffsets[property.Name] = offset
+				names.WriteString(property.Name + "\x00")
+			}
+
+			binary.Write(&structure, binary.BigEndian, []uint32{fdtProp, uint32(len(property.Value)), uint32(offset)})
+			structure.Write(property.Value)
+			pad()
+		}
+
+		for _, child := range node.Children {
+			write(child)
+		}
+		binary.Write(&structure, binary.BigEndian, uint32(fdtEndNode))
+	}
+	write(root)
+	binary.Write(&structure, binary.BigEndian, uint32(fdtEnd))
+
+	// Header, empty memory reservation map, structure, strings
+	structOffset := 40 + 16
+	stringsOffset := structOffset + structure.Len()
+	total := stringsOffset + names.Len()
+
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, []uint32{FDTMagic, uint32(total), uint32(structOffset), uint32(stringsOffset),
+		40, 17, 16, 0, uint32(names.Len()), uint32(structure.Len())})
+	blob.Write(make([]byte, 16))
+	blob.Write(structure.Bytes())
+	blob.Write(names.Bytes())
+
+	return blob.Bytes()
+}
+
+func cells(values ...uint32) []byte {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(value[4*i:], v)
+	}
+	return value
+}
+
+func TestParseFDT(t *testing.T) {
+	tree := &FDTNode{
+		Properties: []FDTProperty{
+			{"model", []byte("Vendor Board\x00")},
+			{"compatible", []byte("vendor,board\x00vendor,soc\x00")},
+		},
+		Children: []*FDTNode{
+			{Name: "memory@80000000", Properties: []FDTProperty{{"reg", cells(0x80000000, 0x20000000)}}},
+			{Name: "chosen", Properties: []FDTProperty{{"bootargs", []byte("console=ttymxc0\x00")}}},
+		},
+	}
+
+	blob := buildFDT(tree)
+	if FDTSize(blob) != len(blob) {
+		t.Errorf("FDTSize: got %d, want %d", FDTSize(blob), len(blob))
+	}
+
+	root, err := ParseFDT(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(root, tree) {
+		t.Errorf("got %+v, want %+v", root, tree)
+	}
+	if root.String("model") != "Vendor Board" || !reflect.DeepEqual(root.Strings("compatible"), []string{"vendor,board", "vendor,soc"}) {
+		t.Errorf("unexpected string properties: %q %q", root.String("model"), root.Strings("compatible"))
+	}
+	if value, ok := root.Child("memory@80000000").Uint("reg"); !ok || value != 0x8000000020000000 {
+		t.Errorf("unexpected reg: %x", value)
+	}
+
+	var dts strings.Builder
+	if err := root.WriteDTS(&dts); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\tcompatible = \"vendor,board\", \"vendor,soc\";\n", "\tmemory@80000000 {\n\t\treg = <0x80000000 0x20000000>;\n\t};\n"} {
+		if !strings.Contains(dts.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, dts.String())
+		}
+	}
+
+	if _, err := ParseFDT(blob[:len(blob)-8]); err == nil {
+		t.Error("truncated device tree should fail")
+	}
+}
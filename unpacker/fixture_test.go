@@ -0,0 +1,147 @@
+package unpacker
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Synthetic package that mimics the layout of a real unpacked .up file. Real
+// packages can't be distributed, so tests that don't need live files use this.
+var syntheticFiles = map[string]string{
+	"main_instructions.ini": `[Settings]
+PackageID = 1587449549
+CompressionType = GZIP
+TotalStepsCount = 10
+
+[Instructions]
+Count = 3
+1 = Execute, bootstrap, execute.ini, 4
+2 = ImageUpdate, linux1, binary.ini, 2
+3 = FileUpdate, resources, files.ini, 4
+
+[Instructions_Ext]
+Count = 5
+1 = Execute, bootstrap, execute.ini, 4
+2 = BreakPoint, reinstall, Start, 0
+3 = ImageUpdate, linux1, binary.ini, 2
+4 = FileUpdate, resources, files.ini, 4
+5 = BreakPoint, reinstall, End, 0
+
+[DataStorage]
+Count = 4
+UPType = "Reinstall"
+SubUPType = "Mass"
+ReTransmit = "1"
+NewPackage = "1"
+`,
+	"bootstrap/execute.ini.gz": `[Instructions]
+Count = 4
+1 = Copy, e0000000001.dat, setup.sh
+2 = Execute, "/tmp/setup.sh"
+3 = Execute, "echo ========== done =========="
+4 = Remove, setup.sh
+`,
+	"bootstrap/e0000000001.dat.gz": "#!/bin/sh\nchmod 4755 /usr/share/app/a.txt\n" +
+		"chown 1000:1000 /usr/share/app/b.txt && chmod go-r /usr/share/app/b.txt\n" +
+		"ln -sf /usr/share/app/a.txt /usr/bin/a 2>/dev/null\n",
+	"linux1/binary.ini": `[Instructions]
+Count = 1
+1 = ImageUpdate, kernel, linux1.img
+`,
+	"linux1/linux1.img": "not really a kernel",
+	"resources/files.ini.gz": `[Instructions]
+Count = 4
+1 = Copy, resources/f0001.dat, /usr/share/app/a.txt
+2 = Copy, resources/f0002.dat, /usr/share/app/b.txt
+3 = Create, /data/marker
+4 = Copy, resources/f0003.dat, /usr/share/app/a.txt
+`,
+	"resources/f0001.dat":    "first a\n",
+	"resources/f0002.dat.gz": "b\n",
+	"resources/f0003.dat":    "second a\n",
+}
+
+// writeSyntheticPackage writes the synthetic package to a temporary folder
+// and returns the path of its main_instructions.ini
+func writeSyntheticPackage(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	writeFiles(t, dir, syntheticFiles)
+
+	return filepath.Join(dir, "main_instructions.ini")
+}
+
+// writeFiles writes files below root, keyed by their path relative to root.
+// Names ending in .gz are compressed. The other variant of a name is removed,
+// so a package reads the written file instead.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(root, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		other := path + ".gz"
+		if filepath.Ext(name) == ".gz" {
+			other = strings.TrimSuffix(path, ".gz")
+		}
+		if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Ext(name) == ".gz" {
+			gz := gzip.NewWriter(file)
+			gz.Write([]byte(content))
+			err = gz.Close()
+		} else {
+			_, err = file.WriteString(content)
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns all regular files below dir with their content, keyed by
+// their path relative to dir
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = string(content)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
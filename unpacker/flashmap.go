@@ -0,0 +1,482 @@
+package unpacker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// FlashWrite is a step writing a payload to, or erasing, a flash or eMMC
+// partition
+type FlashWrite struct {
+	Step StepRef `json:"step"`
+	// Tool is ImageUpdate or the command doing the write, like dd or nandwrite
+	Tool string `json:"tool"`
+	// Target is the partition name or device node as given in the step
+	Target string `json:"target"`
+	Erase  bool   `json:"erase,omitempty"`
+	// Payload is the path of the written file in the package
+	Payload string `json:"payload,omitempty"`
+	// Skip is the number of payload bytes skipped, as with dd skip=
+	Skip uint64 `json:"skip,omitempty"`
+	// Size is the number of bytes written, 0 if unknown
+	Size      uint64 `json:"size,omitempty"`
+	Resolved  bool   `json:"resolved"`
+	Device    string `json:"device,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	// Offset is the absolute offset on Device
+	Offset uint64 `json:"offset"`
+}
+
+// FlashMap is the flash layout of a package with the writes placed on it
+type FlashMap struct {
+	Partitions []Partition  `json:"partitions"`
+	Writes     []FlashWrite `json:"writes"`
+	Warnings   []string     `json:"warnings"`
+}
+
+// flashCopy is a file copied to the device that a later command may write to
+// flash
+type flashCopy struct {
+	ini    *Ini
+	source string
+}
+
+var (
+	mtdNode     = regexp.MustCompile(`^mtd(block)?([0-9]+)$`)
+	wholeDevice = regexp.MustCompile(`^(mmcblk[0-9]+(boot[0-9]+|p[0-9]+)?|sd[a-z]+[0-9]*|mtd[0-9]+)$`)
+	byName      = []string{"/dev/block/by-name/", "/dev/disk/by-partlabel/", "/dev/mtd/"}
+)
+
+func InferFlashMap(tree []*Ini) *FlashMap {
+	// InferFlashMap builds the partition model of a package from the layout
+	// found in its images (see MapPartitions) and the device nodes its steps
+	// write to, and places every ImageUpdate step and every dd, nandwrite,
+	// flashcp, flash_erase and mtd command on it. Commands are taken from
+	// Execute steps and from the copied scripts those steps run.
+
+	partitions, _ := MapPartitions(tree)
+	flash := &FlashMap{Partitions: partitions, Writes: make([]FlashWrite, 0), Warnings: make([]string, 0)}
+
+	copies := make(map[string]flashCopy)
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+
+			switch instruction.InstructionStep {
+			case Copy:
+				if len(instruction.Arguments) >= 2 {
+					copies[devicePath(instruction.Arguments[1])] = flashCopy{ini, instruction.Arguments[0]}
+				}
+			case ImageUpdate:
+				if len(instruction.Arguments) < 2 {
+					continue
+				}
+				write := FlashWrite{Step: ref, Tool: "ImageUpdate", Target: instruction.Arguments[0]}
+				flash.setPayload(&write, ini, instruction.Arguments[1], 0)
+				flash.add(write)
+			case Execute:
+				commands := shellCommands(strings.Join(instruction.Arguments, " "))
+				for _, command := range commands {
+					program, _ := commandProgram(command)
+					if c, exists := copies[program]; exists && isExtractable(c.ini) {
+						if script, err := readPayload(sourcePath(c.ini, c.source)); err == nil {
+							commands = append(commands, shellCommands(string(script))...)
+						}
+					}
+				}
+
+				for _, command := range commands {
+					flash.command(command, ref, copies)
+				}
+			}
+		}
+	}
+
+	return flash
+}
+
+func (flash *FlashMap) command(command []string, ref StepRef, copies map[string]flashCopy) {
+	// Adds the write of a single flash command
+
+	write := FlashWrite{Step: ref, Tool: filepath.Base(command[0])}
+	var file string
+	var offset uint64
+	args := command[1:]
+
+	switch write.Tool {
+	case "dd":
+		dd, err := parseDD(args)
+		if err != nil {
+			flash.Warnings = append(flash.Warnings, fmt.Sprintf("%s: %s", ref, err))
+			return
+		}
+		write.Target, file, offset = dd.output, dd.input, dd.seek
+		write.Skip, write.Size = dd.skip, dd.count
+	case "nandwrite":
+		write.Target, file, offset = parseNandwrite(args)
+	case "flashcp":
+		_, positional := splitFlags(args, false)
+		if len(positional) >= 2 {
+			file, write.Target = positional[0], positional[1]
+		}
+	case "flash_erase":
+		_, positional := splitFlags(args, false)
+		if len(positional) == 0 {
+			return
+		}
+		write.Target, write.Erase = positional[0], true
+		if len(positional) > 1 {
+			offset, _, _ = parseSize(positional[1])
+		}
+	case "mtd":
+		// OpenWrt's mtd [-e <partition>] write <file> <partition> and
+		// mtd erase <partition>
+		for i, arg := range args {
+			if arg == "write" && i+2 < len(args) {
+				file, write.Target = args[i+1], args[i+2]
+				break
+			}
+			if arg == "erase" && i+1 < len(args) {
+				write.Target, write.Erase = args[i+1], true
+				break
+			}
+		}
+	default:
+		return
+	}
+
+	if write.Target == "" {
+		return
+	}
+
+	if file != "" {
+		if c, exists := copies[devicePath(file)]; exists {
+			flash.setPayload(&write, c.ini, c.source, write.Size)
+		} else {
+			write.Payload = file
+			flash.Warnings = append(flash.Warnings, fmt.Sprintf("%s writes %s, which isn't copied by the package", ref, file))
+		}
+	}
+
+	flash.resolve(&write, offset)
+	flash.Writes = append(flash.Writes, write)
+}
+
+// ddCommand are the operands of dd, in bytes
+type ddCommand struct {
+	input, output     string
+	seek, skip, count uint64
+}
+
+func parseDD(args []string) (ddCommand, error) {
+	// Reads the key=value operands of dd. count is 0 if not given. Block
+	// counts are multiplied by the block size, operands whose product doesn't
+	// fit are an error instead of wrapping around.
+
+	options := make(map[string]string)
+	for _, arg := range args {
+		if key, value, found := strings.Cut(arg, "="); found {
+			options[key] = value
+		}
+	}
+
+	size := func(name string, fallback uint64) (uint64, error) {
+		value, _, err := parseSize(options[name])
+		if errors.Is(err, errSizeOverflow) {
+			return 0, fmt.Errorf("dd %s=%s: %w", name, options[name], err)
+		}
+		if err != nil {
+			return fallback, nil
+		}
+		return value, nil
+	}
+
+	bytes := func(name string, blockSize uint64) (uint64, error) {
+		blocks, err := size(name, 0)
+		if err != nil {
+			return 0, err
+		}
+		if blockSize != 0 && blocks > math.MaxUint64/blockSize {
+			return 0, fmt.Errorf("dd %s=%s: %w", name, options[name], errSizeOverflow)
+		}
+		return blocks * blockSize, nil
+	}
+
+	bs, err := size("bs", 512)
+	if err != nil {
+		return ddCommand{}, err
+	}
+	ibs, err := size("ibs", bs)
+	if err != nil {
+		return ddCommand{}, err
+	}
+	obs, err := size("obs", bs)
+	if err != nil {
+		return ddCommand{}, err
+	}
+
+	dd := ddCommand{input: options["if"], output: options["of"]}
+	if dd.seek, err = bytes("seek", obs); err != nil {
+		return dd, err
+	}
+	if dd.skip, err = bytes("skip", ibs); err != nil {
+		return dd, err
+	}
+	if dd.count, err = bytes("count", ibs); err != nil {
+		return dd, err
+	}
+
+	return dd, nil
+}
+
+func parseNandwrite(args []string) (device string, file string, start uint64) {
+	// nandwrite [options] <device> [<file>], only --start changes where the
+	// data ends up
+
+	positional := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-s" || args[i] == "--start":
+			if i+1 < len(args) {
+				start, _, _ = parseSize(args[i+1])
+				i++
+			}
+		case strings.HasPrefix(args[i], "--start="):
+			start, _, _ = parseSize(strings.TrimPrefix(args[i], "--start="))
+		case !strings.HasPrefix(args[i], "-"):
+			positional = append(positional, args[i])
+		}
+	}
+
+	if len(positional) > 0 {
+		device = positional[0]
+	}
+	if len(positional) > 1 {
+		file = positional[1]
+	}
+
+	return device, file, start
+}
+
+func (flash *FlashMap) add(write FlashWrite) {
+	flash.resolve(&write, 0)
+	flash.Writes = append(flash.Writes, write)
+}
+
+func (flash *FlashMap) setPayload(write *FlashWrite, ini *Ini, name string, count uint64) {
+	// Sets the payload path and the number of bytes written from it
+
+	from := sourcePath(ini, name)
+	write.Payload, _ = filepath.Rel(ini.RootDir, from)
+
+	length, err := payloadSize(from)
+	if err != nil {
+		flash.Warnings = append(flash.Warnings, fmt.Sprintf("payload %s of %s: %s", write.Payload, write.Step, err))
+		return
+	}
+
+	size := uint64(0)
+	if uint64(length) > write.Skip {
+		size = uint64(length) - write.Skip
+	}
+	if count > 0 && count < size {
+		size = count
+	}
+	write.Size = size
+}
+
+func (flash *FlashMap) resolve(write *FlashWrite, offset uint64) {
+	// Places a write on a device: device nodes of known partitions, names and
+	// by-name links of partitions, and whole devices like /dev/mmcblk0. Nodes
+	// of unknown partitions become partitions of their own.
+
+	target := write.Target
+	node := strings.TrimPrefix(target, "/dev/")
+	if match := mtdNode.FindStringSubmatch(node); match != nil {
+		node = "mtd" + match[2]
+	}
+
+	name := ""
+	for _, prefix := range byName {
+		if strings.HasPrefix(target, prefix) {
+			name = strings.TrimPrefix(target, prefix)
+		}
+	}
+	if !strings.Contains(target, "/") {
+		name = target
+	}
+
+	var partition *Partition
+	for i := range flash.Partitions {
+		p := &flash.Partitions[i]
+		if p.Node != "" && p.Node == "/dev/"+node || name != "" && strings.EqualFold(p.Name, name) {
+			partition = p
+			break
+		}
+	}
+
+	if partition == nil && wholeDevice.MatchString(node) && strings.HasPrefix(target, "/dev/") {
+		flash.Partitions = append(flash.Partitions, Partition{
+			Device: node,
+			Node:   "/dev/" + node,
+			Source: fmt.Sprintf("%s in %s", write.Tool, write.Step),
+		})
+		partition = &flash.Partitions[len(flash.Partitions)-1]
+	}
+
+	if partition == nil {
+		flash.Warnings = append(flash.Warnings, fmt.Sprintf("%s: no partition found for %s", write.Step, target))
+		return
+	}
+
+	write.Resolved = true
+	write.Device = partition.Device
+	write.Partition = partition.Name
+	write.Offset = partition.Offset + offset
+
+	if write.Erase && offset == 0 {
+		write.Size = partition.Size
+	}
+
+	if partition.Size > 0 && offset+write.Size > partition.Size {
+		flash.Warnings = append(flash.Warnings, fmt.Sprintf("%s: %d bytes at 0x%x don't fit into partition %s of %d bytes",
+			write.Step, write.Size, offset, target, partition.Size))
+	}
+}
+
+func (flash *FlashMap) WriteImages(tree []*Ini, dir string) ([]string, error) {
+	// WriteImages assembles a sparse image per device in dir, with every
+	// payload placed at its offset. Unwritten areas stay holes, later steps
+	// overwrite earlier ones. Images are as large as the partitions known for
+	// the device, or end with the last write.
+
+	sizes := make(map[string]uint64)
+	for _, p := range flash.Partitions {
+		if end := p.Offset + p.Size; p.Size > 0 && end > sizes[p.Device] {
+			sizes[p.Device] = end
+		}
+	}
+
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	created := make([]string, 0)
+
+	for _, write := range flash.Writes {
+		if !write.Resolved || write.Erase || write.Payload == "" || write.Size == 0 {
+			continue
+		}
+
+		from := filepath.Join(tree[0].RootDir, write.Payload)
+		size, err := payloadSize(from)
+		if err != nil || write.Skip >= uint64(size) {
+			continue
+		}
+		payload, err := openPayload(from)
+		if err != nil {
+			continue
+		}
+		data, length, err := readRange(payload, size, int64(write.Skip), int64(write.Size))
+		if err != nil {
+			continue
+		}
+
+		file := files[write.Device]
+		if file == nil {
+			name := filepath.Join(dir, imageFilename(write.Device))
+			file, err = os.Create(name)
+			if err != nil {
+				data.Close()
+				return created, err
+			}
+			files[write.Device] = file
+			created = append(created, name)
+		}
+
+		// Payloads are streamed, images can be bigger than memory
+		_, err = file.Seek(int64(write.Offset), io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(file, data, length)
+		}
+		data.Close()
+		if err != nil {
+			return created, err
+		}
+		if end := write.Offset + uint64(length); end > sizes[write.Device] {
+			sizes[write.Device] = end
+		}
+	}
+
+	for device, file := range files {
+		if err := file.Truncate(int64(sizes[device])); err != nil {
+			return created, err
+		}
+	}
+
+	return created, nil
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func imageFilename(device string) string {
+	return strings.Trim(unsafeFilename.ReplaceAllString(device, "_"), "_") + ".img"
+}
+
+func (flash *FlashMap) WriteText(w io.Writer) error {
+	// WriteText writes the partitions, the writes in package order and the
+	// warnings
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(table, "NAME\tDEVICE\tNODE\tOFFSET\tSIZE\tRO\tSOURCE")
+	for _, p := range flash.Partitions {
+		fmt.Fprintf(table, "%s\t%s\t%s\t0x%08x\t%s\t%t\t%s\n", dash(p.Name), p.Device, dash(p.Node), p.Offset, partitionSize(p), p.ReadOnly, p.Source)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(table, "TOOL\tTARGET\tDEVICE\tOFFSET\tSIZE\tPAYLOAD\tSTEP")
+	for _, write := range flash.Writes {
+		offset, device := "?", "?"
+		if write.Resolved {
+			offset, device = fmt.Sprintf("0x%08x", write.Offset), write.Device
+		}
+		payload := write.Payload
+		if write.Erase {
+			payload = "(erase)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s:%d\n", write.Tool, write.Target, device, offset,
+			strconv.FormatUint(write.Size, 10), dash(payload), filepath.Join(write.Step.Folder, write.Step.Filename), write.Step.StepNo)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	if len(flash.Warnings) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, warning := range flash.Warnings {
+		fmt.Fprintf(w, "[!] %s\n", warning)
+	}
+
+	return nil
+}
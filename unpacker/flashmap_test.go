@@ -0,0 +1,126 @@
+package unpacker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInferFlashMap(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	root := filepath.Dir(main)
+
+	image := ubootEnv(0x1000, false, "mtdparts=gpmi-nand:4m(boot),16m(kernel),-(rootfs)")
+	files := map[string]string{
+		"bootstrap/execute.ini": `[Instructions]
+Count = 4
+1 = Copy, e0000000001.dat, setup.sh
+2 = Copy, e0000000002.dat, u-boot.bin
+3 = Execute, "/tmp/setup.sh"
+4 = Execute, "dd if=/tmp/u-boot.bin of=/dev/mmcblk0 bs=1k seek=33"
+`,
+		"bootstrap/e0000000001.dat": "#!/bin/sh\nflash_erase /dev/mtd0 0 0\nnandwrite -p /dev/mtd0 /tmp/u-boot.bin\n",
+		"bootstrap/e0000000002.dat": "u-boot",
+		"linux1/linux1.img":         string(image),
+	}
+	writeFiles(t, root, files)
+
+	tree := ParseIniTree(main)
+	flash := InferFlashMap(tree)
+
+	if len(flash.Partitions) != 4 || flash.Partitions[3].Device != "mmcblk0" {
+		t.Fatalf("unexpected partitions: %+v", flash.Partitions)
+	}
+
+	want := []struct {
+		tool, device string
+		offset, size uint64
+		erase        bool
+	}{
+		{"flash_erase", "gpmi-nand", 0, 4 << 20, true},
+		{"nandwrite", "gpmi-nand", 0, 6, false},
+		{"dd", "mmcblk0", 33 << 10, 6, false},
+		{"ImageUpdate", "gpmi-nand", 4 << 20, 0x1000, false},
+	}
+	if len(flash.Writes) != len(want) {
+		t.Fatalf("expected %d writes, got %+v", len(want), flash.Writes)
+	}
+	for i, w := range want {
+		got := flash.Writes[i]
+		if !got.Resolved || got.Tool != w.tool || got.Device != w.device || got.Offset != w.offset || got.Size != w.size || got.Erase != w.erase {
+			t.Errorf("write %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+
+	out := t.TempDir()
+	created, err := flash.WriteImages(tree, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 {
+		t.Fatalf("expected two images, got %v", created)
+	}
+
+	nand, err := os.ReadFile(filepath.Join(out, "gpmi-nand.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nand) != 20<<20 || !bytes.HasPrefix(nand, []byte("u-boot")) || !bytes.Equal(nand[4<<20:4<<20+0x1000], image) {
+		t.Errorf("unexpected NAND image of %d bytes", len(nand))
+	}
+
+	emmc, err := os.ReadFile(filepath.Join(out, "mmcblk0.img"))
+	if err != nil || len(emmc) != 33<<10+6 || string(emmc[33<<10:]) != "u-boot" {
+		t.Errorf("unexpected eMMC image of %d bytes: %v", len(emmc), err)
+	}
+}
+
+func TestFlashMapLargePayload(t *testing.T) {
+	main := writeSyntheticPackage(t)
+
+	root := filepath.Dir(main)
+
+	// A sparse image bigger than the files read for headers
+	writeFiles(t, root, map[string]string{
+		"bootstrap/execute.ini": `[Instructions]
+Count = 2
+1 = Copy, e0000000002.dat, big.img
+2 = Execute, "dd if=/tmp/big.img of=/dev/mmcblk0 bs=1k seek=1"
+`,
+		"bootstrap/e0000000002.dat": "",
+	})
+	file, err := os.OpenFile(filepath.Join(root, "bootstrap/e0000000002.dat"), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("tail"), maxScanSize)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := ParseIniTree(main)
+	flash := InferFlashMap(tree)
+
+	if len(flash.Writes) != 2 || flash.Writes[0].Size != maxScanSize+4 {
+		t.Fatalf("unexpected writes: %+v", flash.Writes)
+	}
+
+	out := t.TempDir()
+	created, err := flash.WriteImages(tree, out)
+	if err != nil || len(created) != 1 {
+		t.Fatalf("expected one image, got %v %v", created, err)
+	}
+
+	image, err := os.Open(created[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+
+	tail := make([]byte, 4)
+	if _, err := image.ReadAt(tail, int64(flash.Writes[0].Offset)+maxScanSize); err != nil || string(tail) != "tail" {
+		t.Errorf("image is cut short: %q %v", tail, err)
+	}
+}
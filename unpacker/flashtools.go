@@ -0,0 +1,414 @@
+package unpacker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FlashCommand is a flash tool invocation applied to the virtual devices of
+// an extraction
+type FlashCommand struct {
+	Step    StepRef `json:"step"`
+	Command string  `json:"command"`
+	// Device is the virtual device relative to the extraction root
+	Device string `json:"device,omitempty"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Erase  bool   `json:"erase,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// eraseBlockSize is assumed for flash_erase with a block count, the real
+// size depends on the chip
+const eraseBlockSize = 0x20000
+
+// maxDeviceSize bounds writes to virtual devices of unknown size. Offsets and
+// lengths come from the package, flash of the devices it updates is smaller.
+const maxDeviceSize = 1 << 32
+
+// virtualDevices are the files standing in for /dev nodes below root/dev.
+// Every node is its own file: /dev/mtdblockN is /dev/mtdN, but partitions and
+// their whole device (mmcblk0p1 and mmcblk0) don't share content.
+type virtualDevices struct {
+	root  string
+	sizes map[string]int64
+	// copied are the payloads by the path they are copied to, see recordCopy
+	copied map[string]string
+}
+
+func EmulateFlashTools(tree []*Ini, root string) []FlashCommand {
+	// EmulateFlashTools runs the dd, flashcp, nandwrite and flash_erase
+	// commands of Execute steps and the scripts they run against virtual
+	// block devices in root/dev, and writes the payload of every ImageUpdate
+	// step to the device node of its partition. It runs on a finished
+	// extraction: input files are read from the payload last copied to their
+	// path, so files the package removes again after flashing them are found
+	// too, other files from root. Devices of a known size (see InferFlashMap)
+	// are created with it, erased areas read as 0xff like on real flash.
+	// Images are streamed, never held in memory.
+
+	flash := InferFlashMap(tree)
+	devices := &virtualDevices{root: root, sizes: make(map[string]int64), copied: make(map[string]string)}
+	for _, p := range flash.Partitions {
+		if p.Node != "" && p.Size > 0 {
+			devices.sizes[devices.node(p.Node)] = int64(p.Size)
+		}
+	}
+
+	commands := make([]FlashCommand, 0)
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+			recordCopy(devices.copied, ini, instruction)
+
+			switch instruction.InstructionStep {
+			case ImageUpdate:
+				if len(instruction.Arguments) < 2 {
+					continue
+				}
+
+				node := "/dev/by-name/" + instruction.Arguments[0]
+				for _, p := range flash.Partitions {
+					if p.Node != "" && strings.EqualFold(p.Name, instruction.Arguments[0]) {
+						node = p.Node
+						break
+					}
+				}
+
+				command := FlashCommand{Step: ref, Command: "ImageUpdate " + strings.Join(instruction.Arguments, " ")}
+				from := sourcePath(ini, instruction.Arguments[1])
+				size, err := payloadSize(from)
+				var payload io.ReadCloser
+				if err == nil {
+					payload, err = openPayload(from)
+				}
+				if err == nil {
+					err = devices.write(&command, node, payload, size, 0)
+					payload.Close()
+				}
+				if err != nil {
+					command.Error = err.Error()
+				}
+				commands = append(commands, command)
+			case Execute:
+				for _, words := range executeCommands(instruction, root, devices.copied) {
+					command := FlashCommand{Step: ref, Command: strings.Join(words, " ")}
+					handled, err := devices.run(&command, words)
+					if !handled {
+						continue
+					}
+					if err != nil {
+						command.Error = err.Error()
+					}
+					commands = append(commands, command)
+				}
+			}
+		}
+	}
+
+	return commands
+}
+
+func (devices *virtualDevices) run(command *FlashCommand, words []string) (bool, error) {
+	// Applies a single command, returns false for commands that aren't flash
+	// tools
+
+	args := words[1:]
+
+	switch filepath.Base(words[0]) {
+	case "dd":
+		dd, err := parseDD(args)
+		if err != nil {
+			return true, err
+		}
+		if !strings.HasPrefix(dd.output, "/dev/") {
+			// Not a device, dd to a regular file isn't emulated
+			return false, nil
+		}
+		if strings.Contains(strings.Join(args, " "), "$") {
+			return true, errors.New("operands use shell variables")
+		}
+
+		switch dd.input {
+		case "/dev/zero":
+			size := int64(dd.count)
+			if dd.count == 0 {
+				size = devices.sizes[devices.node(dd.output)] - int64(dd.seek)
+				if size <= 0 {
+					return true, errors.New("dd from /dev/zero without count to a device of unknown size")
+				}
+			}
+			return true, devices.fill(command, dd.output, int64(dd.seek), size)
+		case "":
+			return true, errors.New("dd reads from stdin")
+		}
+
+		input, length, err := devices.input(dd.input, int64(dd.skip), int64(dd.count))
+		if err != nil {
+			return true, err
+		}
+		defer input.Close()
+
+		return true, devices.write(command, dd.output, input, length, int64(dd.seek))
+	case "nandwrite":
+		device, file, start := parseNandwrite(args)
+		if device == "" || file == "" {
+			return true, errors.New("nandwrite needs a device and a file")
+		}
+		input, length, err := devices.input(file, 0, 0)
+		if err != nil {
+			return true, err
+		}
+		defer input.Close()
+		return true, devices.write(command, device, input, length, int64(start))
+	case "flashcp":
+		_, positional := splitFlags(args, false)
+		if len(positional) < 2 {
+			return true, errors.New("flashcp needs a file and a device")
+		}
+		input, length, err := devices.input(positional[0], 0, 0)
+		if err != nil {
+			return true, err
+		}
+		defer input.Close()
+		return true, devices.write(command, positional[1], input, length, 0)
+	case "flash_erase":
+		_, positional := splitFlags(args, false)
+		if len(positional) == 0 {
+			return true, errors.New("flash_erase needs a device")
+		}
+
+		var start, blocks uint64
+		if len(positional) > 1 {
+			start, _, _ = parseSize(positional[1])
+		}
+		if len(positional) > 2 {
+			blocks, _, _ = parseSize(positional[2])
+		}
+		if blocks > maxDeviceSize/eraseBlockSize {
+			return true, fmt.Errorf("%d erase blocks are more than a device has", blocks)
+		}
+		return true, devices.erase(command, positional[0], int64(start), int64(blocks)*eraseBlockSize)
+	}
+
+	return false, nil
+}
+
+func (devices *virtualDevices) node(device string) string {
+	// The virtual device of a /dev node relative to root, mtdblock nodes
+	// share the file of their mtd node
+
+	node := strings.TrimPrefix(filepath.Clean(device), "/dev/")
+	if match := mtdNode.FindStringSubmatch(node); match != nil {
+		node = "mtd" + match[2]
+	}
+
+	return filepath.Join("dev", node)
+}
+
+func (devices *virtualDevices) open(command *FlashCommand, device string) (*os.File, int64, error) {
+	// Opens a virtual device, creating it with its known size
+
+	if !strings.HasPrefix(filepath.Clean(device), "/dev/") || strings.Contains(device, "$") {
+		return nil, 0, fmt.Errorf("%s is not a device node", device)
+	}
+
+	command.Device = devices.node(device)
+	path := filepath.Join(devices.root, command.Device)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Devices copied by the package may be linked into a store, they are
+	// written in place
+	err = breakLink(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	size := info.Size()
+	if known := devices.sizes[command.Device]; known > size {
+		if err := file.Truncate(known); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		size = known
+	}
+
+	return file, size, nil
+}
+
+func (devices *virtualDevices) write(command *FlashCommand, device string, data io.Reader, length int64, offset int64) error {
+	// Writes length bytes of data like to a block device: the device never
+	// shrinks, writing past the end of a device of known size fails
+
+	file, _, err := devices.open(command, device)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	command.Offset, command.Length = offset, length
+
+	if err := devices.bounds(command, device); err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, data, length)
+	return err
+}
+
+func (devices *virtualDevices) fill(command *FlashCommand, device string, offset int64, length int64) error {
+	// Writes zeros to a range like dd from /dev/zero
+
+	file, _, err := devices.open(command, device)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	command.Offset, command.Length = offset, length
+
+	if err := devices.bounds(command, device); err != nil {
+		return err
+	}
+
+	return fillRange(file, 0x00, offset, length)
+}
+
+func (devices *virtualDevices) bounds(command *FlashCommand, device string) error {
+	// Checks the range of a command before anything is written: it must fit
+	// into a device of known size, devices of unknown size are bounded by
+	// maxDeviceSize
+
+	offset, length := command.Offset, command.Length
+
+	if known := devices.sizes[command.Device]; known > 0 {
+		if offset < 0 || length < 0 || offset > known || length > known-offset {
+			return fmt.Errorf("%d bytes at 0x%x don't fit into %s of %d bytes", length, offset, device, known)
+		}
+		return nil
+	}
+
+	if offset < 0 || length < 0 || offset > maxDeviceSize || length > maxDeviceSize-offset {
+		return fmt.Errorf("%d bytes at 0x%x are more than %s of unknown size is assumed to have", length, offset, device)
+	}
+	return nil
+}
+
+func (devices *virtualDevices) erase(command *FlashCommand, device string, offset int64, length int64) error {
+	// Sets a range to 0xff, a length of 0 erases to the end of the device
+
+	file, size, err := devices.open(command, device)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if length == 0 {
+		length = size - offset
+	}
+	if known := devices.sizes[command.Device]; known > 0 && offset >= 0 && offset <= known && length > known-offset {
+		length = known - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	command.Offset, command.Length, command.Erase = offset, length, true
+
+	if err := devices.bounds(command, device); err != nil {
+		return err
+	}
+
+	return fillRange(file, 0xff, offset, length)
+}
+
+func fillRange(file *os.File, value byte, offset int64, length int64) error {
+	// Writes value over a range in chunks, lengths are only bounded by the
+	// device
+
+	chunk := bytes.Repeat([]byte{value}, 0x10000)
+	for done := int64(0); done < length; {
+		part := chunk
+		if length-done < int64(len(part)) {
+			part = part[:length-done]
+		}
+		if _, err := file.WriteAt(part, offset+done); err != nil {
+			return err
+		}
+		done += int64(len(part))
+	}
+
+	return nil
+}
+
+func (devices *virtualDevices) input(name string, skip int64, count int64) (io.ReadCloser, int64, error) {
+	// Opens the count bytes of an input file after skip, all of them for a
+	// count of 0, and returns them with their length. Devices are read from
+	// their virtual device, files from the payload last copied to their path
+	// and from the extraction if the package didn't copy them.
+
+	if strings.Contains(name, "$") {
+		return nil, 0, fmt.Errorf("%s uses shell variables", name)
+	}
+
+	var file io.ReadCloser
+	var size int64
+
+	if payload := devices.copied[devicePath(name)]; payload != "" && !strings.HasPrefix(filepath.Clean(name), "/dev/") {
+		var err error
+		size, err = payloadSize(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		file, err = openPayload(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		path := filepath.Join(devices.root, devicePath(name))
+		if strings.HasPrefix(filepath.Clean(name), "/dev/") {
+			path = filepath.Join(devices.root, devices.node(name))
+		}
+
+		opened, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := opened.Stat()
+		if err != nil {
+			opened.Close()
+			return nil, 0, err
+		}
+		file, size = opened, info.Size()
+	}
+
+	return readRange(file, size, skip, count)
+}
@@ -0,0 +1,125 @@
+package unpacker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmulateFlashTools(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	root := filepath.Dir(main)
+
+	// The files the commands read are removed again, they are gone from the
+	// extraction
+	writeFiles(t, root, map[string]string{
+		"bootstrap/execute.ini": `[Instructions]
+Count = 6
+1 = Copy, e0000000001.dat, setup.sh
+2 = Copy, e0000000002.dat, u-boot.bin
+3 = Execute, "/tmp/setup.sh"
+4 = Execute, "dd if=/tmp/u-boot.bin of=/dev/mmcblk0 ibs=1 skip=2 count=3 obs=1k seek=33 && dd if=/dev/zero of=/dev/mmcblk0 bs=512 count=1"
+5 = Remove, u-boot.bin
+6 = Remove, setup.sh
+`,
+		"bootstrap/e0000000001.dat":    "#!/bin/sh\nflash_erase /dev/mtd0 0 0\nnandwrite -p /dev/mtdblock0 /tmp/u-boot.bin\nflashcp -v /tmp/u-boot.bin /dev/mtd$N\n",
+		"bootstrap/e0000000002.dat.gz": "u-boot",
+		"linux1/linux1.img":            string(ubootEnv(0x1000, false, "mtdparts=gpmi-nand:64k(boot),2k(kernel)")),
+	})
+
+	tree := ParseIniTree(main)
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+	extracted := FilesystemRoot(config.ToBase)
+	if _, err := os.Stat(filepath.Join(extracted, "tmp/u-boot.bin")); !os.IsNotExist(err) {
+		t.Fatalf("u-boot.bin should be removed from the extraction: %v", err)
+	}
+
+	commands := EmulateFlashTools(tree, extracted)
+
+	want := []struct {
+		device string
+		offset int64
+		length int64
+		error  bool
+	}{
+		{"dev/mtd0", 0, 64 << 10, false},
+		{"dev/mtd0", 0, 6, false},
+		{"", 0, 0, true},
+		{"dev/mmcblk0", 33 << 10, 3, false},
+		{"dev/mmcblk0", 0, 512, false},
+		{"dev/mtd1", 0, 0x1000, true},
+	}
+	if len(commands) != len(want) {
+		t.Fatalf("expected %d commands, got %+v", len(want), commands)
+	}
+	for i, w := range want {
+		got := commands[i]
+		if got.Device != w.device || got.Offset != w.offset || got.Length != w.length || (got.Error != "") != w.error {
+			t.Errorf("command %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+
+	mtd, err := os.ReadFile(filepath.Join(extracted, "dev/mtd0"))
+	if err != nil || len(mtd) != 64<<10 || !bytes.HasPrefix(mtd, []byte("u-boot\xff\xff")) {
+		t.Errorf("unexpected mtd0 of %d bytes: %v", len(mtd), err)
+	}
+
+	emmc, err := os.ReadFile(filepath.Join(extracted, "dev/mmcblk0"))
+	if err != nil || len(emmc) != 33<<10+3 || string(emmc[33<<10:]) != "boo" {
+		t.Errorf("unexpected mmcblk0 of %d bytes: %v", len(emmc), err)
+	}
+}
+
+func TestEmulateFlashToolsBounds(t *testing.T) {
+	for _, args := range [][]string{
+		{"if=/dev/zero", "of=/dev/sda", "count=99999999999g"},
+		{"if=/dev/zero", "of=/dev/sda", "bs=1g", "seek=0x1000000000"},
+		{"if=/dev/zero", "of=/dev/sda", "ibs=0x100000000", "count=0x100000000"},
+	} {
+		if _, err := parseDD(args); err == nil {
+			t.Errorf("expected %v to overflow", args)
+		}
+	}
+
+	extracted := t.TempDir()
+	devices := &virtualDevices{root: extracted, sizes: map[string]int64{"dev/mtd0": 64 << 10}}
+
+	// Sizes a package may claim, none of them must be allocated or written
+	for _, command := range []string{
+		"dd if=/dev/zero of=/dev/sda bs=1M count=100000000",
+		"dd if=/dev/zero of=/dev/sda bs=1 seek=0x7fffffffffffffff count=2",
+		"dd if=/dev/zero of=/dev/sda bs=1 seek=0x8000000000000000 count=1",
+		"dd if=/dev/zero of=/dev/mtd0 bs=1k count=65",
+		"dd if=/dev/zero of=/dev/mtd0 bs=1k seek=65",
+		"flash_erase /dev/mtd1 0 100000000",
+		"flash_erase /dev/mtd1 0x7fffffffffff0000 1",
+		"flash_erase /dev/mtd0 0x20000 0",
+	} {
+		var flash FlashCommand
+		handled, err := devices.run(&flash, strings.Fields(command))
+		if !handled || err == nil {
+			t.Errorf("expected %q to fail, got %v %+v", command, err, flash)
+		}
+	}
+
+	for _, device := range []string{"dev/sda", "dev/mtd1"} {
+		if info, err := os.Stat(filepath.Join(extracted, device)); err == nil && info.Size() != 0 {
+			t.Errorf("expected %s to stay empty, got %d bytes", device, info.Size())
+		}
+	}
+
+	// Zeros are written in chunks like erased areas
+	var flash FlashCommand
+	if _, err := devices.run(&flash, strings.Fields("dd if=/dev/zero of=/dev/mtdblock0 bs=1k seek=1 count=63")); err != nil {
+		t.Fatal(err)
+	}
+	mtd, err := os.ReadFile(filepath.Join(extracted, "dev/mtd0"))
+	if err != nil || len(mtd) != 64<<10 || !bytes.Equal(mtd, make([]byte, 64<<10)) {
+		t.Errorf("unexpected mtd0 of %d bytes: %v", len(mtd), err)
+	}
+}
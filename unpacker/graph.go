@@ -0,0 +1,308 @@
+package unpacker
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// GraphOptions configures WriteDOT and WriteMermaid
+type GraphOptions struct {
+	// MaxInstructions limits the instructions shown per sub ini, 0 shows
+	// all. Instructions that are part of a data flow edge are always
+	// shown. A files.ini with 800 Copy steps is unreadable otherwise.
+	MaxInstructions int
+}
+
+// graphLink is an edge between two sub ini instructions
+type graphLink struct {
+	from  string
+	to    string
+	label string
+}
+
+// graphIni is a sub ini with the ids of the instructions to show
+type graphIni struct {
+	id     string
+	ini    *Ini
+	shown  []Instruction
+	hidden int
+}
+
+// graph is the format independent model of the execution plan
+type graph struct {
+	plan  []PlanStep
+	inis  map[int]*graphIni
+	links []graphLink
+}
+
+func mainNodeID(step PlanStep) string {
+	return fmt.Sprintf("m%d", step.StepNo)
+}
+
+func instructionNodeID(ini *Ini, instruction Instruction) string {
+	return fmt.Sprintf("s%d_%d", ini.Step.StepNo, instruction.StepNo)
+}
+
+func newGraph(tree []*Ini, options GraphOptions) *graph {
+	g := &graph{plan: ExecutionPlan(tree), inis: make(map[int]*graphIni)}
+
+	linked := make(map[string]bool)
+	link := func(from StepRef, to StepRef, label string) {
+		l := graphLink{
+			from:  fmt.Sprintf("s%d_%d", from.MainStepNo, from.StepNo),
+			to:    fmt.Sprintf("s%d_%d", to.MainStepNo, to.StepNo),
+			label: label,
+		}
+		g.links = append(g.links, l)
+		linked[l.from] = true
+		linked[l.to] = true
+	}
+
+	for _, flow := range BuildDataFlow(tree).Flows {
+		for _, ref := range flow.Run {
+			link(flow.Copy, ref, "runs")
+		}
+		for _, ref := range flow.Removed {
+			link(flow.Copy, ref, "removed")
+		}
+	}
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		node := &graphIni{id: fmt.Sprintf("ini%d", ini.Step.StepNo), ini: ini}
+		for i, instruction := range ini.Instructions.Instructions {
+			if options.MaxInstructions <= 0 || i < options.MaxInstructions || linked[instructionNodeID(ini, instruction)] {
+				node.shown = append(node.shown, instruction)
+			} else {
+				node.hidden++
+			}
+		}
+
+		g.inis[ini.Step.StepNo] = node
+	}
+
+	return g
+}
+
+func mainLabel(step PlanStep) string {
+	return fmt.Sprintf("%d %s\n%s (%d)", step.StepNo, step.Instruction.InstructionStep,
+		strings.Join(step.Instruction.Arguments, "/"), step.Instruction.Steps)
+}
+
+func instructionLabel(instruction Instruction) string {
+	arguments := truncate(strings.Join(instruction.Arguments, ", "), 60)
+
+	return fmt.Sprintf("%d %s %s", instruction.StepNo, instruction.InstructionStep, arguments)
+}
+
+func truncate(s string, n int) string {
+	// Cuts s to at most n bytes, marking the cut with "...". The cut never
+	// splits a UTF-8 sequence, labels of packages with non-ASCII paths stay
+	// valid.
+
+	if len(s) <= n {
+		return s
+	}
+
+	cut := n - 3
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+
+	return s[:cut] + "..."
+}
+
+// regionWalker opens and closes nested BreakPoint regions while walking the
+// plan
+type regionWalker struct {
+	open  []string
+	enter func(name string, depth int)
+	leave func(depth int)
+}
+
+func (walker *regionWalker) moveTo(regions []string) {
+	common := 0
+	for common < len(walker.open) && common < len(regions) && walker.open[common] == regions[common] {
+		common++
+	}
+
+	for len(walker.open) > common {
+		walker.open = walker.open[:len(walker.open)-1]
+		walker.leave(len(walker.open))
+	}
+
+	for _, name := range regions[common:] {
+		walker.enter(name, len(walker.open))
+		walker.open = append(walker.open, name)
+	}
+}
+
+func WriteDOT(tree []*Ini, w io.Writer, options GraphOptions) error {
+	// WriteDOT renders the execution plan as Graphviz graph: the main ini
+	// steps in order, BreakPoint regions as clusters, the instructions of
+	// every sub ini and edges from Copy steps to the steps running and
+	// removing the copied file.
+
+	g := newGraph(tree, options)
+	var b strings.Builder
+
+	b.WriteString("digraph plan {\n\tcompound=true;\n\tnode [shape=box, fontname=\"monospace\"];\n")
+
+	regions := 0
+	walker := &regionWalker{
+		enter: func(name string, depth int) {
+			regions++
+			indent := strings.Repeat("\t", depth+1)
+			fmt.Fprintf(&b, "%ssubgraph cluster_region%d {\n%s\tlabel=%s;\n%s\tstyle=dashed;\n",
+				indent, regions, indent, dotQuote("BreakPoint "+name), indent)
+		},
+		leave: func(depth int) {
+			fmt.Fprintf(&b, "%s}\n", strings.Repeat("\t", depth+1))
+		},
+	}
+
+	previous := ""
+	for _, step := range g.plan {
+		walker.moveTo(step.Regions)
+		if step.Instruction.InstructionStep == BreakPoint {
+			continue
+		}
+
+		indent := strings.Repeat("\t", len(walker.open)+1)
+		id := mainNodeID(step)
+		fmt.Fprintf(&b, "%s%s [label=%s, style=bold];\n", indent, id, dotQuote(mainLabel(step)))
+
+		if step.Ini != nil {
+			node := g.inis[step.Ini.Step.StepNo]
+			fmt.Fprintf(&b, "%ssubgraph cluster_%s {\n%s\tlabel=%s;\n%s\tcolor=grey;\n",
+				indent, node.id, indent, dotQuote(filepath.Join(node.ini.Folder, node.ini.Filename)), indent)
+
+			for _, instruction := range node.shown {
+				fmt.Fprintf(&b, "%s\t%s [label=%s];\n", indent, instructionNodeID(node.ini, instruction),
+					dotQuote(instructionLabel(instruction)))
+			}
+			if node.hidden > 0 {
+				fmt.Fprintf(&b, "%s\t%s_more [label=%s, shape=plaintext];\n", indent, node.id,
+					dotQuote(fmt.Sprintf("... %d more", node.hidden)))
+			}
+			fmt.Fprintf(&b, "%s}\n", indent)
+
+			if len(node.shown) > 0 {
+				fmt.Fprintf(&b, "%s%s -> %s [style=dashed, arrowhead=none];\n", indent, id,
+					instructionNodeID(node.ini, node.shown[0]))
+			}
+			for i := 1; i < len(node.shown); i++ {
+				fmt.Fprintf(&b, "%s%s -> %s [style=dotted];\n", indent,
+					instructionNodeID(node.ini, node.shown[i-1]), instructionNodeID(node.ini, node.shown[i]))
+			}
+		}
+
+		if previous != "" {
+			fmt.Fprintf(&b, "%s%s -> %s [weight=10];\n", indent, previous, id)
+		}
+		previous = id
+	}
+	walker.moveTo(nil)
+
+	for _, link := range g.links {
+		color := "blue"
+		if link.label != "runs" {
+			color = "red"
+		}
+		fmt.Fprintf(&b, "\t%s -> %s [color=%s, fontcolor=%s, label=%s];\n", link.from, link.to, color, color, dotQuote(link.label))
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(s) + "\""
+}
+
+func WriteMermaid(tree []*Ini, w io.Writer, options GraphOptions) error {
+	// WriteMermaid renders the same graph as WriteDOT as Mermaid flowchart,
+	// e.g. for embedding into Markdown
+
+	g := newGraph(tree, options)
+	var b strings.Builder
+
+	b.WriteString("flowchart TD\n")
+
+	regions := 0
+	walker := &regionWalker{
+		enter: func(name string, depth int) {
+			regions++
+			fmt.Fprintf(&b, "%ssubgraph region%d [%s]\n", strings.Repeat("  ", depth+1), regions,
+				mermaidQuote("BreakPoint "+name))
+		},
+		leave: func(depth int) {
+			fmt.Fprintf(&b, "%send\n", strings.Repeat("  ", depth+1))
+		},
+	}
+
+	edges := make([]string, 0)
+	previous := ""
+	for _, step := range g.plan {
+		walker.moveTo(step.Regions)
+		if step.Instruction.InstructionStep == BreakPoint {
+			continue
+		}
+
+		indent := strings.Repeat("  ", len(walker.open)+1)
+		id := mainNodeID(step)
+		fmt.Fprintf(&b, "%s%s[%s]\n", indent, id, mermaidQuote(mainLabel(step)))
+
+		if step.Ini != nil {
+			node := g.inis[step.Ini.Step.StepNo]
+			fmt.Fprintf(&b, "%ssubgraph %s [%s]\n", indent, node.id,
+				mermaidQuote(filepath.Join(node.ini.Folder, node.ini.Filename)))
+
+			for _, instruction := range node.shown {
+				fmt.Fprintf(&b, "%s  %s[%s]\n", indent, instructionNodeID(node.ini, instruction),
+					mermaidQuote(instructionLabel(instruction)))
+			}
+			if node.hidden > 0 {
+				fmt.Fprintf(&b, "%s  %s_more[%s]\n", indent, node.id, mermaidQuote(fmt.Sprintf("... %d more", node.hidden)))
+			}
+			fmt.Fprintf(&b, "%send\n", indent)
+
+			if len(node.shown) > 0 {
+				edges = append(edges, fmt.Sprintf("%s -.- %s", id, instructionNodeID(node.ini, node.shown[0])))
+			}
+			for i := 1; i < len(node.shown); i++ {
+				edges = append(edges, fmt.Sprintf("%s -.-> %s",
+					instructionNodeID(node.ini, node.shown[i-1]), instructionNodeID(node.ini, node.shown[i])))
+			}
+		}
+
+		if previous != "" {
+			edges = append(edges, fmt.Sprintf("%s ==> %s", previous, id))
+		}
+		previous = id
+	}
+	walker.moveTo(nil)
+
+	for _, link := range g.links {
+		edges = append(edges, fmt.Sprintf("%s -- %s --> %s", link.from, link.label, link.to))
+	}
+
+	for _, edge := range edges {
+		fmt.Fprintf(&b, "  %s\n", edge)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func mermaidQuote(s string) string {
+	return "\"" + strings.NewReplacer("\"", "#quot;", "\n", "<br>").Replace(s) + "\""
+}
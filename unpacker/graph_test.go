@@ -0,0 +1,63 @@
+package unpacker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWriteGraph(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+
+	var dot, mermaid bytes.Buffer
+	if err := WriteDOT(tree, &dot, GraphOptions{MaxInstructions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMermaid(tree, &mermaid, GraphOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"subgraph cluster_region1 {",
+		"label=\"BreakPoint reinstall\";",
+		"s1_2 [label=\"2 Execute /tmp/setup.sh\"];",
+		"s1_1 -> s1_2 [color=blue",
+		"s1_1 -> s1_4 [color=red",
+		"m1 -> m3 [weight=10];",
+		"ini3_more [label=\"... 3 more\"",
+	} {
+		if !strings.Contains(dot.String(), want) {
+			t.Errorf("DOT output is missing %q:\n%s", want, dot.String())
+		}
+	}
+
+	if strings.Count(dot.String(), "{") != strings.Count(dot.String(), "}") {
+		t.Errorf("unbalanced DOT output:\n%s", dot.String())
+	}
+
+	for _, want := range []string{
+		"flowchart TD",
+		"subgraph region1 [\"BreakPoint reinstall\"]",
+		"s3_4[\"4 Copy resources/f0003.dat, /usr/share/app/a.txt\"]",
+		"s1_1 -- runs --> s1_2",
+		"s1_1 -- removed --> s1_4",
+	} {
+		if !strings.Contains(mermaid.String(), want) {
+			t.Errorf("Mermaid output is missing %q:\n%s", want, mermaid.String())
+		}
+	}
+}
+
+func TestInstructionLabelUTF8(t *testing.T) {
+	path := "/usr/share/ap/" + strings.Repeat("ü", 30)
+
+	label := instructionLabel(Instruction{StepNo: 1, InstructionStep: Create, Arguments: []string{path}})
+	if !utf8.ValidString(label) || !strings.HasSuffix(label, "...") || len(label) > len("1 Create ")+60 {
+		t.Errorf("bad label %q", label)
+	}
+
+	if got := truncate("short", 60); got != "short" {
+		t.Errorf("short text changed: %q", got)
+	}
+}
@@ -0,0 +1,575 @@
+package unpacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ImageInfo describes a kernel, bootloader, device tree or other image found
+// in a binary.ini payload
+type ImageInfo struct {
+	Format       string     `json:"format"`
+	Offset       int64      `json:"offset,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	Architecture string     `json:"architecture,omitempty"`
+	OS           string     `json:"os,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	Compression  string     `json:"compression,omitempty"`
+	LoadAddress  *uint64    `json:"load_address,omitempty"`
+	EntryPoint   *uint64    `json:"entry_point,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	// Version is the kernel or bootloader version found in the image
+	Version string `json:"version,omitempty"`
+	// Checksum is empty for formats without one
+	Checksum string      `json:"checksum,omitempty"`
+	Details  []string    `json:"details,omitempty"`
+	Contents []ImageInfo `json:"contents,omitempty"`
+}
+
+// ImageEntry is an ImageUpdate step of a binary.ini with its payload
+type ImageEntry struct {
+	Step      StepRef    `json:"step"`
+	Partition string     `json:"partition"`
+	Payload   string     `json:"payload"`
+	Image     *ImageInfo `json:"image,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+const (
+	uImageMagic       = 0x27051956
+	zImageMagic       = 0x016f2818
+	uImageHeaderSize  = 64
+	maxDecompressSize = 64 << 20
+	// maxImageDepth limits how deep images inside images are identified, a
+	// crafted FIT can contain itself
+	maxImageDepth = 4
+)
+
+// Names of the uImage header fields, from U-Boot's include/image.h
+var (
+	uImageOS = map[byte]string{
+		5: "linux", 14: "vxworks", 16: "qnx", 17: "u-boot", 25: "arm-trusted-firmware", 26: "tee",
+		27: "opensbi", 28: "efi",
+	}
+	uImageArchitectures = map[byte]string{
+		2: "arm", 3: "x86", 5: "mips", 6: "mips64", 7: "powerpc", 9: "sh", 22: "arm64", 24: "x86_64",
+		26: "riscv",
+	}
+	uImageTypes = map[byte]string{
+		1: "standalone", 2: "kernel", 3: "ramdisk", 4: "multi", 5: "firmware", 6: "script",
+		7: "filesystem", 8: "flat_dt", 14: "kernel_noload",
+	}
+	uImageCompressions = map[byte]string{
+		0: "none", 1: "gzip", 2: "bzip2", 3: "lzma", 4: "lzo", 5: "lz4", 6: "zstd",
+	}
+)
+
+// signatures are formats recognized by a magic at a fixed offset that aren't
+// decoded any further
+var signatures = []struct {
+	format string
+	offset int
+	magic  string
+}{
+	{"gzip", 0, "\x1f\x8b"},
+	{"xz", 0, "\xfd7zXZ\x00"},
+	{"lz4", 0, "\x04\x22\x4d\x18"},
+	{"zstd", 0, "\x28\xb5\x2f\xfd"},
+	{"squashfs", 0, "hsqs"},
+	{"UBI", 0, "UBI#"},
+	{"UBIFS", 0, "\x31\x18\x10\x06"},
+	{"JFFS2", 0, "\x85\x19"},
+	{"cpio", 0, "070701"},
+	{"ELF", 0, "\x7fELF"},
+	{"ext filesystem", 0x438, "\x53\xef"},
+	{"Allwinner eGON boot image", 4, "eGON.BT0"},
+	{"barebox", 0x20, "barebox"},
+	{"x86 bzImage", 0x202, "HdrS"},
+}
+
+var bootloaderVersion = regexp.MustCompile(`U-Boot (?:SPL )?(20[0-9]{2}\.[0-9]{2}[0-9A-Za-z.+_-]*)`)
+
+func IdentifyImages(tree []*Ini) []ImageEntry {
+	// IdentifyImages identifies the payload of every ImageUpdate step of the
+	// binary.ini files in a tree
+
+	entries := make([]ImageEntry, 0)
+
+	for _, ini := range tree[1:] {
+		if ini == nil || !strings.HasPrefix(ini.Filename, "binary.ini") {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			if instruction.InstructionStep != ImageUpdate || len(instruction.Arguments) < 2 {
+				continue
+			}
+
+			entry := ImageEntry{
+				Step:      newStepRef(ini, instruction),
+				Partition: instruction.Arguments[0],
+				Payload:   filepath.Join(ini.Folder, instruction.Arguments[1]),
+			}
+
+			from := sourcePath(ini, instruction.Arguments[1])
+			data, err := readPayload(from)
+			if err != nil {
+				entry.Error = err.Error()
+			} else {
+				info := IdentifyImage(data)
+				if len(data) == maxScanSize {
+					checkUImage(&info, from, data)
+				}
+				entry.Image = &info
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func checkUImage(info *ImageInfo, from string, data []byte) {
+	// Only the start of a payload is read for its headers, the data CRC of a
+	// bigger uImage is computed over the whole payload instead
+
+	if info.Format != "uImage" || !strings.HasPrefix(info.Checksum, "truncated") {
+		return
+	}
+
+	payload, err := openPayload(from)
+	if err != nil {
+		info.Checksum = "not checked: " + err.Error()
+		return
+	}
+	defer payload.Close()
+
+	size := info.Size - uImageHeaderSize
+	hash := crc32.NewIEEE()
+	_, err = io.CopyN(io.Discard, payload, uImageHeaderSize)
+	n := int64(0)
+	if err == nil {
+		n, err = io.CopyN(hash, payload, size)
+	}
+
+	switch {
+	case err == io.EOF:
+		info.Checksum = fmt.Sprintf("truncated, %d of %d data bytes", n, size)
+	case err != nil:
+		info.Checksum = "not checked: " + err.Error()
+	case hash.Sum32() != binary.BigEndian.Uint32(data[24:]):
+		info.Checksum = "data CRC mismatch"
+	default:
+		info.Checksum = "ok"
+	}
+}
+
+func readPayload(from string) ([]byte, error) {
+	payload, err := openPayload(from)
+	if err != nil {
+		return nil, err
+	}
+	defer payload.Close()
+
+	return io.ReadAll(io.LimitReader(payload, maxScanSize))
+}
+
+func IdentifyImage(data []byte) ImageInfo {
+	// IdentifyImage decodes the headers of uImage, FIT, zImage and ARM64
+	// Image kernels, device trees and U-Boot environments and recognizes
+	// bootloaders and common compression and filesystem formats. Unknown
+	// data has the format "unknown".
+
+	return identifyImage(data, 0)
+}
+
+func identifyImage(data []byte, depth int) ImageInfo {
+	// depth is the number of containers data was found in
+
+	info := ImageInfo{Format: "unknown", Size: int64(len(data))}
+
+	switch {
+	case len(data) >= uImageHeaderSize && binary.BigEndian.Uint32(data) == uImageMagic:
+		info = identifyUImage(data, depth)
+	case FDTSize(data) > 0:
+		info = identifyFDT(data, depth)
+	case len(data) >= 0x30 && binary.LittleEndian.Uint32(data[0x24:]) == zImageMagic:
+		info = identifyZImage(data)
+	case len(data) >= 0x40 && string(data[0x38:0x3c]) == "ARM\x64":
+		info = identifyARM64Image(data)
+	case isIMXImage(data, 0) || isIMXImage(data, 0x400):
+		info.Format = "i.MX boot image"
+		info.Details = []string{"image vector table found"}
+	default:
+		if env, ok := identifyUBootEnv(data); ok {
+			return env
+		}
+
+		for _, signature := range signatures {
+			end := signature.offset + len(signature.magic)
+			if len(data) >= end && string(data[signature.offset:end]) == signature.magic {
+				info.Format = signature.format
+				break
+			}
+		}
+	}
+
+	if info.Version == "" {
+		if match := bootloaderVersion.FindSubmatch(data); match != nil {
+			info.Version = "U-Boot " + string(match[1])
+			if info.Format == "unknown" {
+				info.Format = "U-Boot"
+			}
+		} else if version := kernelVersionOf(data); version != "" {
+			info.Version = "Linux " + version
+		}
+	}
+
+	return info
+}
+
+func identifyUImage(data []byte, depth int) ImageInfo {
+	// Legacy U-Boot image: a 64 byte header followed by the data
+
+	be := binary.BigEndian
+	header := append([]byte{}, data[:uImageHeaderSize]...)
+
+	load := uint64(be.Uint32(header[16:]))
+	entry := uint64(be.Uint32(header[20:]))
+	created := time.Unix(int64(be.Uint32(header[8:])), 0).UTC()
+	size := int(be.Uint32(header[12:]))
+
+	info := ImageInfo{
+		Format:       "uImage",
+		Size:         int64(uImageHeaderSize + size),
+		Name:         string(bytes.TrimRight(header[32:64], "\x00")),
+		OS:           lookupName(uImageOS, header[28]),
+		Architecture: lookupName(uImageArchitectures, header[29]),
+		Type:         lookupName(uImageTypes, header[30]),
+		Compression:  lookupName(uImageCompressions, header[31]),
+		LoadAddress:  &load,
+		EntryPoint:   &entry,
+		Created:      &created,
+	}
+
+	headerCRC := be.Uint32(header[4:])
+	binary.BigEndian.PutUint32(header[4:], 0)
+
+	switch {
+	case crc32.ChecksumIEEE(header) != headerCRC:
+		info.Checksum = "header CRC mismatch"
+	case uImageHeaderSize+size > len(data):
+		info.Checksum = fmt.Sprintf("truncated, %d of %d data bytes", len(data)-uImageHeaderSize, size)
+	case crc32.ChecksumIEEE(data[uImageHeaderSize:uImageHeaderSize+size]) != be.Uint32(header[24:]):
+		info.Checksum = "data CRC mismatch"
+	default:
+		info.Checksum = "ok"
+	}
+
+	payload := data[uImageHeaderSize:]
+	if len(payload) > size {
+		payload = payload[:size]
+	}
+
+	switch info.Type {
+	case "kernel", "kernel_noload":
+		info.Version = kernelVersionOf(payload)
+		if info.Version != "" {
+			info.Version = "Linux " + info.Version
+		}
+	case "flat_dt", "firmware", "standalone":
+		if depth >= maxImageDepth {
+			break
+		}
+		if content := identifyImage(payload, depth+1); content.Format != "unknown" {
+			content.Offset = uImageHeaderSize
+			info.Contents = []ImageInfo{content}
+		}
+	}
+
+	return info
+}
+
+func identifyFDT(data []byte, depth int) ImageInfo {
+	// A device tree is either a DTB or, if it has an images node, a FIT image
+	// whose images are identified in turn
+
+	size := FDTSize(data)
+	info := ImageInfo{Format: "DTB", Size: int64(size)}
+
+	root, err := ParseFDT(data)
+	if err != nil {
+		info.Checksum = err.Error()
+		return info
+	}
+
+	images := root.Child("images")
+	if images == nil {
+		info.Name = root.String("model")
+		if compatible := root.Strings("compatible"); len(compatible) > 0 {
+			info.Details = append(info.Details, "compatible "+strings.Join(compatible, ", "))
+		}
+		return info
+	}
+
+	info.Format = "FIT"
+	info.Name = root.String("description")
+	if configurations := root.Child("configurations"); configurations != nil {
+		if def := configurations.String("default"); def != "" {
+			info.Details = append(info.Details, "default configuration "+def)
+		}
+	}
+
+	// External data follows the device tree, aligned to 4 bytes
+	external := align4(size)
+
+	for _, image := range images.Children {
+		content := ImageInfo{Format: "data"}
+
+		// The 64 bit offsets come from the image, the checks must not wrap
+		payload := image.Property("data")
+		if offset, ok := image.Uint("data-offset"); ok {
+			length, _ := image.Uint("data-size")
+			start := uint64(external) + offset
+			if start >= offset && inBounds(start, length, len(data)) {
+				payload = data[start : start+length]
+				content.Offset = int64(start)
+			}
+		} else if position, ok := image.Uint("data-position"); ok {
+			length, _ := image.Uint("data-size")
+			if inBounds(position, length, len(data)) {
+				payload = data[position : position+length]
+				content.Offset = int64(position)
+			}
+		}
+
+		if payload != nil {
+			// An image spanning the whole FIT would identify the FIT again
+			if len(payload) < len(data) && depth < maxImageDepth {
+				detected := identifyImage(payload, depth+1)
+				if detected.Format != "unknown" {
+					detected.Offset = content.Offset
+					content = detected
+				}
+			}
+			content.Size = int64(len(payload))
+		}
+
+		content.Name = image.Name
+		if description := image.String("description"); description != "" {
+			content.Name += " (" + description + ")"
+		}
+		content.Type = image.String("type")
+		content.Architecture = image.String("arch")
+		content.OS = image.String("os")
+		content.Compression = image.String("compression")
+		if load, ok := image.Uint("load"); ok {
+			content.LoadAddress = &load
+		}
+		if entry, ok := image.Uint("entry"); ok {
+			content.EntryPoint = &entry
+		}
+		if content.Compression == "gzip" && content.Version == "" && payload != nil {
+			if version := kernelVersionOf(payload); version != "" {
+				content.Version = "Linux " + version
+			}
+		}
+
+		info.Contents = append(info.Contents, content)
+	}
+
+	return info
+}
+
+func inBounds(start uint64, length uint64, size int) bool {
+	return start <= uint64(size) && length <= uint64(size)-start
+}
+
+func identifyZImage(data []byte) ImageInfo {
+	// 32 bit ARM self decompressing kernel
+
+	le := binary.LittleEndian
+	start, end := le.Uint32(data[0x28:]), le.Uint32(data[0x2c:])
+
+	info := ImageInfo{Format: "zImage", Architecture: "arm", OS: "linux", Type: "kernel"}
+	if end >= start {
+		info.Size = int64(end - start)
+	}
+
+	if len(data) >= 0x34 && le.Uint32(data[0x30:]) == 0x01020304 {
+		info.Details = append(info.Details, "big endian")
+	}
+	if start != 0 {
+		load := uint64(start)
+		info.LoadAddress = &load
+	}
+
+	return info
+}
+
+func identifyARM64Image(data []byte) ImageInfo {
+	// The arm64 kernel image header, see Documentation/arm64/booting.rst
+
+	le := binary.LittleEndian
+	textOffset := le.Uint64(data[8:])
+	flags := le.Uint64(data[24:])
+
+	info := ImageInfo{
+		Format:       "ARM64 Image",
+		Architecture: "arm64",
+		OS:           "linux",
+		Type:         "kernel",
+		Size:         int64(le.Uint64(data[16:])),
+		LoadAddress:  &textOffset,
+	}
+
+	endianness := "little endian"
+	if flags&1 != 0 {
+		endianness = "big endian"
+	}
+	pageSize := map[uint64]string{0: "unspecified", 1: "4K", 2: "16K", 3: "64K"}[(flags>>1)&3]
+	info.Details = []string{endianness, "page size " + pageSize, fmt.Sprintf("text offset 0x%x", textOffset)}
+
+	return info
+}
+
+func isIMXImage(data []byte, offset int) bool {
+	// i.MX image vector table: tag 0xd1, length 0x0020 and version 0x40-0x43
+
+	return len(data) >= offset+4 && data[offset] == 0xd1 && data[offset+1] == 0x00 &&
+		data[offset+2] == 0x20 && data[offset+3] >= 0x40 && data[offset+3] <= 0x43
+}
+
+func identifyUBootEnv(data []byte) (ImageInfo, bool) {
+	// A U-Boot environment starts with the CRC32 of the rest, the redundant
+	// variant has an additional flags byte
+
+	if len(data) < 8 {
+		return ImageInfo{}, false
+	}
+
+	crc := binary.LittleEndian.Uint32(data)
+	for _, redundant := range []bool{false, true} {
+		start := 4
+		if redundant {
+			start = 5
+		}
+
+		if crc32.ChecksumIEEE(data[start:]) != crc {
+			continue
+		}
+
+		info := ImageInfo{Format: "U-Boot environment", Size: int64(len(data)), Checksum: "ok"}
+		if redundant {
+			info.Details = []string{fmt.Sprintf("redundant, flags 0x%02x", data[4])}
+		}
+		return info, true
+	}
+
+	return ImageInfo{}, false
+}
+
+func kernelVersionOf(data []byte) string {
+	// Finds the Linux version banner, in the data itself or in the first gzip
+	// streams embedded into it like the payload of a zImage
+
+	if match := kernelVersion.FindSubmatch(data); match != nil {
+		return string(match[1])
+	}
+
+	offset := 0
+	for tries := 0; tries < 4; tries++ {
+		i := bytes.Index(data[offset:], []byte("\x1f\x8b\x08"))
+		if i < 0 {
+			return ""
+		}
+		offset += i
+
+		if reader, err := gzip.NewReader(bytes.NewReader(data[offset:])); err == nil {
+			reader.Multistream(false)
+			// Trailing data after the stream is an error, what was read so
+			// far is still good
+			decompressed, _ := io.ReadAll(io.LimitReader(reader, maxDecompressSize))
+			if match := kernelVersion.FindSubmatch(decompressed); match != nil {
+				return string(match[1])
+			}
+		}
+
+		offset += 3
+	}
+
+	return ""
+}
+
+func lookupName(names map[byte]string, value byte) string {
+	if name, exists := names[value]; exists {
+		return name
+	}
+
+	return fmt.Sprintf("unknown (%d)", value)
+}
+
+func WriteImages(entries []ImageEntry, w io.Writer) {
+	// WriteImages writes a human readable description of every entry
+
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s -> %s (%s)\n", entry.Payload, entry.Partition, entry.Step)
+		if entry.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", entry.Error)
+			continue
+		}
+		writeImageInfo(w, *entry.Image, "  ")
+	}
+}
+
+func writeImageInfo(w io.Writer, info ImageInfo, indent string) {
+	fmt.Fprintf(w, "%s%s, %d bytes", indent, info.Format, info.Size)
+	if info.Offset != 0 {
+		fmt.Fprintf(w, " at 0x%x", info.Offset)
+	}
+	fmt.Fprintln(w)
+
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"name", info.Name},
+		{"version", info.Version},
+		{"os", info.OS},
+		{"architecture", info.Architecture},
+		{"type", info.Type},
+		{"compression", info.Compression},
+		{"checksum", info.Checksum},
+	}
+	if info.LoadAddress != nil {
+		fields = append(fields, struct{ name, value string }{"load address", fmt.Sprintf("0x%08x", *info.LoadAddress)})
+	}
+	if info.EntryPoint != nil {
+		fields = append(fields, struct{ name, value string }{"entry point", fmt.Sprintf("0x%08x", *info.EntryPoint)})
+	}
+	if info.Created != nil {
+		fields = append(fields, struct{ name, value string }{"created", info.Created.Format(time.RFC3339)})
+	}
+
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Fprintf(w, "%s  %s: %s\n", indent, field.name, field.value)
+		}
+	}
+	for _, detail := range info.Details {
+		fmt.Fprintf(w, "%s  %s\n", indent, detail)
+	}
+	for _, content := range info.Contents {
+		writeImageInfo(w, content, indent+"  ")
+	}
+}
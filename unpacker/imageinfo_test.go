@@ -0,0 +1,217 @@
+package unpacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+)
+
+func uImage(name string, imageType byte, compression byte, data []byte) []byte {
+	header := make([]byte, uImageHeaderSize)
+	be := binary.BigEndian
+
+	be.PutUint32(header[0:], uImageMagic)
+	be.PutUint32(header[8:], 1587449549)
+	be.PutUint32(header[12:], uint32(len(data)))
+	be.PutUint32(header[16:], 0x10008000)
+	be.PutUint32(header[20:], 0x10008000)
+	be.PutUint32(header[24:], crc32.ChecksumIEEE(data))
+	header[28], header[29], header[30], header[31] = 5, 2, imageType, compression
+	copy(header[32:], name)
+	be.PutUint32(header[4:], crc32.ChecksumIEEE(header))
+
+	return append(header, data...)
+}
+
+func ubootEnv(size int, redundant bool, variables ...string) []byte {
+	start := 4
+	if redundant {
+		start = 5
+	}
+
+	env := make([]byte, size)
+	offset := start
+	for _, variable := range variables {
+		offset += copy(env[offset:], variable+"\x00")
+	}
+	if redundant {
+		env[4] = 1
+	}
+	binary.LittleEndian.PutUint32(env, crc32.ChecksumIEEE(env[start:]))
+
+	return env
+}
+
+func TestIdentifyImage(t *testing.T) {
+	var kernel bytes.Buffer
+	gz := gzip.NewWriter(&kernel)
+	gz.Write([]byte("\x00\x00Linux version 4.14.98-imx (oe-user@oe-host) #1 SMP PREEMPT\x00"))
+	gz.Close()
+
+	arm64 := make([]byte, 0x48)
+	binary.LittleEndian.PutUint64(arm64[8:], 0x80000)
+	binary.LittleEndian.PutUint64(arm64[16:], 0x1200000)
+	binary.LittleEndian.PutUint64(arm64[24:], 0x2)
+	copy(arm64[0x38:], "ARM\x64")
+
+	zImage := make([]byte, 0x40)
+	binary.LittleEndian.PutUint32(zImage[0x24:], zImageMagic)
+	binary.LittleEndian.PutUint32(zImage[0x2c:], 0x500000)
+
+	dtb := buildFDT(&FDTNode{Properties: []FDTProperty{{"model", []byte("Vendor Board\x00")}}})
+	fit := buildFDT(&FDTNode{
+		Properties: []FDTProperty{{"description", []byte("Kernel and FDT\x00")}},
+		Children: []*FDTNode{
+			{Name: "images", Children: []*FDTNode{
+				{Name: "kernel-1", Properties: []FDTProperty{
+					{"data", arm64},
+					{"type", []byte("kernel\x00")},
+					{"arch", []byte("arm64\x00")},
+					{"compression", []byte("none\x00")},
+					{"load", cells(0x40080000)},
+				}},
+				{Name: "fdt-1", Properties: []FDTProperty{{"data", dtb}, {"type", []byte("flat_dt\x00")}}},
+			}},
+			{Name: "configurations", Properties: []FDTProperty{{"default", []byte("conf-1\x00")}}},
+		},
+	})
+
+	broken := uImage("Linux", 2, 1, kernel.Bytes())
+	broken[len(broken)-1] ^= 0xff
+
+	imx := make([]byte, 0x800)
+	copy(imx[0x400:], "\xd1\x00\x20\x41")
+
+	cases := []struct {
+		name     string
+		data     []byte
+		format   string
+		version  string
+		checksum string
+		contents int
+	}{
+		{"uImage", uImage("Linux-4.14.98", 2, 1, kernel.Bytes()), "uImage", "Linux 4.14.98-imx", "ok", 0},
+		{"corrupt uImage", broken, "uImage", "Linux 4.14.98-imx", "data CRC mismatch", 0},
+		{"zImage", zImage, "zImage", "", "", 0},
+		{"ARM64 Image", arm64, "ARM64 Image", "", "", 0},
+		{"DTB", dtb, "DTB", "", "", 0},
+		{"FIT", fit, "FIT", "", "", 2},
+		{"environment", ubootEnv(0x2000, false, "bootcmd=run mmcboot"), "U-Boot environment", "", "ok", 0},
+		{"redundant environment", ubootEnv(0x2000, true, "bootdelay=3"), "U-Boot environment", "", "ok", 0},
+		{"bootloader", []byte("\x00\x01U-Boot SPL 2018.03-imx_v2018.03 (Apr 20 2020)\x00"), "U-Boot", "U-Boot 2018.03-imx_v2018.03", "", 0},
+		{"i.MX", imx, "i.MX boot image", "", "", 0},
+		{"squashfs", []byte("hsqs and more"), "squashfs", "", "", 0},
+		{"unknown", []byte("not really a kernel"), "unknown", "", "", 0},
+	}
+
+	for _, c := range cases {
+		info := IdentifyImage(c.data)
+		if info.Format != c.format || info.Version != c.version || info.Checksum != c.checksum || len(info.Contents) != c.contents {
+			t.Errorf("%s: got %+v", c.name, info)
+		}
+	}
+
+	info := IdentifyImage(uImage("Linux-4.14.98", 2, 1, kernel.Bytes()))
+	if info.Name != "Linux-4.14.98" || info.OS != "linux" || info.Architecture != "arm" || info.Type != "kernel" ||
+		info.Compression != "gzip" || *info.LoadAddress != 0x10008000 || info.Created.Unix() != 1587449549 {
+		t.Errorf("unexpected uImage header fields: %+v", info)
+	}
+
+	info = IdentifyImage(fit)
+	if info.Name != "Kernel and FDT" || info.Contents[0].Format != "ARM64 Image" || info.Contents[0].Name != "kernel-1" ||
+		*info.Contents[0].LoadAddress != 0x40080000 || info.Contents[1].Format != "DTB" || info.Contents[1].Name != "fdt-1" {
+		t.Errorf("unexpected FIT contents: %+v", info)
+	}
+}
+
+func TestIdentifyImages(t *testing.T) {
+	entries := IdentifyImages(ParseIniTree(writeSyntheticPackage(t)))
+
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %+v", entries)
+	}
+
+	entry := entries[0]
+	if entry.Partition != "kernel" || entry.Payload != "linux1/linux1.img" || entry.Step.MainStepNo != 2 ||
+		entry.Image == nil || entry.Image.Format != "unknown" || entry.Image.Size != 19 {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestIdentifyImagesLargeUImage(t *testing.T) {
+	main := writeSyntheticPackage(t)
+
+	// Bigger than the start of payloads read for headers
+	data := make([]byte, maxScanSize)
+	copy(data[len(data)-4:], "tail")
+	writeFiles(t, filepath.Dir(main), map[string]string{
+		"linux1/linux1.img.gz": string(uImage("big", 2, 0, data)),
+	})
+
+	entries := IdentifyImages(ParseIniTree(main))
+	if len(entries) != 1 || entries[0].Image == nil || entries[0].Image.Checksum != "ok" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	// A changed byte past the start is still found
+	image := uImage("big", 2, 0, data)
+	image[len(image)-1] = 'X'
+	writeFiles(t, filepath.Dir(main), map[string]string{"linux1/linux1.img": string(image)})
+
+	entries = IdentifyImages(ParseIniTree(main))
+	if len(entries) != 1 || entries[0].Image == nil || entries[0].Image.Checksum != "data CRC mismatch" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestIdentifyImageBounds(t *testing.T) {
+	// Crafted offsets and sizes must neither panic nor recurse endlessly
+	fitWith := func(properties ...FDTProperty) []byte {
+		return buildFDT(&FDTNode{Children: []*FDTNode{
+			{Name: "images", Children: []*FDTNode{{Name: "kernel-1", Properties: properties}}},
+		}})
+	}
+
+	for name, fit := range map[string][]byte{
+		"data-position": fitWith(FDTProperty{"data-position", cells(0xffffffff, 0xfffffff8)}, FDTProperty{"data-size", cells(0, 16)}),
+		"data-offset":   fitWith(FDTProperty{"data-offset", cells(0xffffffff, 0xffffffff)}, FDTProperty{"data-size", cells(0, 16)}),
+	} {
+		info := IdentifyImage(fit)
+		if info.Format != "FIT" || len(info.Contents) != 1 || info.Contents[0].Format != "data" || info.Contents[0].Size != 0 {
+			t.Errorf("%s: got %+v", name, info)
+		}
+	}
+
+	// An image covering the whole FIT, the size cell has a fixed length
+	size := len(fitWith(FDTProperty{"data-position", cells(0)}, FDTProperty{"data-size", cells(0)}))
+	itself := fitWith(FDTProperty{"data-position", cells(0)}, FDTProperty{"data-size", cells(uint32(size))})
+	info := IdentifyImage(itself)
+	if len(info.Contents) != 1 || info.Contents[0].Format != "data" || info.Contents[0].Size != int64(size) {
+		t.Errorf("self containing FIT: got %+v", info)
+	}
+
+	// Firmware uImages nested deeper than the limit, around the FIT, stop at the
+	// depth limit
+	nested := uImage("firmware", 5, 0, itself)
+	for i := 0; i < 2*maxImageDepth; i++ {
+		nested = uImage("firmware", 5, 0, nested)
+	}
+	depth := 0
+	for info := IdentifyImage(nested); len(info.Contents) > 0 && info.Format == "uImage"; info = info.Contents[0] {
+		depth++
+	}
+	if depth > maxImageDepth {
+		t.Errorf("nested images identified %d levels deep", depth)
+	}
+
+	zImage := make([]byte, 0x40)
+	binary.LittleEndian.PutUint32(zImage[0x24:], zImageMagic)
+	binary.LittleEndian.PutUint32(zImage[0x28:], 0x8000)
+	binary.LittleEndian.PutUint32(zImage[0x2c:], 0x100)
+	if info := IdentifyImage(zImage); info.Format != "zImage" || info.Size != 0 {
+		t.Errorf("zImage with end before start: got %+v", info)
+	}
+}
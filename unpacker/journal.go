@@ -0,0 +1,255 @@
+package unpacker
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// JournalFilename is the journal of finished steps kept in the staging folder
+// while an extraction is running
+const JournalFilename = ".upupandaway-journal"
+
+// StagingSuffix is appended to the output folder for the staging folder
+const StagingSuffix = ".partial"
+
+// extraction is the state of a single ExtractTree run
+type extraction struct {
+	config  *Config
+	staging string
+	marker  Marker
+	tracker *progressTracker
+	journal *journal
+	// failures are the steps that failed, a run with failures is not
+	// committed
+	failures []string
+	mutex    sync.Mutex
+}
+
+func newExtraction(tree []*Ini, config *Config) (*extraction, error) {
+	// Sets up the staging folder and journal. An existing staging folder is
+	// only reused when resuming, it's never silently thrown away.
+
+	run := &extraction{
+		config:  config,
+		staging: config.ToBase + StagingSuffix,
+		tracker: newProgressTracker(tree, config.Progress),
+	}
+
+	var err error
+	run.marker, err = NewMarker(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkOutput(config.ToBase, config.Mode, run.marker)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(run.staging)
+	switch {
+	case err == nil && !config.Resume:
+		return nil, fmt.Errorf("found interrupted extraction in %s, resume or remove it", run.staging)
+	case err == nil:
+		log.Printf("[+] Resuming extraction in %s", run.staging)
+	case os.IsNotExist(err):
+		if config.Resume {
+			log.Printf("[!] Nothing to resume in %s, starting over", run.staging)
+		}
+		err = os.MkdirAll(run.staging, 0755)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	run.journal, err = openJournal(filepath.Join(run.staging, JournalFilename), config.Sync)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+func (run *extraction) fail(step string, err error) {
+	// Records a failed step, the run goes on so all failures are reported at
+	// once
+
+	failure := fmt.Sprintf("%s: %s", step, err)
+	log.Printf("[!] %s", failure)
+
+	run.mutex.Lock()
+	run.failures = append(run.failures, failure)
+	run.mutex.Unlock()
+}
+
+func (run *extraction) failing() bool {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	return len(run.failures) > 0
+}
+
+func (run *extraction) failed() error {
+	// The error for a run with failures. The staging folder and the journal
+	// stay, so -resume only repeats the failed steps.
+
+	if len(run.failures) == 0 {
+		return nil
+	}
+
+	if err := run.journal.close(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%d steps failed, kept %s for resuming: %s", len(run.failures), run.staging,
+		strings.Join(run.failures, "; "))
+}
+
+func (run *extraction) copy(from string, to string) error {
+	// Copies a payload to its target, through the store if there is one
+
+	if run.config.Store != nil {
+		return run.config.Store.Put(from, to, run.config.Sync)
+	}
+
+	return copyFile(from, to, run.config.Sync)
+}
+
+func (run *extraction) commit() error {
+	// Moves a finished extraction into place according to the output mode
+
+	err := run.journal.close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(run.staging, JournalFilename))
+	if err != nil {
+		return err
+	}
+
+	err = writeMarker(run.staging, run.marker)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(run.config.ToBase); os.IsNotExist(err) {
+		return os.Rename(run.staging, run.config.ToBase)
+	}
+
+	if run.config.Mode == Merge {
+		return mergeDir(run.staging, run.config.ToBase)
+	}
+
+	return replaceDir(run.staging, run.config.ToBase)
+}
+
+// journal keeps track of the finished steps of every sub ini. A step is
+// identified by the StepNo of its sub ini in the main ini and its own StepNo.
+type journal struct {
+	file     *os.File
+	fsync    bool
+	finished map[[2]int]bool
+	mutex    sync.Mutex
+}
+
+func openJournal(filename string, fsync bool) (*journal, error) {
+	// Reads the steps of an earlier run and opens the journal for appending
+
+	j := &journal{fsync: fsync, finished: make(map[[2]int]bool)}
+
+	torn := false
+
+	existing, err := os.Open(filename)
+	if err == nil {
+		reader := bufio.NewReader(existing)
+		for {
+			// A torn last line without newline from a crash doesn't count
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				torn = line != ""
+				break
+			}
+
+			var key [2]int
+			if _, err := fmt.Sscanf(line, "%d %d", &key[0], &key[1]); err == nil {
+				j.finished[key] = true
+			}
+		}
+		existing.Close()
+
+		if len(j.finished) > 0 {
+			log.Printf("[+] %d steps already finished", len(j.finished))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't glue the next entry onto the torn line
+	if torn {
+		_, err = j.file.WriteString("\n")
+		if err != nil {
+			j.file.Close()
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+func (j *journal) done(ini *Ini, instruction Instruction) bool {
+	if j == nil {
+		return false
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.finished[[2]int{ini.Step.StepNo, instruction.StepNo}]
+}
+
+func (j *journal) record(ini *Ini, instruction Instruction) error {
+	// Appends a finished step. The folder and filename are only there for
+	// humans reading the journal.
+
+	if j == nil {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.finished[[2]int{ini.Step.StepNo, instruction.StepNo}] = true
+
+	_, err := fmt.Fprintf(j.file, "%d %d %s\n", ini.Step.StepNo, instruction.StepNo,
+		filepath.Join(ini.Folder, ini.Filename))
+	if err != nil {
+		return err
+	}
+
+	if j.fsync {
+		return j.file.Sync()
+	}
+
+	return nil
+}
+
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+
+	return j.file.Close()
+}
@@ -0,0 +1,128 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTreeResume(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+	staging := config.ToBase + StagingSuffix
+
+	// Pretend an earlier run copied b.txt and then died
+	writeFiles(t, staging, map[string]string{
+		"usr/share/app/b.txt": "kept",
+		JournalFilename:       "3 2 resources/files.ini\n3 1 resou",
+	})
+
+	if err := ExtractTree(tree, config); err == nil {
+		t.Fatal("interrupted run was not detected")
+	}
+
+	config.Resume = true
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readTree(t, config.ToBase)
+
+	if got["usr/share/app/b.txt"] != "kept" {
+		t.Errorf("finished step ran again: %q", got["usr/share/app/b.txt"])
+	}
+	if got["usr/share/app/a.txt"] != "second a\n" {
+		t.Errorf("unfinished steps did not run: %#v", got)
+	}
+	if _, exists := got[JournalFilename]; exists {
+		t.Error("journal left in output")
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("staging folder left behind: %v", err)
+	}
+}
+
+func TestExtractTreeFailedCopy(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	os.Remove(filepath.Join(filepath.Dir(main), "resources", "f0002.dat.gz"))
+	tree := ParseIniTree(main)
+
+	for _, config := range []*Config{
+		{ToBase: filepath.Join(t.TempDir(), "out")},
+		{ToBase: filepath.Join(t.TempDir(), "out"), Workers: 4},
+		{ToBase: filepath.Join(t.TempDir(), "out"), Layered: true},
+	} {
+		if err := ExtractTree(tree, config); err == nil {
+			t.Errorf("%+v: missing payload went unnoticed", config)
+		}
+		if _, err := os.Stat(config.ToBase); !os.IsNotExist(err) {
+			t.Errorf("%+v: incomplete extraction was committed", config)
+		}
+
+		journal, _ := os.ReadFile(filepath.Join(config.ToBase+StagingSuffix, JournalFilename))
+		if len(journal) == 0 {
+			t.Errorf("%+v: journal of the failed run is gone", config)
+		}
+	}
+
+	// Once the payload is back, resuming finishes the run
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+	ExtractTree(tree, config)
+	os.WriteFile(filepath.Join(filepath.Dir(main), "resources", "f0002.dat"), []byte("b\n"), 0644)
+	config.Resume = true
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, config.ToBase); got["usr/share/app/b.txt"] != "b\n" {
+		t.Errorf("resumed run is missing the failed step: %#v", got)
+	}
+}
+
+func TestExtractTreeResumeFailedCopy(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	root := filepath.Dir(main)
+
+	// The Remove after the failed Copy succeeds, it must still run again
+	// after the Copy on resume
+	writeFiles(t, root, map[string]string{
+		"resources/files.ini": `[Instructions]
+Count = 3
+1 = Copy, resources/f0001.dat, /usr/share/app/a.txt
+2 = Copy, resources/f0004.dat, /tmp/update.tar
+3 = Remove, /tmp/update.tar
+`,
+	})
+	tree := ParseIniTree(main)
+
+	for _, config := range []*Config{
+		{ToBase: filepath.Join(t.TempDir(), "out")},
+		{ToBase: filepath.Join(t.TempDir(), "out"), Workers: 4},
+		{ToBase: filepath.Join(t.TempDir(), "out"), Layered: true},
+	} {
+		os.Remove(filepath.Join(root, "resources/f0004.dat"))
+		if err := ExtractTree(tree, config); err == nil {
+			t.Fatalf("%+v: missing payload went unnoticed", config)
+		}
+
+		writeFiles(t, root, map[string]string{"resources/f0004.dat": "update"})
+		config.Resume = true
+		if err := ExtractTree(tree, config); err != nil {
+			t.Fatal(err)
+		}
+
+		merged := config.ToBase
+		if config.Layered {
+			layers, err := Layers(config.ToBase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merged = filepath.Join(t.TempDir(), "merged")
+			if err := MergeLayers(layers, merged); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := readTree(t, merged); got["tmp/update.tar"] != "" || got["usr/share/app/a.txt"] != "first a\n" {
+			t.Errorf("%+v: resumed run differs from a clean one: %#v", config, got)
+		}
+	}
+}
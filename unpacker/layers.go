@@ -0,0 +1,254 @@
+package unpacker
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// LayersDir contains one folder per main ini step in layered output
+	LayersDir = "layers"
+	// MergedDir contains all layers applied on top of each other
+	MergedDir = "merged"
+	// WhiteoutPrefix marks a path removed by a layer, same as in OCI images
+	WhiteoutPrefix = ".wh."
+	// OpaqueWhiteout marks a folder whose earlier content was removed
+	OpaqueWhiteout = ".wh..wh..opq"
+)
+
+func LayerName(ini *Ini) string {
+	// LayerName is the folder of a sub ini within LayersDir. The StepNo
+	// prefix keeps the folders sorted in the order they are applied.
+
+	return fmt.Sprintf("%03d_%s", ini.Step.StepNo, ini.Folder)
+}
+
+func Layers(toBase string) ([]string, error) {
+	// Layers lists the layer folders of a layered extraction in the order
+	// they have to be applied
+
+	entries, err := os.ReadDir(filepath.Join(toBase, LayersDir))
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			layers = append(layers, filepath.Join(toBase, LayersDir, entry.Name()))
+		}
+	}
+
+	sort.Strings(layers)
+
+	return layers, nil
+}
+
+func extractLayer(ini *Ini, run *extraction) {
+	// extractLayer records the changes of a single sub ini in its own layer.
+	// Steps are applied like in a flat extraction, see applyStep, except that
+	// Remove and RemoveFolderContent become whiteouts, so the layers describe
+	// the state after every step.
+
+	layer := filepath.Join(run.staging, LayersDir, LayerName(ini))
+
+	err := os.MkdirAll(layer, 0755)
+	if err != nil {
+		run.fail("layer "+LayerName(ini), err)
+		return
+	}
+
+	applySteps(ini, layer, run)
+}
+
+func createFile(path string) error {
+	// Creates an empty file, keeping an existing one as it is
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func whiteout(layer string, path string) error {
+	// Removes path from the layer itself and hides it in the layers below
+
+	target := filepath.Join(layer, path)
+
+	err := os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+
+	return createFile(filepath.Join(filepath.Dir(target), WhiteoutPrefix+filepath.Base(target)))
+}
+
+func lowerFile(layer string, path string) string {
+	// The file at path as the layers below layer leave it, empty if it
+	// doesn't exist there or layer itself removed it. Layers are extracted
+	// in order, so the layers below are complete.
+
+	if hidden(layer, path) {
+		return ""
+	}
+
+	layers, err := Layers(filepath.Dir(filepath.Dir(layer)))
+	if err != nil {
+		return ""
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		if layers[i] >= layer {
+			continue
+		}
+
+		if info, err := os.Lstat(filepath.Join(layers[i], path)); err == nil {
+			if info.Mode().IsRegular() {
+				return filepath.Join(layers[i], path)
+			}
+			return ""
+		}
+		if hidden(layers[i], path) {
+			return ""
+		}
+	}
+
+	return ""
+}
+
+func hidden(layer string, path string) bool {
+	// A layer hides path from the layers below with a whiteout of path or a
+	// folder above it, or an opaque whiteout in a folder above it
+
+	for p := path; p != filepath.Dir(p); p = filepath.Dir(p) {
+		dir := filepath.Join(layer, filepath.Dir(p))
+		if fileExists(filepath.Join(dir, WhiteoutPrefix+filepath.Base(p))) || fileExists(filepath.Join(dir, OpaqueWhiteout)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func clearWhiteout(target string) {
+	// A path that comes back after a Remove in the same layer doesn't need
+	// its whiteout anymore
+
+	os.Remove(filepath.Join(filepath.Dir(target), WhiteoutPrefix+filepath.Base(target)))
+}
+
+func opaqueWhiteout(layer string, dir string) error {
+	// Empties dir in the layer itself and hides its content in the layers
+	// below
+
+	target := filepath.Join(layer, dir)
+
+	entries, err := os.ReadDir(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(target, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return createFile(filepath.Join(target, OpaqueWhiteout))
+}
+
+func MergeLayers(layers []string, merged string) error {
+	// MergeLayers applies the layers in order on top of each other into
+	// merged. A layer's whiteouts only affect the layers below it, so they
+	// are applied before the files of the same layer are copied.
+
+	return mergeLayers(layers, merged, func(from string, to string) error {
+		return copyFile(from, to, false)
+	})
+}
+
+func mergeLayers(layers []string, merged string, copy func(from string, to string) error) error {
+
+	err := os.MkdirAll(merged, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		log.Printf("[+] Merging layer %s", filepath.Base(layer))
+
+		err = applyWhiteouts(layer, merged)
+		if err != nil {
+			return err
+		}
+
+		err = filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), WhiteoutPrefix) {
+				return err
+			}
+
+			rel, err := filepath.Rel(layer, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(merged, rel)
+
+			// A file replacing a folder of a lower layer
+			if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+
+			return copy(path, target)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyWhiteouts(layer string, merged string) error {
+	return filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasPrefix(info.Name(), WhiteoutPrefix) {
+			return err
+		}
+
+		rel, err := filepath.Rel(layer, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(merged, rel)
+
+		if info.Name() == OpaqueWhiteout {
+			entries, err := os.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		return os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(info.Name(), WhiteoutPrefix)))
+	})
+}
@@ -0,0 +1,117 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExtractTreeLayered(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out"), Layered: true}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readTree(t, config.ToBase)
+	want := map[string]string{
+		MarkerFilename:                             got[MarkerFilename],
+		"layers/001_bootstrap/tmp/.wh.setup.sh":    "",
+		"layers/003_resources/usr/share/app/a.txt": "second a\n",
+		"layers/003_resources/usr/share/app/b.txt": "b\n",
+		"layers/003_resources/data/marker":         "",
+		"merged/usr/share/app/a.txt":               "second a\n",
+		"merged/usr/share/app/b.txt":               "b\n",
+		"merged/data/marker":                       "",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %#v\nwant: %#v", got, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(config.ToBase, LayersDir, "002_linux1")); err != nil {
+		t.Errorf("missing layer for binary.ini: %v", err)
+	}
+}
+
+func TestMergeLayers(t *testing.T) {
+	base := t.TempDir()
+	files := map[string]string{
+		"1/a/x":                     "x",
+		"1/a/y":                     "y",
+		"1/b":                       "b",
+		"1/c":                       "lower c",
+		"2/a/" + OpaqueWhiteout:     "",
+		"2/a/z":                     "z",
+		"2/" + WhiteoutPrefix + "b": "",
+		"2/c":                       "upper c",
+	}
+	writeFiles(t, base, files)
+
+	merged := filepath.Join(base, "merged")
+	err := MergeLayers([]string{filepath.Join(base, "1"), filepath.Join(base, "2")}, merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readTree(t, merged)
+	want := map[string]string{"a/z": "z", "c": "upper c"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestExtractTreeLayeredMatchesFlat(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	root := filepath.Dir(main)
+
+	// Later layers empty folders, remove and create again files of the
+	// layers below
+	writeFiles(t, root, map[string]string{
+		"bootstrap/execute.ini": `[Instructions]
+Count = 5
+1 = Copy, e0000000001.dat, setup.sh
+2 = Copy, e0000000001.dat, /usr/share/app/old.txt
+3 = Copy, e0000000001.dat, /data/marker
+4 = Execute, "/tmp/setup.sh"
+5 = Remove, setup.sh
+`,
+		"resources/files.ini": `[Instructions]
+Count = 7
+1 = Copy, resources/f0001.dat, /usr/share/app/a.txt
+2 = RemoveFolderContent, /usr/share/app
+3 = Copy, resources/f0002.dat, /usr/share/app/b.txt
+4 = Create, /data/marker
+5 = Remove, /usr/share/app/b.txt
+6 = Create, /usr/share/app/b.txt
+7 = Copy, resources/f0003.dat, /opt/a.txt
+`,
+	})
+
+	tree := ParseIniTree(main)
+	base := t.TempDir()
+
+	flat := &Config{ToBase: filepath.Join(base, "flat")}
+	layered := &Config{ToBase: filepath.Join(base, "layered"), Layered: true}
+	for _, config := range []*Config{flat, layered} {
+		if err := ExtractTree(tree, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := readTree(t, flat.ToBase)
+	delete(want, MarkerFilename)
+	got := readTree(t, filepath.Join(layered.ToBase, MergedDir))
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged layers differ from the flat extraction\ngot: %#v\nwant: %#v", got, want)
+	}
+
+	script := syntheticFiles["bootstrap/e0000000001.dat.gz"]
+	if len(want) != 3 || want["data/marker"] != script || want["usr/share/app/b.txt"] != "" || want["opt/a.txt"] != "second a\n" {
+		t.Errorf("unexpected flat extraction %#v", want)
+	}
+}
@@ -0,0 +1,217 @@
+package unpacker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Version of the tool, recorded in every output folder
+const Version = "0.1.0"
+
+// MarkerFilename is written to the root of every extraction and records what
+// was extracted with which version
+const MarkerFilename = ".upupandaway.json"
+
+// OutputMode decides what happens when the output folder already exists
+type OutputMode int
+
+const (
+	// Refuse fails the extraction, this is the default
+	Refuse OutputMode = iota
+	// Overwrite replaces the existing folder once the new run succeeded
+	Overwrite
+	// Merge moves the new files over the existing folder, keeping files that
+	// are not part of the new run
+	Merge
+)
+
+// ParseOutputMode parses the names used on the command line
+func ParseOutputMode(name string) (OutputMode, error) {
+	switch strings.ToLower(name) {
+	case "refuse", "":
+		return Refuse, nil
+	case "overwrite":
+		return Overwrite, nil
+	case "merge":
+		return Merge, nil
+	default:
+		return Refuse, fmt.Errorf("unknown output mode %q", name)
+	}
+}
+
+// Marker is the content of MarkerFilename
+type Marker struct {
+	Tool       string `json:"tool"`
+	Version    string `json:"version"`
+	PackageID  int64  `json:"package_id"`
+	UPType     string `json:"up_type,omitempty"`
+	SubUPType  string `json:"sub_up_type,omitempty"`
+	Source     string `json:"source"`
+	MainSHA256 string `json:"main_instructions_sha256"`
+}
+
+func PackageName(tree []*Ini) string {
+	// PackageName is the deterministic folder name for the output of a
+	// package. It is based on the PackageID, packages without one fall back
+	// to the name of their folder.
+
+	main := tree[0]
+
+	if main.Settings.Packageid != 0 {
+		return fmt.Sprintf("up_%d", main.Settings.Packageid)
+	}
+
+	return "up_" + filepath.Base(main.RootDir)
+}
+
+func OutputPath(tree []*Ini, outDir string) string {
+	// OutputPath returns where a package is extracted to within outDir
+
+	return filepath.Join(outDir, PackageName(tree))
+}
+
+func NewMarker(tree []*Ini) (Marker, error) {
+	// Creates the marker for a parsed tree. The hash of main_instructions.ini
+	// identifies the package even if the PackageID is reused.
+
+	main := tree[0]
+
+	marker := Marker{
+		Tool:      "upupandaway",
+		Version:   Version,
+		PackageID: main.Settings.Packageid,
+		UPType:    strings.Trim(main.DataStorage.UPType, "\""),
+		SubUPType: strings.Trim(main.DataStorage.SubUPType, "\""),
+	}
+
+	source, err := filepath.Abs(main.RootDir)
+	if err != nil {
+		return marker, err
+	}
+	marker.Source = source
+
+	file, err := os.Open(main.Filename)
+	if err != nil {
+		return marker, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return marker, err
+	}
+	marker.MainSHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return marker, nil
+}
+
+func ReadMarker(dir string) (Marker, error) {
+	// Reads the marker of an existing output folder
+
+	var marker Marker
+
+	content, err := os.ReadFile(filepath.Join(dir, MarkerFilename))
+	if err != nil {
+		return marker, err
+	}
+
+	err = json.Unmarshal(content, &marker)
+
+	return marker, err
+}
+
+func writeMarker(dir string, marker Marker) error {
+	content, err := json.MarshalIndent(marker, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, MarkerFilename), append(content, '\n'), 0644)
+}
+
+func checkOutput(toBase string, mode OutputMode, marker Marker) error {
+	// Checks an existing output folder against the output mode before any
+	// work is done
+
+	_, err := os.Stat(toBase)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case Overwrite:
+		log.Printf("[!] %s exists and will be replaced", toBase)
+	case Merge:
+		existing, err := ReadMarker(toBase)
+		if err == nil && existing.MainSHA256 != marker.MainSHA256 {
+			log.Printf("[!] Merging package %d into output of package %d",
+				marker.PackageID, existing.PackageID)
+		}
+	default:
+		return fmt.Errorf("%s already exists", toBase)
+	}
+
+	return nil
+}
+
+func replaceDir(from string, to string) error {
+	// Replaces to with from. The old folder is only removed once the new one
+	// is in place.
+
+	old := to + ".old"
+
+	if err := os.Rename(to, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+func mergeDir(from string, to string) error {
+	// Moves every file of from into to, replacing what's already there, and
+	// removes from afterwards
+
+	err := filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// A directory can't be replaced by a file with a rename
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		return os.Rename(path, target)
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(from)
+}
@@ -0,0 +1,49 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputModes(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	toBase := OutputPath(tree, t.TempDir())
+
+	if filepath.Base(toBase) != "up_1587449549" {
+		t.Errorf("unexpected output name %s", toBase)
+	}
+
+	if err := ExtractTree(tree, &Config{ToBase: toBase}); err != nil {
+		t.Fatal(err)
+	}
+
+	marker, err := ReadMarker(toBase)
+	if err != nil || marker.PackageID != 1587449549 || marker.Version != Version || marker.UPType != "Reinstall" {
+		t.Errorf("unexpected marker %+v: %v", marker, err)
+	}
+
+	if err := ExtractTree(tree, &Config{ToBase: toBase}); err == nil {
+		t.Error("existing output was not refused")
+	}
+
+	extra := filepath.Join(toBase, "extra")
+	os.WriteFile(extra, []byte("analyst notes"), 0644)
+
+	if err := ExtractTree(tree, &Config{ToBase: toBase, Mode: Merge}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(extra); err != nil {
+		t.Errorf("merge removed unrelated file: %v", err)
+	}
+
+	if err := ExtractTree(tree, &Config{ToBase: toBase, Mode: Overwrite}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(extra); !os.IsNotExist(err) {
+		t.Errorf("overwrite kept old file: %v", err)
+	}
+	if got := readTree(t, toBase); got["usr/share/app/b.txt"] != "b\n" {
+		t.Errorf("overwrite lost extracted files: %#v", got)
+	}
+}
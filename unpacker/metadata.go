@@ -0,0 +1,372 @@
+package unpacker
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileMeta is the ownership and permission of a path as the update would
+// leave it. Nil values mean the update doesn't change the default.
+type FileMeta struct {
+	Mode    *os.FileMode
+	Uid     *int
+	Gid     *int
+	Symlink string
+}
+
+// Metadata maps absolute paths on the target filesystem to their metadata
+type Metadata map[string]*FileMeta
+
+func InferMetadata(tree []*Ini, root string) Metadata {
+	// InferMetadata collects the chmod, chown, chgrp and ln -s commands of
+	// Execute steps, including the scripts they run if those were copied by
+	// the package or extracted to root, and applies them in the order of the
+	// package.
+	//
+	// Paths with shell variables can't be resolved and are skipped, globs are
+	// expanded against the files in root.
+
+	meta := make(Metadata)
+	users := readIDs(filepath.Join(root, "etc/passwd"))
+	groups := readIDs(filepath.Join(root, "etc/group"))
+	copied := make(map[string]string)
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			recordCopy(copied, ini, instruction)
+			if instruction.InstructionStep != Execute {
+				continue
+			}
+
+			for _, command := range executeCommands(instruction, root, copied) {
+				meta.apply(command, root, users, groups)
+			}
+		}
+	}
+
+	return meta
+}
+
+func recordCopy(copied map[string]string, ini *Ini, instruction Instruction) {
+	// Keeps the payload of a Copy step by the path it's copied to
+
+	if instruction.InstructionStep != Copy {
+		return
+	}
+	if target, err := stepTarget(ini, instruction); err == nil && target != "" {
+		copied[target] = sourcePath(ini, instruction.Arguments[0])
+	}
+}
+
+func executeCommands(instruction Instruction, root string, copied map[string]string) [][]string {
+	// The commands of an Execute step, followed by the commands of the
+	// script it runs. The script is read from the payload last copied to its
+	// path (see recordCopy), scripts the package removes again after running
+	// them are gone from the extraction. Others are read from root.
+
+	commands := shellCommands(strings.Join(instruction.Arguments, " "))
+	all := make([][]string, 0, len(commands))
+
+	for _, command := range commands {
+		all = append(all, command)
+
+		script := command[0]
+		if (script == "sh" || script == "/bin/sh" || script == "bash") && len(command) > 1 {
+			script = command[1]
+		}
+
+		var content []byte
+		var err error
+		if payload := copied[devicePath(script)]; payload != "" {
+			content, err = readPayload(payload)
+		} else {
+			content, err = os.ReadFile(filepath.Join(root, devicePath(script)))
+		}
+		if err != nil || !isScript(content) && !strings.HasSuffix(script, ".sh") {
+			continue
+		}
+
+		all = append(all, shellCommands(string(content))...)
+	}
+
+	return all
+}
+
+func isScript(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("#!"))
+}
+
+func (meta Metadata) get(path string) *FileMeta {
+	if meta[path] == nil {
+		meta[path] = &FileMeta{}
+	}
+
+	return meta[path]
+}
+
+func (meta Metadata) apply(command []string, root string, users map[string]int, groups map[string]int) {
+	name := filepath.Base(command[0])
+	flags, args := splitFlags(command[1:], name == "chmod")
+	recursive := strings.Contains(flags, "R")
+
+	switch name {
+	case "chmod":
+		if len(args) < 2 {
+			return
+		}
+		for _, path := range expandPaths(args[1:], root, recursive) {
+			entry := meta.get(path)
+			mode, ok := parseMode(args[0], currentMode(entry, root, path))
+			if ok {
+				entry.Mode = &mode
+			}
+		}
+	case "chown", "chgrp":
+		if len(args) < 2 {
+			return
+		}
+		owner, group := args[0], ""
+		if name == "chgrp" {
+			owner, group = "", args[0]
+		} else if i := strings.IndexAny(owner, ":."); i >= 0 {
+			owner, group = owner[:i], owner[i+1:]
+		}
+		uid, hasUid := lookupID(owner, users)
+		gid, hasGid := lookupID(group, groups)
+		for _, path := range expandPaths(args[1:], root, recursive) {
+			entry := meta.get(path)
+			if hasUid {
+				entry.Uid = &uid
+			}
+			if hasGid {
+				entry.Gid = &gid
+			}
+		}
+	case "ln":
+		if !strings.Contains(flags, "s") || len(args) != 2 || strings.Contains(args[1], "$") {
+			return
+		}
+		link := devicePath(args[1])
+		if strings.HasSuffix(args[1], "/") {
+			link = filepath.Join(devicePath(args[1]), filepath.Base(args[0]))
+		}
+		meta.get(link).Symlink = args[0]
+	}
+}
+
+func splitFlags(words []string, chmod bool) (string, []string) {
+	// Separates short flags like -R or -sf from the other arguments. Modes
+	// like -w for chmod look like flags, they're kept as arguments.
+
+	var flags strings.Builder
+	args := make([]string, 0, len(words))
+
+	for _, word := range words {
+		isMode := chmod && strings.ContainsAny(word, "rwxXst=")
+		if len(args) == 0 && strings.HasPrefix(word, "-") && len(word) > 1 && !isMode {
+			flags.WriteString(word[1:])
+			continue
+		}
+		args = append(args, word)
+	}
+
+	return flags.String(), args
+}
+
+func expandPaths(args []string, root string, recursive bool) []string {
+	// Turns the path arguments of a command into absolute paths on the target
+	// filesystem
+
+	paths := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if strings.Contains(arg, "$") || strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		path := devicePath(arg)
+
+		if strings.ContainsAny(path, "*?[") {
+			matches, _ := filepath.Glob(filepath.Join(root, path))
+			for _, match := range matches {
+				rel, _ := filepath.Rel(root, match)
+				paths = append(paths, "/"+filepath.ToSlash(rel))
+			}
+			continue
+		}
+
+		paths = append(paths, path)
+
+		if recursive {
+			filepath.Walk(filepath.Join(root, path), func(sub string, info os.FileInfo, err error) error {
+				if err == nil && sub != filepath.Join(root, path) {
+					rel, _ := filepath.Rel(root, sub)
+					paths = append(paths, "/"+filepath.ToSlash(rel))
+				}
+				return nil
+			})
+		}
+	}
+
+	return paths
+}
+
+func currentMode(entry *FileMeta, root string, path string) os.FileMode {
+	if entry.Mode != nil {
+		return *entry.Mode
+	}
+
+	return defaultMode(filepath.Join(root, path))
+}
+
+func defaultMode(file string) os.FileMode {
+	// defaultMode guesses the mode a path has on the device before any
+	// chmod: folders and executables 0755, everything else 0644
+
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		return 0755
+	}
+
+	head := make([]byte, 4)
+	f, err := os.Open(file)
+	if err == nil {
+		f.Read(head)
+		f.Close()
+	}
+
+	if bytes.HasPrefix(head, []byte("\x7fELF")) || isScript(head) {
+		return 0755
+	}
+
+	return 0644
+}
+
+func parseMode(spec string, current os.FileMode) (os.FileMode, bool) {
+	// Parses octal modes and the common symbolic ones like +x, u+x,go-w or
+	// a=rx
+
+	if octal, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		mode := os.FileMode(octal) & os.ModePerm
+		if octal&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if octal&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if octal&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		return mode, true
+	}
+
+	mode := current
+
+	for _, clause := range strings.Split(spec, ",") {
+		i := strings.IndexAny(clause, "+-=")
+		if i < 0 {
+			return current, false
+		}
+
+		who, op, perms := clause[:i], clause[i], clause[i+1:]
+		if who == "" || strings.Contains(who, "a") {
+			who = "ugo"
+		}
+
+		var bits os.FileMode
+		for _, p := range perms {
+			switch p {
+			case 'r':
+				bits |= 4
+			case 'w':
+				bits |= 2
+			case 'x', 'X':
+				bits |= 1
+			}
+		}
+
+		var mask, set os.FileMode
+		for _, w := range who {
+			shift := map[rune]uint{'u': 6, 'g': 3, 'o': 0}[w]
+			mask |= 7 << shift
+			set |= bits << shift
+		}
+
+		switch op {
+		case '+':
+			mode |= set
+		case '-':
+			mode &^= set
+		case '=':
+			mode = mode&^mask | set
+		}
+	}
+
+	return mode, true
+}
+
+func readIDs(file string) map[string]int {
+	// Reads name to id mappings from a passwd or group file
+
+	ids := map[string]int{"root": 0}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return ids
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[2]); err == nil {
+			ids[fields[0]] = id
+		}
+	}
+
+	return ids
+}
+
+func lookupID(name string, ids map[string]int) (int, bool) {
+	if name == "" {
+		return 0, false
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, true
+	}
+
+	id, exists := ids[name]
+	return id, exists
+}
+
+func nameOf(id int, ids map[string]int) string {
+	// The reverse of lookupID, the first name in alphabetical order wins for
+	// ids with several names
+
+	names := make([]string, 0)
+	for name, candidate := range ids {
+		if candidate == id {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+	return names[0]
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package unpacker
+
+import (
+	"os"
+	"syscall"
+)
+
+// notifier signals changes in watched folders through inotify. Events are
+// coalesced, the watcher rescans anyway.
+type notifier struct {
+	fd     int
+	file   *os.File
+	events chan struct{}
+}
+
+func newNotifier(dir string) (*notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non blocking file is read through the runtime poller, so closing it
+	// ends a pending read
+	n := &notifier{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), events: make(chan struct{}, 1)}
+
+	if err := n.add(dir); err != nil {
+		n.close()
+		return nil, err
+	}
+
+	go n.read()
+
+	return n, nil
+}
+
+func (n *notifier) add(dir string) error {
+	_, err := syscall.InotifyAddWatch(n.fd, dir, syscall.IN_CREATE|syscall.IN_MOVED_TO|
+		syscall.IN_MOVED_FROM|syscall.IN_DELETE|syscall.IN_CLOSE_WRITE)
+	return err
+}
+
+func (n *notifier) read() {
+	buffer := make([]byte, 64*1024)
+
+	for {
+		if _, err := n.file.Read(buffer); err != nil {
+			return
+		}
+
+		select {
+		case n.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *notifier) close() {
+	n.file.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package unpacker
+
+import (
+	"errors"
+)
+
+// notifier is only implemented with inotify, the watcher polls elsewhere
+type notifier struct {
+	events chan struct{}
+}
+
+func newNotifier(dir string) (*notifier, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
+
+func (n *notifier) add(dir string) error {
+	return nil
+}
+
+func (n *notifier) close() {}
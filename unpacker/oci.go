@@ -0,0 +1,402 @@
+package unpacker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// OCIOptions configures ExportOCI
+type OCIOptions struct {
+	// Tag is the reference name, defaults to upupandaway/<PackageName>:latest
+	Tag string
+	// Architecture of the image, defaults to the one of this machine so the
+	// image can be loaded without emulation. Nothing in it runs anyway.
+	Architecture string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociHistory struct {
+	CreatedBy string `json:"created_by"`
+}
+
+type ociConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []ociHistory `json:"history"`
+}
+
+// dockerManifest is the manifest.json of `docker save`, added so older docker
+// versions without OCI layout support can load the image as well
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ociBlob is a layer compressed to a temporary file
+type ociBlob struct {
+	file   *os.File
+	digest string
+	diffID string
+	size   int64
+}
+
+func ExportOCI(tree []*Ini, toBase string, out io.Writer, options OCIOptions) error {
+	// ExportOCI writes an extraction as OCI image layout tarball, loadable
+	// with `podman load` or `docker load`. Layered output becomes one image
+	// layer per main ini step, flat output a single layer. Its whiteouts are
+	// already in the format OCI expects.
+	//
+	// The PackageID, UPType and SubUPType of the marker end up as labels.
+
+	marker, err := ReadMarker(toBase)
+	if err != nil {
+		return err
+	}
+
+	layers, err := Layers(toBase)
+	if os.IsNotExist(err) {
+		layers = []string{toBase}
+	} else if err != nil {
+		return err
+	}
+
+	if options.Tag == "" {
+		options.Tag = "upupandaway/" + PackageName(tree) + ":latest"
+	}
+	if options.Architecture == "" {
+		options.Architecture = runtime.GOARCH
+	}
+
+	config := ociConfig{Architecture: options.Architecture, OS: "linux"}
+	config.RootFS.Type = "layers"
+	config.Config.Labels = map[string]string{
+		"upupandaway.package_id":  strconv.FormatInt(marker.PackageID, 10),
+		"upupandaway.up_type":     marker.UPType,
+		"upupandaway.sub_up_type": marker.SubUPType,
+		"upupandaway.version":     marker.Version,
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Annotations:   config.Config.Labels,
+	}
+
+	tw := tar.NewWriter(out)
+
+	// Layers with the same content, like the empty layers of sub inis that
+	// don't change the filesystem, share their blob
+	written := make(map[string]bool)
+
+	for _, layer := range layers {
+		blob, err := compressLayer(layer, layer == toBase)
+		if err != nil {
+			return err
+		}
+
+		if !written[blob.digest] {
+			err = writeBlobFile(tw, blob)
+			written[blob.digest] = true
+		}
+		blob.file.Close()
+		os.Remove(blob.file.Name())
+		if err != nil {
+			return err
+		}
+
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, blob.diffID)
+		config.History = append(config.History, ociHistory{CreatedBy: filepath.Base(layer)})
+		manifest.Layers = append(manifest.Layers, ociDescriptor{
+			MediaType: ociLayerType,
+			Digest:    blob.digest,
+			Size:      blob.size,
+		})
+	}
+
+	manifest.Config, err = writeJSONBlob(tw, ociConfigType, config)
+	if err != nil {
+		return err
+	}
+
+	manifestDescriptor, err := writeJSONBlob(tw, ociManifestType, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDescriptor.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": options.Tag,
+		"io.containerd.image.name":          options.Tag,
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests:     []ociDescriptor{manifestDescriptor},
+	}
+
+	docker := []dockerManifest{{
+		Config:   blobPath(manifest.Config.Digest),
+		RepoTags: []string{options.Tag},
+	}}
+	for _, layer := range manifest.Layers {
+		docker[0].Layers = append(docker[0].Layers, blobPath(layer.Digest))
+	}
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"oci-layout", map[string]string{"imageLayoutVersion": "1.0.0"}},
+		{"index.json", index},
+		{"manifest.json", docker},
+	}
+
+	for _, file := range files {
+		content, err := json.Marshal(file.content)
+		if err != nil {
+			return err
+		}
+
+		err = writeTarFile(tw, file.name, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func blobPath(digest string) string {
+	return "blobs/sha256/" + digest[len("sha256:"):]
+}
+
+func compressLayer(layer string, flat bool) (*ociBlob, error) {
+	// Writes layer as gzipped tar to a temporary file, hashing both the
+	// compressed (digest) and uncompressed (diff id) stream on the way
+
+	file, err := os.CreateTemp("", "upupandaway-layer-")
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &ociBlob{file: file}
+
+	compressedHash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(file, compressedHash))
+	uncompressedHash := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(gz, uncompressedHash))
+
+	// The marker of a flat extraction isn't part of the filesystem
+	skip := func(rel string) bool {
+		return flat && rel == MarkerFilename
+	}
+
+	err = writeTarTree(tw, layer, skip)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		blob.size, err = file.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	blob.digest = digestOf(compressedHash)
+	blob.diffID = digestOf(uncompressedHash)
+
+	return blob, nil
+}
+
+func digestOf(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func writeTarTree(tw *tar.Writer, dir string, skip func(rel string) bool) error {
+	// writeTarTree adds everything below dir to tw with stable headers, so
+	// the same tree always results in the same bytes
+
+	paths := make([]string, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if skip != nil && skip(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Walk is lexical already, sorting makes it explicit
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		path := filepath.Join(dir, rel)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.ModTime = time.Unix(0, 0)
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "root", "root"
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(tw, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeBlobFile(tw *tar.Writer, blob *ociBlob) error {
+	_, err := blob.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     blobPath(blob.digest),
+		Mode:     0644,
+		Size:     blob.size,
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, blob.file)
+
+	return err
+}
+
+func writeJSONBlob(tw *tar.Writer, mediaType string, content interface{}) (ociDescriptor, error) {
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	sum := sha256.Sum256(encoded)
+	descriptor := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(encoded)),
+	}
+
+	return descriptor, writeTarFile(tw, blobPath(descriptor.Digest), encoded)
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(content)
+
+	return err
+}
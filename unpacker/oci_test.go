@@ -0,0 +1,83 @@
+package unpacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportOCI(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out"), Layered: true}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second empty layer next to the one of binary.ini
+	if err := os.Mkdir(filepath.Join(config.ToBase, LayersDir, "004_empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := ExportOCI(tree, config.ToBase, &out, OCIOptions{Architecture: "arm"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, exists := files[header.Name]; exists {
+			t.Errorf("%s is written twice", header.Name)
+		}
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = content
+	}
+
+	for name, content := range files {
+		if filepath.Dir(name) != "blobs/sha256" {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != filepath.Base(name) {
+			t.Errorf("blob %s doesn't match its digest", name)
+		}
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(files["index.json"], &index); err != nil || len(index.Manifests) != 1 {
+		t.Fatalf("bad index.json %s: %v", files["index.json"], err)
+	}
+
+	var manifest ociManifest
+	json.Unmarshal(files[blobPath(index.Manifests[0].Digest)], &manifest)
+	if len(manifest.Layers) != 4 || manifest.Layers[1].Digest != manifest.Layers[3].Digest {
+		t.Errorf("expected one layer per layer folder, got %+v", manifest.Layers)
+	}
+	if tag := index.Manifests[0].Annotations["org.opencontainers.image.ref.name"]; tag != "upupandaway/up_1587449549:latest" {
+		t.Errorf("unexpected tag %s", tag)
+	}
+
+	var image ociConfig
+	json.Unmarshal(files[blobPath(manifest.Config.Digest)], &image)
+	if image.Config.Labels["upupandaway.package_id"] != "1587449549" || image.Config.Labels["upupandaway.up_type"] != "Reinstall" {
+		t.Errorf("missing labels: %#v", image.Config.Labels)
+	}
+	if len(image.RootFS.DiffIDs) != 4 || image.Architecture != "arm" {
+		t.Errorf("unexpected config: %#v", image)
+	}
+}
@@ -0,0 +1,176 @@
+package unpacker
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stepJob is a single step of a sub ini changing the filesystem, to is the
+// path it changes in the staging folder
+type stepJob struct {
+	ini         *Ini
+	instruction Instruction
+	to          string
+}
+
+func extractParallel(tree []*Ini, run *extraction) {
+	// extractParallel extracts the same files as the sequential path, but
+	// runs the steps on run.config.Workers goroutines.
+	//
+	// Steps that touch the same path, or where one target is a parent
+	// directory of another target, are put into the same group and run in
+	// their original order on a single worker. That way later steps still
+	// win, a Remove only removes what was copied before it and the result is
+	// identical to a sequential run. Once a step of a group failed, its later
+	// steps aren't journaled, see applySteps. Other groups don't share paths
+	// with it and are journaled as usual.
+
+	os.Mkdir(run.staging, 0755)
+
+	jobs := make([]stepJob, 0)
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		log.Printf("[+] Extracting %s", filepath.Join(ini.Folder, ini.Filename))
+
+		for _, instruction := range ini.Instructions.Instructions {
+			// Finished in an earlier, interrupted run
+			if run.journal.done(ini, instruction) {
+				run.tracker.advance(ini, 1)
+				continue
+			}
+
+			target, err := stepTarget(ini, instruction)
+			if err != nil {
+				run.fail(newStepRef(ini, instruction).String(), err)
+			}
+			if target == "" {
+				run.tracker.advance(ini, 1)
+				continue
+			}
+
+			jobs = append(jobs, stepJob{
+				ini:         ini,
+				instruction: instruction,
+				to:          filepath.Join(run.staging, target),
+			})
+		}
+	}
+
+	groups := groupJobs(jobs)
+
+	queue := make(chan []stepJob)
+	var wg sync.WaitGroup
+
+	for i := 0; i < run.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for group := range queue {
+				failed := false
+				for _, job := range group {
+					err := applyJob(job, run)
+					if err != nil {
+						run.fail(newStepRef(job.ini, job.instruction).String(), err)
+						failed = true
+					} else if !failed {
+						check(run.journal.record(job.ini, job.instruction))
+					}
+					run.tracker.advance(job.ini, 1)
+				}
+			}
+		}()
+	}
+
+	for _, group := range groups {
+		queue <- group
+	}
+	close(queue)
+	wg.Wait()
+
+	// Steps that don't change the filesystem are done as well by now
+	for _, ini := range tree[1:] {
+		run.tracker.finish(ini)
+	}
+}
+
+func applyJob(job stepJob, run *extraction) (err error) {
+	// A panic on a worker can't be recovered by the caller of ExtractTree
+	// and would end the whole process, it fails the step instead
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return applyStep(job.ini, job.instruction, run.staging, run)
+}
+
+func groupJobs(jobs []stepJob) [][]stepJob {
+	// groupJobs partitions the jobs into groups that can run independently of
+	// each other. Jobs within a group keep their original order.
+
+	parent := make([]int, len(jobs))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+
+	union := func(a int, b int) {
+		parent[find(a)] = find(b)
+	}
+
+	// First job seen for every target path
+	first := make(map[string]int)
+	for i, job := range jobs {
+		if j, exists := first[job.to]; exists {
+			union(i, j)
+		} else {
+			first[job.to] = i
+		}
+	}
+
+	// A file that is also used as a directory by another step
+	for i, job := range jobs {
+		for dir := filepath.Dir(job.to); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if j, exists := first[dir]; exists {
+				union(i, j)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]stepJob)
+	roots := make([]int, 0)
+	for i, job := range jobs {
+		root := find(i)
+		if _, exists := byRoot[root]; !exists {
+			roots = append(roots, root)
+		}
+		byRoot[root] = append(byRoot[root], job)
+	}
+
+	// Jobs were appended in their original order, so every group already is
+	// sorted
+	groups := make([][]stepJob, 0, len(roots))
+	for _, root := range roots {
+		groups = append(groups, byRoot[root])
+	}
+
+	return groups
+}
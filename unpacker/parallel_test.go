@@ -0,0 +1,83 @@
+package unpacker
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractParallelMatchesSequential(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	base := t.TempDir()
+
+	// Empty the folder between copies, only the last b.txt is left
+	writeFiles(t, filepath.Dir(main), map[string]string{
+		"resources/files.ini": `[Instructions]
+Count = 6
+1 = Copy, resources/f0001.dat, /usr/share/app/a.txt
+2 = Copy, resources/f0002.dat, /usr/share/app/b.txt
+3 = Create, /data/marker
+4 = Copy, resources/f0003.dat, /usr/share/app/a.txt
+5 = RemoveFolderContent, /usr/share/app
+6 = Copy, resources/f0002.dat, /usr/share/app/b.txt
+`,
+	})
+	tree := ParseIniTree(main)
+
+	sequential := &Config{ToBase: filepath.Join(base, "sequential")}
+	if err := ExtractTree(tree, sequential); err != nil {
+		t.Fatal(err)
+	}
+
+	parallel := &Config{ToBase: filepath.Join(base, "parallel"), Workers: 4}
+	if err := ExtractTree(tree, parallel); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readTree(t, parallel.ToBase)
+	want := readTree(t, sequential.ToBase)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parallel extraction differs\ngot: %#v\nwant: %#v", got, want)
+	}
+
+	if _, created := got["data/marker"]; !created || got["usr/share/app/b.txt"] != "b\n" {
+		t.Errorf("later Copy or Create did not run: %#v", got)
+	}
+	for _, removed := range []string{"tmp/setup.sh", "usr/share/app/a.txt"} {
+		if _, exists := got[removed]; exists {
+			t.Errorf("%s survived its Remove", removed)
+		}
+	}
+}
+
+func TestGroupJobs(t *testing.T) {
+	jobs := []stepJob{
+		{to: "/out/a"},
+		{to: "/out/b"},
+		{to: "/out/a"},
+		{to: "/out/b/c"},
+		{to: "/out/d"},
+	}
+
+	got := groupJobs(jobs)
+	want := [][]stepJob{
+		{{to: "/out/a"}, {to: "/out/a"}},
+		{{to: "/out/b"}, {to: "/out/b/c"}},
+		{{to: "/out/d"}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestApplyJobRecovers(t *testing.T) {
+	// An extraction without config makes every step panic
+	job := stepJob{ini: &Ini{}, instruction: Instruction{InstructionStep: Remove, Arguments: []string{"x"}}}
+
+	if err := applyJob(job, &extraction{}); err == nil || !strings.HasPrefix(err.Error(), "panic: ") {
+		t.Errorf("expected the panic as error, got %v", err)
+	}
+}
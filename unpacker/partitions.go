@@ -0,0 +1,350 @@
+package unpacker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Partition is a region of a flash or eMMC device
+type Partition struct {
+	Name   string `json:"name"`
+	Device string `json:"device"`
+	// Node is the device node Linux creates for it, if known
+	Node   string `json:"node,omitempty"`
+	Offset uint64 `json:"offset"`
+	// Size is 0 for a partition taking the rest of the device
+	Size     uint64 `json:"size"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	Source   string `json:"source"`
+}
+
+// PartitionMapping maps the partition name of an ImageUpdate step to the
+// partitions known by that name
+type PartitionMapping struct {
+	Step       StepRef     `json:"step"`
+	Partition  string      `json:"partition"`
+	Payload    string      `json:"payload"`
+	Partitions []Partition `json:"partitions"`
+}
+
+func ParseMTDParts(spec string) ([]Partition, error) {
+	// ParseMTDParts parses the mtdparts and blkdevparts syntax of U-Boot and
+	// the kernel command line, like
+	// mtdparts=gpmi-nand:4m(boot),16m(kernel),-(rootfs)ro. Partitions without
+	// offset follow the previous one. mtdparts partitions are numbered across
+	// all devices, blkdevparts ones per device.
+
+	blockDevices := strings.HasPrefix(spec, "blkdevparts=")
+	spec = strings.TrimPrefix(strings.TrimPrefix(spec, "mtdparts="), "blkdevparts=")
+
+	partitions := make([]Partition, 0)
+	mtd := 0
+
+	for _, definition := range strings.Split(spec, ";") {
+		if definition == "" {
+			continue
+		}
+
+		device, parts, found := strings.Cut(definition, ":")
+		if !found {
+			return nil, fmt.Errorf("partition definition %q has no device", definition)
+		}
+
+		var next uint64
+		for i, part := range strings.Split(parts, ",") {
+			partition := Partition{Device: device, Source: "mtdparts"}
+			if blockDevices {
+				partition.Source = "blkdevparts"
+				partition.Node = fmt.Sprintf("/dev/%sp%d", device, i+1)
+			} else {
+				partition.Node = fmt.Sprintf("/dev/mtd%d", mtd)
+				mtd++
+			}
+
+			var err error
+			rest := part
+			if strings.HasPrefix(rest, "-") {
+				rest = rest[1:]
+			} else {
+				partition.Size, rest, err = parseSize(rest)
+				if err != nil {
+					return nil, fmt.Errorf("partition %q: %w", part, err)
+				}
+			}
+
+			partition.Offset = next
+			if strings.HasPrefix(rest, "@") {
+				partition.Offset, rest, err = parseSize(rest[1:])
+				if err != nil {
+					return nil, fmt.Errorf("partition %q: %w", part, err)
+				}
+			}
+
+			if strings.HasPrefix(rest, "(") {
+				end := strings.IndexByte(rest, ')')
+				if end < 0 {
+					return nil, fmt.Errorf("partition %q has an unterminated name", part)
+				}
+				partition.Name, rest = rest[1:end], rest[end+1:]
+			}
+
+			partition.ReadOnly = strings.Contains(rest, "ro")
+			next = partition.Offset + partition.Size
+			partitions = append(partitions, partition)
+		}
+	}
+
+	return partitions, nil
+}
+
+// errSizeOverflow is returned for sizes that don't fit into 64 bits
+var errSizeOverflow = errors.New("size overflows")
+
+func parseSize(s string) (uint64, string, error) {
+	// Parses a number with an optional k, m or g suffix, returning the rest
+
+	end := 0
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		end = 2
+		for end < len(s) && strings.ContainsRune("0123456789abcdefABCDEF", rune(s[end])) {
+			end++
+		}
+	} else {
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			end++
+		}
+	}
+
+	value, err := strconv.ParseUint(s[:end], 0, 64)
+	if err != nil {
+		return 0, s, fmt.Errorf("invalid size %q", s)
+	}
+
+	if end < len(s) {
+		shift := uint(0)
+		switch s[end] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift > 0 {
+			if value > math.MaxUint64>>shift {
+				return 0, s, fmt.Errorf("size %q: %w", s, errSizeOverflow)
+			}
+			value <<= shift
+			end++
+		}
+	}
+
+	return value, s[end:], nil
+}
+
+func DevicetreePartitions(root *FDTNode) []Partition {
+	// DevicetreePartitions returns the fixed partitions of all flash nodes in
+	// a device tree, both inside a partitions node and as direct children of
+	// the flash node
+
+	partitions := make([]Partition, 0)
+
+	var walk func(node *FDTNode, nodePath string, parent *FDTNode, parentPath string)
+	walk = func(node *FDTNode, nodePath string, parent *FDTNode, parentPath string) {
+		if parent != nil && strings.HasPrefix(node.Name, "partition") && node.Property("reg") != nil && node.Name != "partitions" {
+			device := parentPath
+			if parent.Name == "partitions" {
+				device = path.Dir(parentPath)
+			}
+
+			addressCells, sizeCells := cellCount(parent, "#address-cells"), cellCount(parent, "#size-cells")
+			reg := node.Property("reg")
+
+			if len(reg) >= 4*(addressCells+sizeCells) {
+				name := node.String("label")
+				if name == "" {
+					name = strings.SplitN(node.Name, "@", 2)[0]
+				}
+
+				partitions = append(partitions, Partition{
+					Name:     name,
+					Device:   device,
+					Offset:   readCells(reg, addressCells),
+					Size:     readCells(reg[4*addressCells:], sizeCells),
+					ReadOnly: node.Property("read-only") != nil,
+					Source:   "device tree",
+				})
+			}
+		}
+
+		for _, child := range node.Children {
+			walk(child, path.Join(nodePath, child.Name), node, nodePath)
+		}
+	}
+	walk(root, "/", nil, "")
+
+	return partitions
+}
+
+func cellCount(node *FDTNode, name string) int {
+	if value, ok := node.Uint(name); ok && len(node.Property(name)) == 4 {
+		return int(value)
+	}
+
+	return 1
+}
+
+func readCells(value []byte, count int) uint64 {
+	var result uint64
+	for i := 0; i < count; i++ {
+		result = result<<32 | uint64(value[4*i])<<24 | uint64(value[4*i+1])<<16 | uint64(value[4*i+2])<<8 | uint64(value[4*i+3])
+	}
+
+	return result
+}
+
+func FindPartitions(data []byte, source string) []Partition {
+	// FindPartitions collects the partitions defined in an image: mtdparts
+	// and blkdevparts in U-Boot environments, the bootargs of device trees and
+	// the partition nodes of device trees. source is added to the Source of
+	// each partition.
+
+	partitions := make([]Partition, 0)
+
+	fromCommandLine := func(line string, origin string) {
+		for _, word := range strings.Fields(line) {
+			if strings.HasPrefix(word, "mtdparts=") || strings.HasPrefix(word, "blkdevparts=") {
+				parsed, err := ParseMTDParts(word)
+				if err != nil {
+					continue
+				}
+				for _, partition := range parsed {
+					partition.Source += " in " + origin
+					partitions = append(partitions, partition)
+				}
+			}
+		}
+	}
+
+	for _, env := range FindUBootEnvs(data) {
+		origin := fmt.Sprintf("U-Boot environment at 0x%x of %s", env.Offset, source)
+		for _, name := range sortedKeys(env.Variables) {
+			value := env.Variables[name]
+			if name == "mtdparts" || name == "blkdevparts" {
+				value = name + "=" + value
+			}
+			fromCommandLine(value, origin)
+		}
+	}
+
+	for _, fdt := range FindFDTs(data) {
+		origin := fmt.Sprintf("device tree at 0x%x of %s", fdt.Offset, source)
+		if chosen := fdt.Root.Child("chosen"); chosen != nil {
+			fromCommandLine(chosen.String("bootargs"), origin)
+		}
+		for _, partition := range DevicetreePartitions(fdt.Root) {
+			partition.Source = origin
+			partitions = append(partitions, partition)
+		}
+	}
+
+	return partitions
+}
+
+func MapPartitions(tree []*Ini) ([]Partition, []PartitionMapping) {
+	// MapPartitions searches all binary.ini payloads for partition
+	// definitions and maps the partition of every ImageUpdate step to them by
+	// name
+
+	partitions := make([]Partition, 0)
+	seen := make(map[string]bool)
+	entries := make([]PartitionMapping, 0)
+
+	for _, ini := range tree[1:] {
+		if ini == nil || !strings.HasPrefix(ini.Filename, "binary.ini") {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			if instruction.InstructionStep != ImageUpdate || len(instruction.Arguments) < 2 {
+				continue
+			}
+
+			entries = append(entries, PartitionMapping{
+				Step:      newStepRef(ini, instruction),
+				Partition: instruction.Arguments[0],
+				Payload:   filepath.Join(ini.Folder, instruction.Arguments[1]),
+			})
+
+			data, err := readPayload(sourcePath(ini, instruction.Arguments[1]))
+			if err != nil {
+				continue
+			}
+
+			for _, partition := range FindPartitions(data, entries[len(entries)-1].Payload) {
+				key := fmt.Sprintf("%s %s %d %d", partition.Device, partition.Name, partition.Offset, partition.Size)
+				if !seen[key] {
+					seen[key] = true
+					partitions = append(partitions, partition)
+				}
+			}
+		}
+	}
+
+	mappings := make([]PartitionMapping, 0, len(entries))
+	for _, entry := range entries {
+		mapping := entry
+		mapping.Partitions = make([]Partition, 0)
+		for _, partition := range partitions {
+			if strings.EqualFold(partition.Name, entry.Partition) {
+				mapping.Partitions = append(mapping.Partitions, partition)
+			}
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	return partitions, mappings
+}
+
+func WritePartitions(partitions []Partition, mappings []PartitionMapping, w io.Writer) error {
+	// WritePartitions writes the partition table and the mapping of every
+	// ImageUpdate step
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(table, "NAME\tDEVICE\tNODE\tOFFSET\tSIZE\tRO\tSOURCE")
+	for _, p := range partitions {
+		fmt.Fprintf(table, "%s\t%s\t%s\t0x%08x\t%s\t%t\t%s\n", p.Name, p.Device, dash(p.Node), p.Offset, partitionSize(p), p.ReadOnly, p.Source)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	for _, mapping := range mappings {
+		fmt.Fprintf(w, "%s -> %s (%s)\n", mapping.Payload, mapping.Partition, mapping.Step)
+		if len(mapping.Partitions) == 0 {
+			fmt.Fprintln(w, "  no partition of that name found")
+		}
+		for _, p := range mapping.Partitions {
+			fmt.Fprintf(w, "  %s %s offset 0x%08x size %s\n", p.Device, p.Node, p.Offset, partitionSize(p))
+		}
+	}
+
+	return nil
+}
+
+func partitionSize(p Partition) string {
+	if p.Size == 0 {
+		return "rest"
+	}
+
+	return fmt.Sprintf("0x%08x", p.Size)
+}
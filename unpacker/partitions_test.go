@@ -0,0 +1,78 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMTDParts(t *testing.T) {
+	partitions, err := ParseMTDParts("mtdparts=gpmi-nand:4m(boot)ro,0x1000000@0x800000(kernel),-(rootfs);spi0.0:512k(env)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Partition{
+		{Name: "boot", Device: "gpmi-nand", Node: "/dev/mtd0", Offset: 0, Size: 4 << 20, ReadOnly: true, Source: "mtdparts"},
+		{Name: "kernel", Device: "gpmi-nand", Node: "/dev/mtd1", Offset: 0x800000, Size: 0x1000000, Source: "mtdparts"},
+		{Name: "rootfs", Device: "gpmi-nand", Node: "/dev/mtd2", Offset: 0x1800000, Size: 0, Source: "mtdparts"},
+		{Name: "env", Device: "spi0.0", Node: "/dev/mtd3", Offset: 0, Size: 512 << 10, Source: "mtdparts"},
+	}
+	if len(partitions) != len(want) {
+		t.Fatalf("expected %d partitions, got %+v", len(want), partitions)
+	}
+	for i := range want {
+		if partitions[i] != want[i] {
+			t.Errorf("partition %d: expected %+v, got %+v", i, want[i], partitions[i])
+		}
+	}
+
+	partitions, err = ParseMTDParts("blkdevparts=mmcblk0:1M(boot),-(data)")
+	if err != nil || len(partitions) != 2 || partitions[1].Node != "/dev/mmcblk0p2" || partitions[1].Offset != 1<<20 {
+		t.Errorf("unexpected blkdevparts: %+v, %v", partitions, err)
+	}
+
+	if _, err := ParseMTDParts("mtdparts=4m(boot)"); err == nil {
+		t.Error("expected an error for a definition without device")
+	}
+}
+
+func TestMapPartitions(t *testing.T) {
+	dtb := buildFDT(&FDTNode{
+		Children: []*FDTNode{
+			{Name: "chosen", Properties: []FDTProperty{{"bootargs", []byte("console=ttymxc0 mtdparts=gpmi-nand:8m(uboot),-(ubi)\x00")}}},
+			{Name: "nand@1806000", Children: []*FDTNode{{
+				Name:       "partitions",
+				Properties: []FDTProperty{{"#address-cells", cells(1)}, {"#size-cells", cells(1)}},
+				Children: []*FDTNode{
+					{Name: "partition@0", Properties: []FDTProperty{{"label", []byte("uboot\x00")}, {"reg", cells(0, 0x800000)}, {"read-only", nil}}},
+					{Name: "partition@800000", Properties: []FDTProperty{{"label", []byte("kernel\x00")}, {"reg", cells(0x800000, 0x1000000)}}},
+				},
+			}}},
+		},
+	})
+
+	main := writeSyntheticPackage(t)
+	image := make([]byte, 0x1000)
+	copy(image[0x100:], dtb)
+	image = append(image, ubootEnv(0x1000, false, "mtdparts=spi0.0:512k(env)")...)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(main), "linux1/linux1.img"), image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	partitions, mappings := MapPartitions(ParseIniTree(main))
+
+	if len(partitions) != 5 {
+		t.Fatalf("expected five partitions, got %+v", partitions)
+	}
+
+	if len(mappings) != 1 || mappings[0].Partition != "kernel" || len(mappings[0].Partitions) != 1 {
+		t.Fatalf("unexpected mappings: %+v", mappings)
+	}
+
+	kernel := mappings[0].Partitions[0]
+	if kernel.Device != "/nand@1806000" || kernel.Offset != 0x800000 || kernel.Size != 0x1000000 ||
+		kernel.Source != "device tree at 0x100 of linux1/linux1.img" {
+		t.Errorf("unexpected kernel partition: %+v", kernel)
+	}
+}
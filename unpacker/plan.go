@@ -0,0 +1,78 @@
+package unpacker
+
+import (
+	"path/filepath"
+)
+
+// PlanStep is a single step of the main ini as the device executes it
+type PlanStep struct {
+	StepNo      int
+	Instruction Instruction
+	// Regions are the BreakPoint regions the step is in, outermost first
+	Regions []string
+	// Ini is the sub ini run by this step, nil for BreakPoints and sub inis
+	// that couldn't be parsed
+	Ini *Ini
+}
+
+func ExecutionPlan(tree []*Ini) []PlanStep {
+	// ExecutionPlan returns the steps of the main ini in order. Instructions_Ext
+	// is preferred since it contains the BreakPoint markers, the plain
+	// Instructions are used for packages without it.
+
+	main := tree[0]
+
+	instructions := main.Instructions_Ext.Instructions
+	if len(instructions) == 0 {
+		instructions = main.Instructions.Instructions
+	}
+
+	subInis := make(map[string]*Ini)
+	for _, ini := range tree[1:] {
+		if ini != nil {
+			subInis[filepath.Join(ini.Folder, ini.Filename)] = ini
+		}
+	}
+
+	plan := make([]PlanStep, 0, len(instructions))
+	regions := make([]string, 0)
+
+	for _, instruction := range instructions {
+		step := PlanStep{StepNo: instruction.StepNo, Instruction: instruction}
+
+		if instruction.InstructionStep == BreakPoint && len(instruction.Arguments) > 1 {
+			name, marker := instruction.Arguments[0], instruction.Arguments[1]
+
+			if marker == "End" {
+				regions = removeRegion(regions, name)
+			}
+			step.Regions = append([]string{}, regions...)
+			if marker == "Start" {
+				regions = append(regions, name)
+				step.Regions = append(step.Regions, name)
+			}
+		} else {
+			step.Regions = append([]string{}, regions...)
+			if len(instruction.Arguments) > 1 {
+				step.Ini = subInis[filepath.Join(instruction.Arguments[0], instruction.Arguments[1])]
+			}
+		}
+
+		plan = append(plan, step)
+	}
+
+	return plan
+}
+
+func removeRegion(regions []string, name string) []string {
+	// Closes the innermost region with that name, regions that aren't
+	// properly nested are closed anyway
+
+	for i := len(regions) - 1; i >= 0; i-- {
+		if regions[i] == name {
+			return append(regions[:i:i], regions[i+1:]...)
+		}
+	}
+
+	return regions
+}
@@ -0,0 +1,138 @@
+package unpacker
+
+import (
+	"sync"
+)
+
+// Progress is a snapshot of how far an extraction or simulation has come. It
+// mirrors what the device shows on its progress bar: every main ini step has a
+// weight (its Steps column) and all weights add up to TotalStepsCount.
+type Progress struct {
+	Folder   string
+	Filename string
+	StepNo   int
+	Weight   int
+	SubStep  int
+	SubCount int
+	Done     float64
+	Total    int64
+	Percent  float64
+}
+
+// ProgressFunc receives progress updates. It is called synchronously, so it
+// should return quickly.
+type ProgressFunc func(Progress)
+
+// ProgressChannel wraps a channel into a ProgressFunc. Updates are dropped
+// instead of blocking when the channel is full, the next update will carry the
+// current state anyway.
+func ProgressChannel(ch chan<- Progress) ProgressFunc {
+	return func(p Progress) {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// progressTracker sums up the weighted steps of a tree and reports them to a
+// ProgressFunc. A nil tracker or one without a callback does nothing.
+type progressTracker struct {
+	fn        ProgressFunc
+	total     int64
+	processed map[int]int
+	done      float64
+	mutex     sync.Mutex
+}
+
+func newProgressTracker(tree []*Ini, fn ProgressFunc) *progressTracker {
+	// Uses TotalStepsCount of the main ini, falls back to the sum of all
+	// weights if the package doesn't declare it. Main steps without a sub ini
+	// in the tree never advance, their weight is left out so a finished
+	// extraction still reaches 100%.
+
+	tracker := &progressTracker{fn: fn, processed: make(map[int]int)}
+
+	if fn == nil || len(tree) == 0 || tree[0] == nil {
+		return tracker
+	}
+
+	main := tree[0]
+	tracker.total = main.Settings.TotalStepsCount
+
+	if tracker.total <= 0 {
+		for _, instruction := range main.Instructions.Instructions {
+			tracker.total += int64(instruction.Steps)
+		}
+	}
+
+	for _, instruction := range main.Instructions.Instructions {
+		if instruction.StepNo <= 0 || instruction.StepNo >= len(tree) || tree[instruction.StepNo] == nil {
+			tracker.total -= int64(instruction.Steps)
+		}
+	}
+
+	return tracker
+}
+
+// advance reports that n more instructions of ini have been processed. Safe
+// to call from several goroutines.
+func (tracker *progressTracker) advance(ini *Ini, n int) {
+	if tracker == nil || tracker.fn == nil || ini == nil {
+		return
+	}
+
+	subCount := len(ini.Instructions.Instructions)
+	weight := float64(ini.Step.Steps)
+
+	tracker.mutex.Lock()
+	before := tracker.processed[ini.Step.StepNo]
+	after := before + n
+	if after > subCount {
+		after = subCount
+	}
+	tracker.processed[ini.Step.StepNo] = after
+
+	if subCount == 0 {
+		tracker.done += weight
+	} else {
+		tracker.done += weight * float64(after-before) / float64(subCount)
+	}
+
+	progress := Progress{
+		Folder:   ini.Folder,
+		Filename: ini.Filename,
+		StepNo:   ini.Step.StepNo,
+		Weight:   ini.Step.Steps,
+		SubStep:  after,
+		SubCount: subCount,
+		Done:     tracker.done,
+		Total:    tracker.total,
+	}
+	tracker.mutex.Unlock()
+
+	if progress.Total > 0 {
+		progress.Percent = 100 * progress.Done / float64(progress.Total)
+		if progress.Percent > 100 {
+			progress.Percent = 100
+		}
+	}
+
+	tracker.fn(progress)
+}
+
+// finish reports all remaining instructions of ini as processed
+func (tracker *progressTracker) finish(ini *Ini) {
+	if tracker == nil || ini == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	remaining := len(ini.Instructions.Instructions) - tracker.processed[ini.Step.StepNo]
+	finished := remaining == 0 && tracker.processed[ini.Step.StepNo] > 0
+	tracker.mutex.Unlock()
+
+	if !finished {
+		tracker.advance(ini, remaining)
+	}
+}
@@ -0,0 +1,55 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTreeProgress(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+
+	updates := make([]Progress, 0)
+	config := &Config{
+		ToBase:   filepath.Join(t.TempDir(), "out"),
+		Progress: func(p Progress) { updates = append(updates, p) },
+	}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) == 0 {
+		t.Fatal("no progress reported")
+	}
+
+	for i := 1; i < len(updates); i++ {
+		if updates[i].Done < updates[i-1].Done {
+			t.Errorf("progress moved backwards: %+v after %+v", updates[i], updates[i-1])
+		}
+	}
+
+	last := updates[len(updates)-1]
+	if last.Total != 10 || last.Percent != 100 {
+		t.Errorf("unexpected final progress: %+v", last)
+	}
+}
+
+func TestExtractTreeProgressMissingIni(t *testing.T) {
+	main := writeSyntheticPackage(t)
+	os.Remove(filepath.Join(filepath.Dir(main), "linux1/binary.ini"))
+	tree := ParseIniTree(main)
+
+	var last Progress
+	config := &Config{
+		ToBase:   filepath.Join(t.TempDir(), "out"),
+		Progress: func(p Progress) { last = p },
+	}
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree[2] != nil || last.Total != 8 || last.Percent != 100 {
+		t.Errorf("unexpected final progress without binary.ini: %+v", last)
+	}
+}
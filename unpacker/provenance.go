@@ -0,0 +1,139 @@
+package unpacker
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StepRef points to a single instruction of a sub ini
+type StepRef struct {
+	Folder          string          `json:"folder"`
+	Filename        string          `json:"filename"`
+	MainStepNo      int             `json:"main_step"`
+	StepNo          int             `json:"step"`
+	InstructionStep InstructionStep `json:"-"`
+	Instruction     string          `json:"instruction"`
+	Arguments       []string        `json:"arguments"`
+}
+
+func newStepRef(ini *Ini, instruction Instruction) StepRef {
+	return StepRef{
+		Folder:          ini.Folder,
+		Filename:        ini.Filename,
+		MainStepNo:      ini.Step.StepNo,
+		StepNo:          instruction.StepNo,
+		InstructionStep: instruction.InstructionStep,
+		Instruction:     instruction.InstructionStep.String(),
+		Arguments:       instruction.Arguments,
+	}
+}
+
+// String formats the reference like folder/execute.ini:3 Copy a, b
+func (ref StepRef) String() string {
+	return fmt.Sprintf("%s:%d %s %s", filepath.Join(ref.Folder, ref.Filename), ref.StepNo,
+		ref.Instruction, strings.Join(ref.Arguments, ", "))
+}
+
+// Provenance knows which steps of a package touch which path of the target
+// filesystem
+type Provenance struct {
+	paths   map[string][]StepRef
+	folders map[string][]StepRef
+}
+
+func BuildProvenance(tree []*Ini) *Provenance {
+	// BuildProvenance indexes the paths of every Copy, Create, Remove and
+	// RemoveFolderContent step, as well as absolute paths mentioned in
+	// Execute steps.
+
+	provenance := &Provenance{
+		paths:   make(map[string][]StepRef),
+		folders: make(map[string][]StepRef),
+	}
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+
+			switch instruction.InstructionStep {
+			case Copy:
+				if len(instruction.Arguments) > 1 {
+					provenance.add(devicePath(instruction.Arguments[1]), ref)
+				}
+			case Create, Remove:
+				if len(instruction.Arguments) > 0 {
+					provenance.add(devicePath(instruction.Arguments[0]), ref)
+				}
+			case RemoveFolderContent:
+				if len(instruction.Arguments) > 0 {
+					folder := devicePath(instruction.Arguments[0])
+					provenance.folders[folder] = append(provenance.folders[folder], ref)
+				}
+			case Execute:
+				for _, command := range shellCommands(strings.Join(instruction.Arguments, " ")) {
+					for _, word := range command {
+						if strings.HasPrefix(word, "/") && !strings.Contains(word, "$") {
+							provenance.add(filepath.Clean(word), ref)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return provenance
+}
+
+func (provenance *Provenance) add(path string, ref StepRef) {
+	refs := provenance.paths[path]
+
+	// Execute steps can mention the same path several times
+	if len(refs) > 0 && refs[len(refs)-1].MainStepNo == ref.MainStepNo && refs[len(refs)-1].StepNo == ref.StepNo {
+		return
+	}
+
+	provenance.paths[path] = append(refs, ref)
+}
+
+func (provenance *Provenance) For(path string) []StepRef {
+	// For returns the steps touching path in package order, including
+	// RemoveFolderContent of any of its parent folders
+
+	path = filepath.Clean("/" + path)
+	refs := append([]StepRef{}, provenance.paths[path]...)
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		refs = append(refs, provenance.folders[dir]...)
+		if dir == "/" {
+			break
+		}
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		if refs[i].MainStepNo != refs[j].MainStepNo {
+			return refs[i].MainStepNo < refs[j].MainStepNo
+		}
+		return refs[i].StepNo < refs[j].StepNo
+	})
+
+	return refs
+}
+
+func (provenance *Provenance) Paths() []string {
+	// Paths returns every path that is touched by a step, sorted
+
+	paths := make([]string, 0, len(provenance.paths))
+	for path := range provenance.paths {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
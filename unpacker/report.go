@@ -0,0 +1,332 @@
+package unpacker
+
+import (
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Report is an inventory of a package, rendered by WriteMarkdown and
+// WriteHTML
+type Report struct {
+	Package     string
+	Settings    Settings
+	DataStorage DataStorage
+	Plan        []ReportStep
+	SubInis     []ReportIni
+	// Images are the payloads of the binary.ini files
+	Images  []ImageEntry
+	Outputs []ReportOutput
+	// Extracted is false if the outputs are only known from the
+	// instructions, their size and hash are those of the payloads
+	Extracted bool
+	Findings  []Finding
+}
+
+// ReportStep is a step of the execution plan
+type ReportStep struct {
+	StepNo      int
+	Instruction string
+	Arguments   string
+	Steps       int
+	Regions     string
+}
+
+// ReportIni lists the instructions of a sub ini
+type ReportIni struct {
+	Name         string
+	Instructions []ReportInstruction
+}
+
+// ReportInstruction is a single instruction of a sub ini
+type ReportInstruction struct {
+	StepNo      int
+	Instruction string
+	Arguments   string
+}
+
+// ReportOutput is a path on the target filesystem. SHA256 is empty for paths
+// that aren't left as files, like removed ones.
+type ReportOutput struct {
+	Path   string
+	Size   int64
+	SHA256 string
+	Steps  []string
+}
+
+func NewReport(tree []*Ini, extracted string) (*Report, error) {
+	// NewReport collects everything for the report. extracted is the output
+	// of an extraction, if it's empty the outputs are taken from the
+	// instructions instead and hashed from the payloads last copied to them.
+
+	main := tree[0]
+
+	report := &Report{
+		Package:     PackageName(tree),
+		Settings:    main.Settings,
+		DataStorage: main.DataStorage,
+		Findings:    Validate(tree),
+		Images:      IdentifyImages(tree),
+		Extracted:   extracted != "",
+	}
+
+	for _, field := range []*string{&report.DataStorage.UPType, &report.DataStorage.SubUPType,
+		&report.DataStorage.ReTransmit, &report.DataStorage.NewPackage} {
+		*field = strings.Trim(*field, "\"")
+	}
+
+	for _, step := range ExecutionPlan(tree) {
+		report.Plan = append(report.Plan, ReportStep{
+			StepNo:      step.StepNo,
+			Instruction: step.Instruction.InstructionStep.String(),
+			Arguments:   strings.Join(step.Instruction.Arguments, ", "),
+			Steps:       step.Instruction.Steps,
+			Regions:     strings.Join(step.Regions, " > "),
+		})
+	}
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		subIni := ReportIni{Name: filepath.Join(ini.Folder, ini.Filename)}
+		for _, instruction := range ini.Instructions.Instructions {
+			subIni.Instructions = append(subIni.Instructions, ReportInstruction{
+				StepNo:      instruction.StepNo,
+				Instruction: instruction.InstructionStep.String(),
+				Arguments:   strings.Join(instruction.Arguments, ", "),
+			})
+		}
+		report.SubInis = append(report.SubInis, subIni)
+	}
+
+	provenance := BuildProvenance(tree)
+	steps := func(path string) []string {
+		refs := make([]string, 0)
+		for _, ref := range provenance.For(path) {
+			refs = append(refs, ref.String())
+		}
+		return refs
+	}
+
+	if extracted == "" {
+		files := packageFiles(tree)
+		for _, path := range provenance.Paths() {
+			output := ReportOutput{Path: path, Steps: steps(path)}
+			if file := files[path]; file != nil {
+				if entry, err := hashVirtualFile(main.RootDir, file); err == nil {
+					output.Size, output.SHA256 = entry.size, entry.hash
+				}
+			}
+			report.Outputs = append(report.Outputs, output)
+		}
+		return report, nil
+	}
+
+	entries, err := readFolderEntries(FilesystemRoot(extracted))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range sortedKeys(entries) {
+		report.Outputs = append(report.Outputs, ReportOutput{
+			Path:   path,
+			Size:   entries[path].size,
+			SHA256: entries[path].hash,
+			Steps:  steps(path),
+		})
+	}
+
+	return report, nil
+}
+
+func hashVirtualFile(root string, file *VirtualFile) (fsEntry, error) {
+	// Created files are empty, copied ones have the content of their payload
+
+	if file.Source == "" {
+		return hashEntry(strings.NewReader(""))
+	}
+
+	payload, err := openPayload(filepath.Join(root, file.Source))
+	if err != nil {
+		return fsEntry{}, err
+	}
+	defer payload.Close()
+
+	return hashEntry(payload)
+}
+
+func (report *Report) WriteMarkdown(w io.Writer) error {
+	return markdownReport.Execute(w, report)
+}
+
+func (report *Report) WriteHTML(w io.Writer) error {
+	return htmlReport.Execute(w, report)
+}
+
+func (report *Report) WriteFiles(markdown string, html string) error {
+	// WriteFiles writes the report to the given files, empty names are
+	// skipped
+
+	outputs := []struct {
+		filename string
+		write    func(io.Writer) error
+	}{
+		{markdown, report.WriteMarkdown},
+		{html, report.WriteHTML},
+	}
+
+	for _, output := range outputs {
+		if output.filename == "" {
+			continue
+		}
+
+		file, err := os.Create(output.filename)
+		if err != nil {
+			return err
+		}
+
+		err = output.write(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markdownCell escapes the characters that would break a table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
+
+var markdownReport = template.Must(template.New("markdown").Funcs(template.FuncMap{
+	"cell": markdownCell,
+	"join": strings.Join,
+}).Parse(`# Package {{.Package}}
+
+## Settings
+
+| Setting | Value |
+|---|---|
+| PackageID | {{.Settings.Packageid}} |
+| CompressionType | {{if eq .Settings.CompressionType 1}}GZIP{{else}}undefined{{end}} |
+| TotalStepsCount | {{.Settings.TotalStepsCount}} |
+| UPType | {{cell .DataStorage.UPType}} |
+| SubUPType | {{cell .DataStorage.SubUPType}} |
+| ReTransmit | {{cell .DataStorage.ReTransmit}} |
+| NewPackage | {{cell .DataStorage.NewPackage}} |
+
+## Findings
+{{if not .Findings}}
+None.
+{{else}}
+| Severity | Finding | Step |
+|---|---|---|
+{{range .Findings}}| {{.Severity}} | {{cell .Message}} | {{if .Step}}{{cell .Step.String}}{{end}} |
+{{end}}{{end}}
+## Plan
+
+| Step | Instruction | Arguments | Steps | BreakPoint region |
+|---|---|---|---|---|
+{{range .Plan}}| {{.StepNo}} | {{.Instruction}} | {{cell .Arguments}} | {{.Steps}} | {{cell .Regions}} |
+{{end}}
+## Sub inis
+{{range .SubInis}}
+### {{.Name}}
+
+| Step | Instruction | Arguments |
+|---|---|---|
+{{range .Instructions}}| {{.StepNo}} | {{.Instruction}} | {{cell .Arguments}} |
+{{end}}{{end}}{{if .Images}}
+## Images
+
+| Payload | Partition | Format | Name | Version | Checksum |
+|---|---|---|---|---|---|
+{{range .Images}}| {{cell .Payload}} | {{cell .Partition}} | {{if .Image}}{{.Image.Format}} | {{cell .Image.Name}} | {{cell .Image.Version}} | {{.Image.Checksum}}{{else}}{{cell .Error}} | | |{{end}} |
+{{end}}{{end}}
+## Outputs
+{{if not .Extracted}}
+Not extracted, sizes and hashes are those of the payloads.
+{{end}}
+| Path | Size | SHA256 | Steps |
+|---|---|---|---|
+{{range .Outputs}}| {{cell .Path}} | {{if .SHA256}}{{.Size}}{{end}} | {{.SHA256}} | {{cell (join .Steps "<br>")}} |
+{{end}}`))
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Package {{.Package}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+th { background: #eee; }
+td.mono, .mono { font-family: monospace; }
+tr.error td { background: #fdd; }
+tr.warning td { background: #ffd; }
+tr.breakpoint td { background: #eef; }
+details { margin-bottom: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Package {{.Package}}</h1>
+
+<h2>Settings</h2>
+<table>
+<tr><th>PackageID</th><td>{{.Settings.Packageid}}</td></tr>
+<tr><th>CompressionType</th><td>{{if eq .Settings.CompressionType 1}}GZIP{{else}}undefined{{end}}</td></tr>
+<tr><th>TotalStepsCount</th><td>{{.Settings.TotalStepsCount}}</td></tr>
+<tr><th>UPType</th><td>{{.DataStorage.UPType}}</td></tr>
+<tr><th>SubUPType</th><td>{{.DataStorage.SubUPType}}</td></tr>
+<tr><th>ReTransmit</th><td>{{.DataStorage.ReTransmit}}</td></tr>
+<tr><th>NewPackage</th><td>{{.DataStorage.NewPackage}}</td></tr>
+</table>
+
+<h2>Findings</h2>
+{{if not .Findings}}<p>None.</p>{{else}}
+<table>
+<tr><th>Severity</th><th>Finding</th><th>Step</th></tr>
+{{range .Findings}}<tr class="{{.Severity}}"><td>{{.Severity}}</td><td>{{.Message}}</td><td class="mono">{{if .Step}}{{.Step.String}}{{end}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Plan</h2>
+<table>
+<tr><th>Step</th><th>Instruction</th><th>Arguments</th><th>Steps</th><th>BreakPoint region</th></tr>
+{{range .Plan}}<tr{{if eq .Instruction "BreakPoint"}} class="breakpoint"{{end}}><td>{{.StepNo}}</td><td>{{.Instruction}}</td><td class="mono">{{.Arguments}}</td><td>{{.Steps}}</td><td>{{.Regions}}</td></tr>
+{{end}}</table>
+
+<h2>Sub inis</h2>
+{{range .SubInis}}<details>
+<summary class="mono">{{.Name}} ({{len .Instructions}} instructions)</summary>
+<table>
+<tr><th>Step</th><th>Instruction</th><th>Arguments</th></tr>
+{{range .Instructions}}<tr><td>{{.StepNo}}</td><td>{{.Instruction}}</td><td class="mono">{{.Arguments}}</td></tr>
+{{end}}</table>
+</details>
+{{end}}
+{{if .Images}}
+<h2>Images</h2>
+<table>
+<tr><th>Payload</th><th>Partition</th><th>Format</th><th>Name</th><th>Version</th><th>Checksum</th></tr>
+{{range .Images}}<tr><td class="mono">{{.Payload}}</td><td class="mono">{{.Partition}}</td>{{if .Image}}<td>{{.Image.Format}}</td><td>{{.Image.Name}}</td><td>{{.Image.Version}}</td><td>{{.Image.Checksum}}</td>{{else}}<td colspan="4">{{.Error}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+<h2>Outputs</h2>
+{{if not .Extracted}}<p>Not extracted, sizes and hashes are those of the payloads.</p>
+{{end}}<table>
+<tr><th>Path</th><th>Size</th><th>SHA256</th><th>Steps</th></tr>
+{{range .Outputs}}<tr><td class="mono">{{.Path}}</td><td>{{if .SHA256}}{{.Size}}{{end}}</td><td class="mono">{{.SHA256}}</td><td class="mono">{{range .Steps}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,110 @@
+package unpacker
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecutionPlan(t *testing.T) {
+	plan := ExecutionPlan(ParseIniTree(writeSyntheticPackage(t)))
+
+	regions := make([][]string, 0)
+	subInis := make([]string, 0)
+	for _, step := range plan {
+		regions = append(regions, step.Regions)
+		if step.Ini != nil {
+			subInis = append(subInis, step.Ini.Folder)
+		}
+	}
+
+	wantRegions := [][]string{{}, {"reinstall"}, {"reinstall"}, {"reinstall"}, {}}
+	if !reflect.DeepEqual(regions, wantRegions) {
+		t.Errorf("regions: got %#v, want %#v", regions, wantRegions)
+	}
+
+	wantSubInis := []string{"bootstrap", "linux1", "resources"}
+	if !reflect.DeepEqual(subInis, wantSubInis) {
+		t.Errorf("sub inis: got %#v, want %#v", subInis, wantSubInis)
+	}
+}
+
+func TestReport(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := NewReport(tree, config.ToBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Outputs) != 3 || report.Outputs[1].Path != "/usr/share/app/a.txt" || report.Outputs[1].Size != 9 {
+		t.Errorf("unexpected outputs: %+v", report.Outputs)
+	}
+
+	var markdown, html bytes.Buffer
+	if err := report.WriteMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	if err := report.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"| PackageID | 1587449549 |", "| 3 | ImageUpdate | linux1, binary.ini | 2 | reinstall |", "### resources/files.ini",
+		"| linux1/linux1.img | kernel | unknown |  |  |  |"} {
+		if !strings.Contains(markdown.String(), want) {
+			t.Errorf("markdown report is missing %q", want)
+		}
+	}
+
+	for _, want := range []string{"<td>Reinstall</td>", `<tr class="breakpoint">`, "/usr/share/app/b.txt"} {
+		if !strings.Contains(html.String(), want) {
+			t.Errorf("html report is missing %q", want)
+		}
+	}
+}
+
+func TestReportWithoutExtraction(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	extracted, err := NewReport(tree, config.ToBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := NewReport(tree, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payloads hash like the extracted files, removed paths have none
+	hashes := make(map[string]ReportOutput)
+	for _, output := range report.Outputs {
+		hashes[output.Path] = output
+	}
+	for _, output := range extracted.Outputs {
+		if got := hashes[output.Path]; got.Size != output.Size || got.SHA256 != output.SHA256 {
+			t.Errorf("%s: got %d %s, extracted %d %s", output.Path, got.Size, got.SHA256, output.Size, output.SHA256)
+		}
+	}
+	if setup := hashes["/tmp/setup.sh"]; setup.Path == "" || setup.SHA256 != "" {
+		t.Errorf("removed script should be listed without hash: %+v", setup)
+	}
+
+	var markdown bytes.Buffer
+	if err := report.WriteMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(markdown.String(), "| /usr/share/app/a.txt | 9 | ") {
+		t.Errorf("markdown report is missing the size of a.txt:\n%s", markdown.String())
+	}
+}
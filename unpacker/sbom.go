@@ -0,0 +1,487 @@
+package unpacker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Component types of an SBOM
+const (
+	ComponentOpkg    = "opkg"
+	ComponentDeb     = "deb"
+	ComponentBusyBox = "busybox"
+	ComponentLibrary = "library"
+	ComponentKernel  = "kernel"
+)
+
+// Component is a piece of software found in an extraction
+type Component struct {
+	Name         string    `json:"name"`
+	Version      string    `json:"version,omitempty"`
+	Type         string    `json:"type"`
+	Architecture string    `json:"architecture,omitempty"`
+	License      string    `json:"license,omitempty"`
+	PURL         string    `json:"purl,omitempty"`
+	Path         string    `json:"path"`
+	Steps        []StepRef `json:"steps,omitempty"`
+}
+
+// SBOM lists the components of a package, rendered by WriteCycloneDX and
+// WriteSPDX
+type SBOM struct {
+	Marker     Marker
+	Package    string
+	Created    time.Time
+	Components []Component
+}
+
+// statusFiles are the package databases of opkg and dpkg
+var statusFiles = map[string]string{
+	"/usr/lib/opkg/status": ComponentOpkg,
+	"/var/lib/opkg/status": ComponentOpkg,
+	"/etc/opkg/status":     ComponentOpkg,
+	"/var/lib/dpkg/status": ComponentDeb,
+}
+
+var (
+	busyboxVersion = regexp.MustCompile(`BusyBox v([0-9][0-9A-Za-z._-]*)`)
+	kernelVersion  = regexp.MustCompile(`Linux version ([0-9]+\.[0-9]+[0-9A-Za-z.+_-]*)`)
+	vermagic       = regexp.MustCompile(`vermagic=([0-9]+\.[0-9]+[0-9A-Za-z.+_-]*)`)
+	modulesFolder  = regexp.MustCompile(`^/lib/modules/([0-9]+\.[0-9]+[0-9A-Za-z.+_-]*)/`)
+	dashedLibrary  = regexp.MustCompile(`-([0-9][0-9.]*)\.so$`)
+	invalidSPDXID  = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+)
+
+func BuildSBOM(tree []*Ini, extracted string) (*SBOM, error) {
+	// BuildSBOM detects the components of an extraction: packages listed in
+	// opkg and dpkg status files, BusyBox, shared libraries by SONAME and the
+	// kernel version from kernel images, modules and /lib/modules. The
+	// creation time is the modification time of main_instructions.ini, so
+	// the same package always gives the same SBOM.
+
+	marker, err := NewMarker(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(tree[0].Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sbom := &SBOM{Marker: marker, Package: PackageName(tree), Created: info.ModTime().UTC().Truncate(time.Second)}
+	provenance := BuildProvenance(tree)
+	root := FilesystemRoot(extracted)
+	seen := make(map[string]bool)
+
+	add := func(component Component) {
+		key := component.Type + "/" + component.Name + "@" + component.Version
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		if component.PURL == "" {
+			component.PURL = componentPURL(component)
+		}
+		component.Steps = provenance.For(component.Path)
+		sbom.Components = append(sbom.Components, component)
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || !info.Mode().IsRegular() || rel == MarkerFilename || info.Size() > maxScanSize {
+			return err
+		}
+		name := "/" + filepath.ToSlash(rel)
+
+		if match := modulesFolder.FindStringSubmatch(name); match != nil {
+			add(Component{Name: "linux", Version: match[1], Type: ComponentKernel, Path: name})
+		}
+
+		if packageType, exists := statusFiles[name]; exists {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			for _, component := range readStatusFile(file, packageType) {
+				component.Path = name
+				add(component)
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(name, "/usr/lib/opkg/info/") && strings.HasSuffix(name, ".control") {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			for _, component := range readStatusFile(file, ComponentOpkg) {
+				component.Path = name
+				add(component)
+			}
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if match := busyboxVersion.FindSubmatch(content); match != nil {
+			add(Component{Name: "busybox", Version: string(match[1]), Type: ComponentBusyBox, Path: name})
+		}
+		for _, pattern := range []*regexp.Regexp{kernelVersion, vermagic} {
+			if match := pattern.FindSubmatch(content); match != nil {
+				add(Component{Name: "linux", Version: string(match[1]), Type: ComponentKernel, Path: name})
+			}
+		}
+
+		if bytes.HasPrefix(content, []byte("\x7fELF")) {
+			if elfInfo, err := readELF(path); err == nil && elfInfo.SONAME != "" {
+				add(Component{
+					Name:         libraryName(elfInfo.SONAME),
+					Version:      libraryVersion(filepath.Base(name), elfInfo.SONAME),
+					Type:         ComponentLibrary,
+					Architecture: elfInfo.Architecture,
+					Path:         name,
+				})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(sbom.Components, func(i, j int) bool {
+		a, b := sbom.Components[i], sbom.Components[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+
+	return sbom, nil
+}
+
+func readStatusFile(reader io.Reader, packageType string) []Component {
+	// Parses the stanzas of an opkg or dpkg status file. Packages that are
+	// known but not installed are skipped.
+
+	components := make([]Component, 0)
+	fields := make(map[string]string)
+
+	flush := func() {
+		installed := fields["Status"] == "" || strings.HasSuffix(fields["Status"], " installed")
+		if fields["Package"] != "" && installed {
+			components = append(components, Component{
+				Name:         fields["Package"],
+				Version:      fields["Version"],
+				Type:         packageType,
+				Architecture: fields["Architecture"],
+				License:      fields["License"],
+			})
+		}
+		fields = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case line[0] == ' ' || line[0] == '\t':
+			// Continuation of a multiline field like Description
+		default:
+			if key, value, found := strings.Cut(line, ":"); found {
+				fields[key] = strings.TrimSpace(value)
+			}
+		}
+	}
+	flush()
+
+	return components
+}
+
+func libraryName(soname string) string {
+	// libssl.so.1.1 is libssl
+
+	if i := strings.Index(soname, ".so"); i > 0 {
+		return soname[:i]
+	}
+
+	return soname
+}
+
+func libraryVersion(filename string, soname string) string {
+	// The file name carries the full version (libz.so.1.2.11), the SONAME
+	// only the major one (libz.so.1)
+
+	for _, name := range []string{filename, soname} {
+		if i := strings.Index(name, ".so."); i > 0 {
+			return name[i+4:]
+		}
+	}
+
+	// libfoo-1.2.so
+	if match := dashedLibrary.FindStringSubmatch(soname); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+func componentPURL(component Component) string {
+	// Package URLs as defined by github.com/package-url/purl-spec. Libraries
+	// and BusyBox have no package manager, they're generic.
+
+	purlType := "generic"
+	switch component.Type {
+	case ComponentOpkg, ComponentDeb:
+		purlType = component.Type
+	}
+
+	purl := fmt.Sprintf("pkg:%s/%s", purlType, component.Name)
+	if component.Version != "" {
+		purl += "@" + component.Version
+	}
+	if component.Architecture != "" {
+		purl += "?arch=" + component.Architecture
+	}
+
+	return purl
+}
+
+func (sbom *SBOM) properties() [][2]string {
+	return [][2]string{
+		{"upupandaway:package_id", strconv.FormatInt(sbom.Marker.PackageID, 10)},
+		{"upupandaway:up_type", sbom.Marker.UPType},
+		{"upupandaway:sub_up_type", sbom.Marker.SubUPType},
+		{"upupandaway:main_instructions_sha256", sbom.Marker.MainSHA256},
+	}
+}
+
+// serial is a UUID derived from the hash of main_instructions.ini
+func (sbom *SBOM) serial() string {
+	hash := sbom.Marker.MainSHA256 + strings.Repeat("0", 32)
+	return fmt.Sprintf("%s-%s-5%s-8%s-%s", hash[0:8], hash[8:12], hash[13:16], hash[17:20], hash[20:32])
+}
+
+func (sbom *SBOM) WriteCycloneDX(w io.Writer) error {
+	// WriteCycloneDX writes the SBOM as CycloneDX 1.5 JSON. The package is
+	// the firmware component of the metadata, PackageID and UPType are its
+	// properties.
+
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type license struct {
+		License struct {
+			Name string `json:"name"`
+		} `json:"license"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		BOMRef     string     `json:"bom-ref"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		PURL       string     `json:"purl,omitempty"`
+		Licenses   []license  `json:"licenses,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+
+	firmware := component{
+		Type:    "firmware",
+		BOMRef:  sbom.Package,
+		Name:    sbom.Package,
+		Version: strconv.FormatInt(sbom.Marker.PackageID, 10),
+	}
+	for _, p := range sbom.properties() {
+		firmware.Properties = append(firmware.Properties, property{p[0], p[1]})
+	}
+
+	components := make([]component, 0, len(sbom.Components))
+	for _, c := range sbom.Components {
+		cdx := component{Type: "library", BOMRef: c.PURL, Name: c.Name, Version: c.Version, PURL: c.PURL}
+		switch c.Type {
+		case ComponentKernel:
+			cdx.Type = "operating-system"
+		case ComponentBusyBox:
+			cdx.Type = "application"
+		}
+
+		if c.License != "" {
+			var l license
+			l.License.Name = c.License
+			cdx.Licenses = []license{l}
+		}
+
+		cdx.Properties = append(cdx.Properties, property{"upupandaway:path", c.Path})
+		for _, ref := range c.Steps {
+			cdx.Properties = append(cdx.Properties, property{"upupandaway:step", ref.String()})
+		}
+
+		components = append(components, cdx)
+	}
+
+	document := map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + sbom.serial(),
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": sbom.Created.Format(time.RFC3339),
+			"tools": map[string]interface{}{
+				"components": []component{{Type: "application", BOMRef: "upupandaway", Name: "upupandaway", Version: Version}},
+			},
+			"component": firmware,
+		},
+		"components": components,
+	}
+
+	return writeJSON(w, document)
+}
+
+func (sbom *SBOM) WriteSPDX(w io.Writer) error {
+	// WriteSPDX writes the SBOM as SPDX 2.3 JSON. PackageID and UPType are
+	// an annotation of the firmware package, which contains all components.
+
+	type externalRef struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type annotation struct {
+		Type      string `json:"annotationType"`
+		Annotator string `json:"annotator"`
+		Date      string `json:"annotationDate"`
+		Comment   string `json:"comment"`
+	}
+	type spdxPackage struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		Version          string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		LicenseConcluded string        `json:"licenseConcluded"`
+		LicenseDeclared  string        `json:"licenseDeclared"`
+		LicenseComments  string        `json:"licenseComments,omitempty"`
+		Purpose          string        `json:"primaryPackagePurpose,omitempty"`
+		SourceInfo       string        `json:"sourceInfo,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+		Annotations      []annotation  `json:"annotations,omitempty"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+
+	tool := "Tool: upupandaway-" + Version
+	created := sbom.Created.Format(time.RFC3339)
+
+	comments := make([]string, 0)
+	for _, p := range sbom.properties() {
+		comments = append(comments, p[0]+"="+p[1])
+	}
+
+	firmware := spdxPackage{
+		SPDXID:           "SPDXRef-Package-" + spdxID(sbom.Package),
+		Name:             sbom.Package,
+		Version:          strconv.FormatInt(sbom.Marker.PackageID, 10),
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		Purpose:          "FIRMWARE",
+		Annotations:      []annotation{{"OTHER", tool, created, strings.Join(comments, "; ")}},
+	}
+
+	packages := []spdxPackage{firmware}
+	relationships := []relationship{{"SPDXRef-DOCUMENT", "DESCRIBES", firmware.SPDXID}}
+
+	for i, c := range sbom.Components {
+		steps := make([]string, 0, len(c.Steps))
+		for _, ref := range c.Steps {
+			steps = append(steps, ref.String())
+		}
+
+		source := "found at " + c.Path
+		if len(steps) > 0 {
+			source += ", written by " + strings.Join(steps, "; ")
+		}
+
+		p := spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d-%s", i+1, spdxID(c.Name)),
+			Name:             c.Name,
+			Version:          c.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			LicenseComments:  c.License,
+			SourceInfo:       source,
+			ExternalRefs:     []externalRef{{"PACKAGE-MANAGER", "purl", c.PURL}},
+		}
+		if c.Type == ComponentKernel {
+			p.Purpose = "OPERATING-SYSTEM"
+		} else if c.Type == ComponentBusyBox {
+			p.Purpose = "APPLICATION"
+		} else {
+			p.Purpose = "LIBRARY"
+		}
+
+		packages = append(packages, p)
+		relationships = append(relationships, relationship{firmware.SPDXID, "CONTAINS", p.SPDXID})
+	}
+
+	document := map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              sbom.Package,
+		"documentNamespace": "https://github.com/sjossi/upupandaway/spdx/" + sbom.Package + "-" + sbom.serial(),
+		"creationInfo": map[string]interface{}{
+			"created":  created,
+			"creators": []string{tool},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+
+	return writeJSON(w, document)
+}
+
+// spdxID replaces everything an SPDX identifier can't contain
+func spdxID(name string) string {
+	return invalidSPDXID.ReplaceAllString(name, "-")
+}
+
+func writeJSON(w io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(value)
+}
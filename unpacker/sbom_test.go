@@ -0,0 +1,88 @@
+package unpacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildSBOM(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	extracted := t.TempDir()
+
+	files := map[string]string{
+		"usr/lib/opkg/status": "Package: zlib\nVersion: 1.2.11-r0\nArchitecture: cortexa9hf-neon\nLicense: Zlib\n" +
+			"Status: install ok installed\nDescription: compression\n library\n\n" +
+			"Package: removed\nVersion: 1.0\nStatus: deinstall ok not-installed\n",
+		"bin/busybox":                        "\x7fELF\x00BusyBox v1.31.1 (2020-04-01 10:00:00 UTC)\x00",
+		"lib/modules/4.14.98-rt/modules.dep": "",
+		"usr/share/app/a.txt":                "Linux version 4.14.98-rt (builder@host) #1 SMP PREEMPT\n",
+	}
+	writeFiles(t, extracted, files)
+
+	sbom, err := BuildSBOM(tree, extracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	for _, component := range sbom.Components {
+		got = append(got, component.PURL+" "+component.Path)
+	}
+	want := []string{
+		"pkg:generic/busybox@1.31.1 /bin/busybox",
+		"pkg:generic/linux@4.14.98-rt /lib/modules/4.14.98-rt/modules.dep",
+		"pkg:opkg/zlib@1.2.11-r0?arch=cortexa9hf-neon /usr/lib/opkg/status",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got components %#v, want %#v", got, want)
+	}
+
+	var cyclonedx, spdx bytes.Buffer
+	if err := sbom.WriteCycloneDX(&cyclonedx); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbom.WriteSPDX(&spdx); err != nil {
+		t.Fatal(err)
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(cyclonedx.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if document["bomFormat"] != "CycloneDX" || len(document["components"].([]interface{})) != 3 {
+		t.Errorf("unexpected CycloneDX document:\n%s", cyclonedx.String())
+	}
+	for _, want := range []string{`"value": "1587449549"`, `"value": "Reinstall"`, `"name": "Zlib"`} {
+		if !strings.Contains(cyclonedx.String(), want) {
+			t.Errorf("CycloneDX is missing %s:\n%s", want, cyclonedx.String())
+		}
+	}
+
+	if err := json.Unmarshal(spdx.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if document["spdxVersion"] != "SPDX-2.3" || len(document["packages"].([]interface{})) != 4 ||
+		len(document["relationships"].([]interface{})) != 4 {
+		t.Errorf("unexpected SPDX document:\n%s", spdx.String())
+	}
+	if !strings.Contains(spdx.String(), "upupandaway:package_id=1587449549; upupandaway:up_type=Reinstall") {
+		t.Errorf("SPDX is missing the package annotation:\n%s", spdx.String())
+	}
+}
+
+func TestLibraryVersion(t *testing.T) {
+	cases := []struct{ filename, soname, name, version string }{
+		{"libz.so.1.2.11", "libz.so.1", "libz", "1.2.11"},
+		{"libc.so", "libc.so.6", "libc", "6"},
+		{"libfoo-2.4.so", "libfoo-2.4.so", "libfoo-2.4", "2.4"},
+	}
+
+	for _, c := range cases {
+		if name, version := libraryName(c.soname), libraryVersion(c.filename, c.soname); name != c.name || version != c.version {
+			t.Errorf("%s (%s): got %s %s, want %s %s", c.filename, c.soname, name, version, c.name, c.version)
+		}
+	}
+}
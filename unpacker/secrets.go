@@ -0,0 +1,396 @@
+package unpacker
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of secrets found by ScanSecrets
+const (
+	SecretPasswordHash    = "password hash"
+	SecretEmptyPassword   = "empty password"
+	SecretPassword        = "hardcoded password"
+	SecretDefaultPassword = "default credential"
+	SecretPrivateKey      = "private key"
+	SecretCertificate     = "certificate"
+	SecretToken           = "token"
+)
+
+// maxScanSize is the size up to which files are scanned, bigger files are
+// images that are inventoried elsewhere
+const maxScanSize = 64 << 20
+
+// Secret is a credential, key or certificate found in an extraction or in the
+// arguments of an Execute step
+type Secret struct {
+	Kind     string   `json:"kind"`
+	Severity Severity `json:"severity"`
+	// Path is the file on the target filesystem, empty for Execute arguments
+	Path string `json:"path,omitempty"`
+	// Line is 0 for binary files
+	Line   int       `json:"line,omitempty"`
+	Detail string    `json:"detail"`
+	Match  string    `json:"match"`
+	Steps  []StepRef `json:"steps,omitempty"`
+}
+
+// defaultPasswords are passwords shipped as factory default so often they're
+// worth their own kind
+var defaultPasswords = map[string]bool{
+	"root": true, "toor": true, "admin": true, "password": true, "passw0rd": true, "default": true,
+	"1234": true, "12345": true, "123456": true, "guest": true, "user": true, "service": true,
+}
+
+var (
+	accountLine   = regexp.MustCompile(`(?m)^([a-zA-Z_][a-zA-Z0-9_.-]*\$?):([^:\n]*):([0-9]*):`)
+	cryptHash     = regexp.MustCompile(`\$(1|2[aby]|5|6|y|md5|sha1)\$[./A-Za-z0-9$]{8,}`)
+	chpasswd      = regexp.MustCompile(`echo\s+(?:-[en]+\s+)?["']?([a-zA-Z_][a-zA-Z0-9_.-]*):([^\s"':|]*)["']?\s*\|\s*chpasswd`)
+	userPassword  = regexp.MustCompile(`(?:useradd|usermod)\b[^\n;|&]*\s-p\s+["']?([^\s"']+)`)
+	assignment    = regexp.MustCompile(`(?i)\b(password|passwd|passwort|pwd|secret|api_?key|access_?key|auth_?token|token)["']?\s*[:=]\s*["']?([^\s"';&|,)]{4,})`)
+	tokenPatterns = []struct {
+		name    string
+		pattern *regexp.Regexp
+	}{
+		{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+		{"Slack token", regexp.MustCompile(`\bxox[abpr]-[A-Za-z0-9-]{10,}\b`)},
+		{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+		{"JSON web token", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	}
+)
+
+func ScanSecrets(tree []*Ini, extracted string) ([]Secret, error) {
+	// ScanSecrets looks for passwd and shadow entries, password hashes,
+	// private keys, certificates, tokens and hardcoded or default passwords
+	// in the arguments of every Execute step, in the Copy payloads that
+	// aren't in the extraction and, if extracted isn't empty, in every file
+	// of that extraction. Scripts the package copies, runs and removes again
+	// are only found in their payloads, that's where passwords are set. Each
+	// hit carries the steps that produced it.
+
+	secrets := make([]Secret, 0)
+
+	// payloads are the Copy steps in package order, see recordCopy
+	type payload struct {
+		target string
+		from   string
+		ref    StepRef
+	}
+	payloads := make([]payload, 0)
+	copied := make(map[string]string)
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+
+			switch instruction.InstructionStep {
+			case Copy:
+				recordCopy(copied, ini, instruction)
+				if target, err := stepTarget(ini, instruction); err == nil && target != "" {
+					payloads = append(payloads, payload{target, copied[target], ref})
+				}
+			case Execute:
+				for _, secret := range scanContent("", []byte(strings.Join(instruction.Arguments, " "))) {
+					secret.Steps = []StepRef{ref}
+					secrets = append(secrets, secret)
+				}
+			}
+		}
+	}
+
+	root := ""
+	if extracted != "" {
+		root = FilesystemRoot(extracted)
+	}
+
+	// The last payload copied to a path that is still there is scanned with
+	// the extraction
+	last := make(map[string]int)
+	for i, p := range payloads {
+		last[p.target] = i
+	}
+
+	for i, p := range payloads {
+		if root != "" && last[p.target] == i && fileExists(filepath.Join(root, p.target)) {
+			continue
+		}
+		if size, err := payloadSize(p.from); err != nil || size > maxScanSize {
+			continue
+		}
+
+		content, err := readPayload(p.from)
+		if err != nil {
+			continue
+		}
+		for _, secret := range scanContent(p.target, content) {
+			secret.Steps = []StepRef{p.ref}
+			secrets = append(secrets, secret)
+		}
+	}
+
+	if root == "" {
+		return secrets, nil
+	}
+
+	provenance := BuildProvenance(tree)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || !info.Mode().IsRegular() || rel == MarkerFilename || info.Size() > maxScanSize {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		name := "/" + filepath.ToSlash(rel)
+		for _, secret := range scanContent(name, content) {
+			secret.Steps = provenance.For(name)
+			secrets = append(secrets, secret)
+		}
+
+		return nil
+	})
+
+	return secrets, err
+}
+
+func scanContent(name string, content []byte) []Secret {
+	// scanContent runs all detectors over a single file or Execute argument.
+	// Binaries only get the detectors for well delimited formats, the
+	// generic password assignments are too noisy on them.
+
+	secrets := make([]Secret, 0)
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	text := !bytes.Contains(head, []byte{0})
+
+	// Lines are counted on from the previous match. Matches of a detector
+	// come in order, counting only starts over for the next detector.
+	counted, line := 0, 1
+	lineOf := func(offset int) int {
+		if offset < counted {
+			counted, line = 0, 1
+		}
+		line += bytes.Count(content[counted:offset], []byte("\n"))
+		counted = offset
+		return line
+	}
+
+	add := func(kind string, severity Severity, offset int, detail string, match string) {
+		secret := Secret{Kind: kind, Severity: severity, Path: name, Detail: detail, Match: shorten(match, 120)}
+		if text {
+			secret.Line = lineOf(offset)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	base := filepath.Base(name)
+	accounts := strings.HasPrefix(base, "passwd") || strings.HasPrefix(base, "shadow")
+
+	if accounts && text {
+		for _, match := range accountLine.FindAllSubmatchIndex(content, -1) {
+			user, hash := string(content[match[2]:match[3]]), string(content[match[4]:match[5]])
+			line := string(lineAt(content, match[0]))
+
+			switch {
+			case hash == "":
+				add(SecretEmptyPassword, SeverityError, match[0], user+" has no password", line)
+			case hash == "x" || strings.HasPrefix(hash, "*") || strings.HasPrefix(hash, "!"):
+				// Locked or stored in shadow
+			default:
+				add(SecretPasswordHash, SeverityWarning, match[0], user+": "+hashType(hash), line)
+			}
+		}
+	}
+
+	for _, match := range chpasswd.FindAllSubmatchIndex(content, -1) {
+		user, password := string(content[match[2]:match[3]]), string(content[match[4]:match[5]])
+		addPassword(add, match[0], user, password, string(content[match[0]:match[1]]))
+	}
+
+	for _, match := range userPassword.FindAllSubmatchIndex(content, -1) {
+		hash := string(content[match[2]:match[3]])
+		if !strings.HasPrefix(hash, "$") || cryptHash.MatchString(hash) {
+			add(SecretPasswordHash, SeverityWarning, match[0], hashType(hash), string(content[match[0]:match[1]]))
+		}
+	}
+
+	if !accounts {
+		for _, match := range cryptHash.FindAllIndex(content, -1) {
+			if line := lineAt(content, match[0]); userPassword.Match(line) || chpasswd.Match(line) {
+				// Already reported with the user
+				continue
+			}
+			hash := string(content[match[0]:match[1]])
+			add(SecretPasswordHash, SeverityWarning, match[0], hashType(hash), hash)
+		}
+	}
+
+	for _, token := range tokenPatterns {
+		for _, match := range token.pattern.FindAllIndex(content, -1) {
+			add(SecretToken, SeverityWarning, match[0], token.name, string(content[match[0]:match[1]]))
+		}
+	}
+
+	if text {
+		for _, match := range assignment.FindAllSubmatchIndex(content, -1) {
+			key, value := string(content[match[2]:match[3]]), string(content[match[4]:match[5]])
+			if strings.HasPrefix(value, "$") || strings.HasPrefix(value, "%") {
+				// Variables and format strings
+				continue
+			}
+			if strings.Contains(strings.ToLower(key), "pass") || strings.EqualFold(key, "pwd") {
+				addPassword(add, match[0], key, value, string(content[match[0]:match[1]]))
+			} else {
+				add(SecretToken, SeverityWarning, match[0], key, string(content[match[0]:match[1]]))
+			}
+		}
+	}
+
+	scanPEM(content, add)
+
+	sort.SliceStable(secrets, func(i, j int) bool { return secrets[i].Line < secrets[j].Line })
+
+	return secrets
+}
+
+func addPassword(add func(string, Severity, int, string, string), offset int, user string, password string, match string) {
+	switch {
+	case password == "":
+		add(SecretEmptyPassword, SeverityError, offset, user+" has no password", match)
+	case cryptHash.MatchString(password):
+		add(SecretPasswordHash, SeverityWarning, offset, user+": "+hashType(password), match)
+	case defaultPasswords[strings.ToLower(password)] || password == user:
+		add(SecretDefaultPassword, SeverityError, offset, user+" has the default password "+password, match)
+	default:
+		add(SecretPassword, SeverityWarning, offset, user, match)
+	}
+}
+
+func scanPEM(content []byte, add func(string, Severity, int, string, string)) {
+	// Finds PEM blocks, also the ones embedded into binaries
+
+	begin := []byte("-----BEGIN ")
+
+	for offset := 0; ; {
+		i := bytes.Index(content[offset:], begin)
+		if i < 0 {
+			return
+		}
+		offset += i
+
+		block, rest := pem.Decode(content[offset:])
+		if block == nil {
+			offset += len(begin)
+			continue
+		}
+		header := string(lineAt(content, offset))
+
+		switch {
+		case strings.Contains(block.Type, "PRIVATE KEY"):
+			detail := block.Type
+			if block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+				detail += ", encrypted"
+			}
+			add(SecretPrivateKey, SeverityError, offset, detail, header)
+		case block.Type == "CERTIFICATE":
+			add(SecretCertificate, SeverityInfo, offset, certificateDetail(block.Bytes), header)
+		}
+
+		offset = len(content) - len(rest)
+	}
+}
+
+func certificateDetail(der []byte) string {
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "unparsable: " + err.Error()
+	}
+
+	detail := fmt.Sprintf("subject %s, issuer %s, valid until %s", certificate.Subject, certificate.Issuer,
+		certificate.NotAfter.Format("2006-01-02"))
+	if certificate.Subject.String() == certificate.Issuer.String() {
+		detail += ", self-signed"
+	}
+	if certificate.IsCA {
+		detail += ", CA"
+	}
+
+	return detail
+}
+
+func hashType(hash string) string {
+	// hashType names the crypt(3) scheme of a password hash
+
+	schemes := map[string]string{
+		"1": "md5crypt", "2a": "bcrypt", "2b": "bcrypt", "2y": "bcrypt", "5": "sha256crypt",
+		"6": "sha512crypt", "y": "yescrypt", "md5": "Sun md5crypt", "sha1": "sha1crypt",
+	}
+
+	if strings.HasPrefix(hash, "$") {
+		if scheme, exists := schemes[strings.SplitN(hash[1:], "$", 2)[0]]; exists {
+			return scheme
+		}
+		return "unknown crypt scheme"
+	}
+
+	if len(hash) == 13 {
+		return "DES crypt"
+	}
+
+	return "unknown"
+}
+
+func lineAt(content []byte, offset int) []byte {
+	start := bytes.LastIndexByte(content[:offset], '\n') + 1
+	end := bytes.IndexByte(content[offset:], '\n')
+	if end < 0 {
+		return content[start:]
+	}
+
+	return content[start : offset+end]
+}
+
+func shorten(s string, n int) string {
+	return truncate(strings.TrimSpace(s), n)
+}
+
+func WriteSecrets(secrets []Secret, w io.Writer) {
+	// WriteSecrets writes a human readable list of secrets
+
+	for _, secret := range secrets {
+		location := "Execute argument"
+		if secret.Path != "" {
+			location = secret.Path
+			if secret.Line > 0 {
+				location += fmt.Sprintf(":%d", secret.Line)
+			}
+		}
+
+		fmt.Fprintf(w, "%s: %s (%s) in %s\n  %s\n", secret.Severity, secret.Kind, secret.Detail, location, secret.Match)
+		for _, ref := range secret.Steps {
+			fmt.Fprintf(w, "    %s\n", ref)
+		}
+	}
+}
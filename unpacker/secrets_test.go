@@ -0,0 +1,165 @@
+package unpacker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestScanSecrets(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotAfter:     time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificatePEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}))
+
+	extracted := t.TempDir()
+	files := map[string]string{
+		"etc/shadow": "root:$6$saltsalt$0123456789abcdef:18000:0:99999:7:::\n" +
+			"daemon:*:18000:0:99999:7:::\nguest::18000:0:99999:7:::\n",
+		"etc/passwd":         "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/ssl/device.pem": certificatePEM + string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		"usr/bin/tool":       "\x7fELF\x00\x00password=ignored\x00AKIAABCDEFGHIJKLMNOP\x00",
+		"etc/init.d/app":     "#!/bin/sh\nAPP_PASSWORD=$1\necho service:service | chpasswd\napi_key = \"0123456789abcdef\"\n",
+	}
+	writeFiles(t, extracted, files)
+
+	tree := []*Ini{{}, {
+		Folder:   "passwdupdate",
+		Filename: "execute.ini",
+		Step:     Instruction{StepNo: 1},
+		Instructions: Instructions{Instructions: []Instruction{
+			{StepNo: 1, InstructionStep: Execute, Arguments: []string{"usermod -p '$1$abcdefgh$ijklmnopqrstuv' root"}},
+		}},
+	}, {
+		Folder:   "resources",
+		Filename: "files.ini",
+		Step:     Instruction{StepNo: 2},
+		Instructions: Instructions{Instructions: []Instruction{
+			{StepNo: 7, InstructionStep: Copy, Arguments: []string{"resources/f0007.dat", "/etc/shadow"}},
+		}},
+	}}
+
+	secrets, err := ScanSecrets(tree, extracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type hit struct {
+		Kind   string
+		Path   string
+		Line   int
+		Detail string
+	}
+	got := make([]hit, 0)
+	for _, secret := range secrets {
+		got = append(got, hit{secret.Kind, secret.Path, secret.Line, secret.Detail})
+	}
+
+	want := []hit{
+		{SecretPasswordHash, "", 1, "md5crypt"},
+		{SecretDefaultPassword, "/etc/init.d/app", 3, "service has the default password service"},
+		{SecretToken, "/etc/init.d/app", 4, "api_key"},
+		{SecretPasswordHash, "/etc/shadow", 1, "root: sha512crypt"},
+		{SecretEmptyPassword, "/etc/shadow", 3, "guest has no password"},
+		{SecretCertificate, "/etc/ssl/device.pem", 1, "subject CN=device, issuer CN=device, valid until 2040-01-02, self-signed"},
+		{SecretPrivateKey, "/etc/ssl/device.pem", strings.Count(certificatePEM, "\n") + 1, "EC PRIVATE KEY"},
+		{SecretToken, "/usr/bin/tool", 0, "AWS access key"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%+v\nwant:\n%+v", got, want)
+	}
+
+	if len(secrets[0].Steps) != 1 || secrets[0].Steps[0].Folder != "passwdupdate" {
+		t.Errorf("Execute hit points to the wrong step: %+v", secrets[0].Steps)
+	}
+	if len(secrets[3].Steps) != 1 || secrets[3].Steps[0].StepNo != 7 {
+		t.Errorf("shadow hit points to the wrong step: %+v", secrets[3].Steps)
+	}
+}
+
+func TestScanSecretsRemovedScript(t *testing.T) {
+	main := writeSyntheticPackage(t)
+
+	// The usual passwdupdate: copied, run and removed again, only the
+	// payload is left to scan
+	writeFiles(t, filepath.Dir(main), map[string]string{
+		"bootstrap/e0000000001.dat.gz": "#!/bin/sh\necho root:root | chpasswd\n",
+	})
+
+	tree := ParseIniTree(main)
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, extracted := range []string{config.ToBase, ""} {
+		secrets, err := ScanSecrets(tree, extracted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(secrets) != 1 || secrets[0].Kind != SecretDefaultPassword || secrets[0].Path != "/tmp/setup.sh" ||
+			secrets[0].Line != 2 || len(secrets[0].Steps) != 1 || secrets[0].Steps[0].Folder != "bootstrap" || secrets[0].Steps[0].StepNo != 1 {
+			t.Errorf("unexpected secrets with extraction %q: %+v", extracted, secrets)
+		}
+	}
+}
+
+func TestScanContentLines(t *testing.T) {
+	// Two detectors with matches all over a long file, the second one
+	// starts counting lines over
+	var content strings.Builder
+	want := make([]int, 0)
+	for line := 1; line <= 5000; line++ {
+		switch {
+		case line%1000 == 0:
+			fmt.Fprintf(&content, "echo admin%d:admin | chpasswd\n", line)
+			want = append(want, line)
+		case line%1000 == 500:
+			fmt.Fprintf(&content, "token=%s%d\n", strings.Repeat("ä", 100), line)
+			want = append(want, line)
+		default:
+			content.WriteString("echo nothing to see\n")
+		}
+	}
+
+	secrets := scanContent("etc/init.d/app", []byte(content.String()))
+	if len(secrets) != len(want) {
+		t.Fatalf("expected %d secrets, got %+v", len(want), secrets)
+	}
+	for i, secret := range secrets {
+		if secret.Line != want[i] {
+			t.Errorf("secret %d: expected line %d, got %d", i, want[i], secret.Line)
+		}
+		if !utf8.ValidString(secret.Match) || len(secret.Match) > 120 {
+			t.Errorf("secret %d: bad match %q", i, secret.Match)
+		}
+	}
+}
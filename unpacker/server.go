@@ -0,0 +1,303 @@
+package unpacker
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed web/index.html
+var webIndex []byte
+
+// APIIni is a parsed ini as served by the API
+type APIIni struct {
+	// Index is the position in the tree, 0 for the main ini and the main
+	// StepNo for sub inis
+	Index        int              `json:"index"`
+	Folder       string           `json:"folder"`
+	Filename     string           `json:"filename"`
+	Settings     *Settings        `json:"settings,omitempty"`
+	DataStorage  *DataStorage     `json:"data_storage,omitempty"`
+	Instructions []APIInstruction `json:"instructions"`
+	// Plan are the main steps in order with their BreakPoint regions, see
+	// ExecutionPlan, only set for the main ini
+	Plan []APIInstruction `json:"plan,omitempty"`
+}
+
+// APIInstruction is an instruction with its name instead of the number
+type APIInstruction struct {
+	StepNo      int      `json:"step"`
+	Instruction string   `json:"instruction"`
+	Arguments   []string `json:"arguments"`
+	Steps       int      `json:"steps,omitempty"`
+	// Payload is the file a Copy or ImageUpdate step reads, relative to the
+	// package, see /payload
+	Payload string `json:"payload,omitempty"`
+	// Regions are the BreakPoint regions of a main step
+	Regions []string `json:"regions,omitempty"`
+}
+
+// APIFile is a path on the target filesystem with the steps touching it
+type APIFile struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Link   string    `json:"link,omitempty"`
+	Steps  []StepRef `json:"steps"`
+	// Download is the escaped URL of the extracted file, empty without
+	// extraction
+	Download string `json:"download,omitempty"`
+}
+
+// server answers the API from data collected once at start
+type server struct {
+	tree      []*Ini
+	root      string
+	extracted bool
+	inis      []APIIni
+	files     []APIFile
+	findings  []Finding
+}
+
+func NewServer(tree []*Ini, extracted string) (http.Handler, error) {
+	// NewServer serves a package read-only over HTTP: the web UI on /, the
+	// JSON API below /api and downloads below /download (extracted files)
+	// and /payload (files of the package). Without extracted, the file
+	// listing is taken from the instructions and there are no downloads of
+	// extracted files.
+	//
+	//   GET /api/package         name, settings and data storage
+	//   GET /api/tree            all inis with their instructions
+	//   GET /api/findings        validation findings
+	//   GET /api/files           files with provenance, ?q= filters by path
+	//   GET /api/files/<path>    a single file
+	//   GET /download/<path>     an extracted file
+	//   GET /payload/<path>      a payload, relative to the main ini
+
+	s := &server{tree: tree, findings: Validate(tree), extracted: extracted != ""}
+	s.inis = apiInis(tree)
+
+	provenance := BuildProvenance(tree)
+
+	if extracted == "" {
+		for _, p := range provenance.Paths() {
+			s.files = append(s.files, APIFile{Path: p, Steps: provenance.For(p)})
+		}
+	} else {
+		s.root = FilesystemRoot(extracted)
+		entries, err := readFolderEntries(s.root)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range sortedKeys(entries) {
+			file := APIFile{Path: p, Size: entries[p].size, SHA256: entries[p].hash, Link: entries[p].link, Steps: provenance.For(p)}
+			if file.Link == "" {
+				file.Download = (&url.URL{Path: "/download" + p}).EscapedPath()
+			}
+			s.files = append(s.files, file)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.index)
+	mux.HandleFunc("/api/package", s.packageInfo)
+	mux.HandleFunc("/api/tree", func(w http.ResponseWriter, r *http.Request) { writeAPI(w, s.inis) })
+	mux.HandleFunc("/api/findings", func(w http.ResponseWriter, r *http.Request) { writeAPI(w, s.findings) })
+	mux.HandleFunc("/api/files", s.fileList)
+	mux.HandleFunc("/api/files/", s.file)
+	mux.HandleFunc("/download/", s.download)
+	mux.HandleFunc("/payload/", s.payload)
+
+	return readOnly(mux), nil
+}
+
+func apiInis(tree []*Ini) []APIIni {
+	instructions := func(ini *Ini, list []Instruction) []APIInstruction {
+		result := make([]APIInstruction, 0, len(list))
+		for _, instruction := range list {
+			converted := APIInstruction{
+				StepNo:      instruction.StepNo,
+				Instruction: instruction.InstructionStep.String(),
+				Arguments:   instruction.Arguments,
+				Steps:       instruction.Steps,
+			}
+			if payload := InstructionPayload(ini, instruction); payload != "" {
+				relative, err := filepath.Rel(ini.RootDir, payload)
+				if err == nil {
+					converted.Payload = filepath.ToSlash(relative)
+				}
+			}
+			result = append(result, converted)
+		}
+		return result
+	}
+
+	main := tree[0]
+	inis := []APIIni{{
+		Filename:     filepath.Base(main.Filename),
+		Settings:     &main.Settings,
+		DataStorage:  &main.DataStorage,
+		Instructions: instructions(main, main.Instructions.Instructions),
+	}}
+
+	for _, step := range ExecutionPlan(tree) {
+		planned := instructions(main, []Instruction{step.Instruction})[0]
+		planned.Regions = step.Regions
+		inis[0].Plan = append(inis[0].Plan, planned)
+	}
+
+	for i, ini := range tree[1:] {
+		if ini != nil {
+			inis = append(inis, APIIni{
+				Index:        i + 1,
+				Folder:       ini.Folder,
+				Filename:     ini.Filename,
+				Instructions: instructions(ini, ini.Instructions.Instructions),
+			})
+		}
+	}
+
+	return inis
+}
+
+func readOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read only", http.StatusMethodNotAllowed)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func writeAPI(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func (s *server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webIndex)
+}
+
+func (s *server) packageInfo(w http.ResponseWriter, r *http.Request) {
+	main := s.tree[0]
+	writeAPI(w, struct {
+		Name        string      `json:"name"`
+		Settings    Settings    `json:"settings"`
+		DataStorage DataStorage `json:"data_storage"`
+		Extracted   bool        `json:"extracted"`
+		Files       int         `json:"files"`
+		Findings    int         `json:"findings"`
+	}{PackageName(s.tree), main.Settings, main.DataStorage, s.extracted, len(s.files), len(s.findings)})
+}
+
+func (s *server) fileList(w http.ResponseWriter, r *http.Request) {
+	query := strings.ToLower(r.URL.Query().Get("q"))
+
+	files := make([]APIFile, 0, len(s.files))
+	for _, file := range s.files {
+		if strings.Contains(strings.ToLower(file.Path), query) {
+			files = append(files, file)
+		}
+	}
+
+	writeAPI(w, files)
+}
+
+func (s *server) file(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/api/files/"))
+
+	for _, file := range s.files {
+		if file.Path == name {
+			writeAPI(w, file)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	if !s.extracted {
+		http.Error(w, "the package was served without extraction", http.StatusNotFound)
+		return
+	}
+
+	full, ok := servedPath(s.root, strings.TrimPrefix(r.URL.Path, "/download/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	attachment(w, full)
+	http.ServeFile(w, r, full)
+}
+
+func (s *server) payload(w http.ResponseWriter, r *http.Request) {
+	// Payloads are served like the instructions name them, decompressed if
+	// the package only has the .gz
+
+	full, ok := servedPath(s.tree[0].RootDir, strings.TrimPrefix(r.URL.Path, "/payload/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	payload, err := openPayload(full)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer payload.Close()
+
+	attachment(w, full)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, payload)
+}
+
+func servedPath(root string, name string) (string, bool) {
+	// Joins a URL path to root. Cleaning the rooted path keeps .. from
+	// leaving root, symlinks could still point anywhere so no part of the
+	// path may be one. Extractions have plenty of absolute symlinks that
+	// would resolve on this machine.
+
+	name = path.Clean("/" + name)
+	full := root
+
+	for _, part := range strings.Split(strings.TrimPrefix(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		full = filepath.Join(full, part)
+		if info, err := os.Lstat(full); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", false
+		}
+	}
+
+	return full, true
+}
+
+func attachment(w http.ResponseWriter, full string) {
+	name := strings.NewReplacer(`"`, "", "\\", "").Replace(filepath.Base(full))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+}
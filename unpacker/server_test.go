@@ -0,0 +1,104 @@
+package unpacker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out")}
+
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("/etc", filepath.Join(FilesystemRoot(config.ToBase), "usr", "etc"))
+	os.WriteFile(filepath.Join(FilesystemRoot(config.ToBase), "usr", "a #1?.txt"), []byte("odd"), 0644)
+
+	handler, err := NewServer(tree, config.ToBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	var inis []APIIni
+	_, body := get("/api/tree")
+	if err := json.Unmarshal([]byte(body), &inis); err != nil {
+		t.Fatal(err)
+	}
+	if len(inis) != 4 || len(inis[0].Plan) != 5 || inis[0].Plan[2].Regions[0] != "reinstall" {
+		t.Fatalf("unexpected tree %+v", inis)
+	}
+	if copied := inis[1].Instructions[0]; copied.Instruction != "Copy" || copied.Payload != "bootstrap/e0000000001.dat" {
+		t.Errorf("unexpected instruction %+v", copied)
+	}
+
+	var file APIFile
+	_, body = get("/api/files/usr/share/app/a.txt")
+	if err := json.Unmarshal([]byte(body), &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Size != 9 || len(file.Steps) != 2 || file.Download != "/download/usr/share/app/a.txt" {
+		t.Errorf("unexpected file %+v", file)
+	}
+
+	var files []APIFile
+	_, body = get("/api/files?q=B.TXT")
+	json.Unmarshal([]byte(body), &files)
+	if len(files) != 1 || files[0].Path != "/usr/share/app/b.txt" {
+		t.Errorf("unexpected filtered files %+v", files)
+	}
+
+	if status, body := get(file.Download); status != http.StatusOK || body != "second a\n" {
+		t.Errorf("download: got %d %q", status, body)
+	}
+
+	// Names are escaped, the server serves them under the escaped URL
+	_, body = get("/api/files?q=" + url.QueryEscape("#1"))
+	json.Unmarshal([]byte(body), &files)
+	if len(files) != 1 || files[0].Download != "/download/usr/a%20%231%3F.txt" {
+		t.Errorf("unexpected escaped download %+v", files)
+	} else if status, body := get(files[0].Download); status != http.StatusOK || body != "odd" {
+		t.Errorf("escaped download: got %d %q", status, body)
+	}
+	if status, body := get("/payload/" + inis[1].Instructions[0].Payload); status != http.StatusOK || !strings.HasPrefix(body, "#!/bin/sh") {
+		t.Errorf("payload: got %d %q", status, body)
+	}
+
+	for _, path := range []string{"/download/../main_instructions.ini", "/download/usr/etc/passwd", "/download/usr", "/payload/../../etc/passwd"} {
+		if status, _ := get(path); status != http.StatusNotFound {
+			t.Errorf("%s: got status %d", path, status)
+		}
+	}
+
+	if status, body := get("/"); status != http.StatusOK || !strings.Contains(body, "<title>upupandaway</title>") {
+		t.Errorf("index: got %d", status)
+	}
+
+	response, err := http.Post(server.URL+"/api/tree", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,148 @@
+package unpacker
+
+import (
+	"strings"
+)
+
+func shellWords(line string) []string {
+	// shellWords splits a single shell command into words, honoring quotes
+	// and backslash escapes. It's no shell, but good enough for the simple
+	// commands found in Execute steps and update scripts.
+
+	words := make([]string, 0)
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words
+}
+
+func shellCommands(script string) [][]string {
+	// shellCommands returns the simple commands of a script: one per line,
+	// split at ;, &&, || and |. Comments and control flow keywords in front
+	// of a command (if, then, do, ...) are dropped.
+
+	commands := make([][]string, 0)
+
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for _, part := range splitShellLine(line) {
+			words := stripRedirections(shellWords(part))
+
+			for len(words) > 0 && isShellKeyword(words[0]) {
+				words = words[1:]
+			}
+
+			if len(words) > 0 {
+				commands = append(commands, words)
+			}
+		}
+	}
+
+	return commands
+}
+
+func splitShellLine(line string) []string {
+	// Splits a line at command separators outside of quotes
+
+	parts := make([]string, 0)
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			parts = append(parts, line[start:i])
+			return parts
+		case c == '&' && ((i > 0 && line[i-1] == '>') || (i+1 < len(line) && line[i+1] == '>')):
+			// Redirection like 2>&1 or &>
+		case c == ';' || c == '|' || c == '&':
+			parts = append(parts, line[start:i])
+			// && and || are one separator
+			if i+1 < len(line) && line[i+1] == c {
+				i++
+			}
+			start = i + 1
+		}
+	}
+
+	return append(parts, line[start:])
+}
+
+func stripRedirections(words []string) []string {
+	// Drops redirections like "> /dev/null", "2>&1" or ">>log" from a command
+
+	stripped := make([]string, 0, len(words))
+
+	for i := 0; i < len(words); i++ {
+		word := strings.TrimLeft(words[i], "0123456789&")
+		if !strings.HasPrefix(word, ">") && !strings.HasPrefix(word, "<") {
+			stripped = append(stripped, words[i])
+			continue
+		}
+
+		// The target is a separate word
+		if strings.Trim(word, "<>&") == "" && !strings.Contains(word, "&") {
+			i++
+		}
+	}
+
+	return stripped
+}
+
+func isShellKeyword(word string) bool {
+	switch word {
+	case "if", "then", "else", "elif", "fi", "do", "done", "while", "until", "!", "{", "}", "(", ")":
+		return true
+	}
+
+	return false
+}
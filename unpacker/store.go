@@ -0,0 +1,181 @@
+package unpacker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Store is a content addressed store for extracted files. Every content is
+// kept once in Dir/sha256/<first two hex digits>/<hash> and extractions
+// hardlink to it, so successive versions of a firmware share what didn't
+// change. Where hardlinks aren't possible, e.g. across filesystems, the file
+// is copied from the store instead.
+//
+// Files in an extraction are hardlinks: they must not be written to in place,
+// extraction always replaces targets instead of writing through them and
+// anything writing to extracted files breaks the link first, see breakLink.
+type Store struct {
+	Dir string
+}
+
+// StoreStats is the result of a garbage collection
+type StoreStats struct {
+	Blobs   int   `json:"blobs"`
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// errLinkCount is returned where the platform doesn't tell how often a file
+// is linked
+var errLinkCount = errors.New("link counts are not available on this platform")
+
+func OpenStore(dir string) (*Store, error) {
+	// OpenStore creates the store if needed
+
+	store := &Store{Dir: dir}
+
+	for _, sub := range []string{"sha256", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (store *Store) blob(hash string) string {
+	return filepath.Join(store.Dir, "sha256", hash[:2], hash)
+}
+
+func (store *Store) Put(from string, to string, fsync bool) error {
+	// Put streams a payload into the store like copyFile would to its
+	// target, and links the target to the stored content. The content is
+	// hashed while it's written to a temporary file, which becomes the blob
+	// unless the store already has it.
+
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+
+	hash, err := store.write(from, fsync)
+	if err != nil {
+		return err
+	}
+	blob := store.blob(hash)
+
+	if err := unlinkTarget(to); err != nil {
+		return err
+	}
+
+	if os.Link(blob, to) == nil {
+		return nil
+	}
+
+	return copyFile(blob, to, fsync)
+}
+
+func (store *Store) write(from string, fsync bool) (hash string, err error) {
+	reader, err := openPayload(from)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	temporary, err := os.CreateTemp(filepath.Join(store.Dir, "tmp"), "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// Only left over if something failed
+		os.Remove(temporary.Name())
+	}()
+
+	digest := sha256.New()
+	buffer := copyBuffers.Get().(*[]byte)
+	_, err = io.CopyBuffer(io.MultiWriter(temporary, digest), reader, *buffer)
+	copyBuffers.Put(buffer)
+	if err == nil && fsync {
+		err = temporary.Sync()
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// CreateTemp makes files 0600, extracted files are 0644 like with copyFile
+	if err := os.Chmod(temporary.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	hash = hex.EncodeToString(digest.Sum(nil))
+	blob := store.blob(hash)
+
+	if _, err := os.Lstat(blob); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return "", err
+	}
+
+	return hash, os.Rename(temporary.Name(), blob)
+}
+
+func (store *Store) GC() (StoreStats, error) {
+	// GC removes the blobs no extraction links to anymore, that is every
+	// blob that is only linked from the store itself, as well as temporary
+	// files of interrupted runs. It must not run while extractions into the
+	// store are running. Extractions that fell back to copies don't depend
+	// on the store, so collecting never loses extracted content.
+
+	var stats StoreStats
+
+	err := filepath.Walk(filepath.Join(store.Dir, "sha256"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		links, err := linkCount(info)
+		if err != nil {
+			return err
+		}
+
+		stats.Blobs++
+		if links > 1 {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		stats.Removed++
+		stats.Freed += info.Size()
+
+		// Empty prefix folders are removed as well, failing for the others
+		os.Remove(filepath.Dir(path))
+
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	temporaries, err := os.ReadDir(filepath.Join(store.Dir, "tmp"))
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range temporaries {
+		if err := os.Remove(filepath.Join(store.Dir, "tmp", entry.Name())); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package unpacker
+
+import (
+	"os"
+)
+
+func linkCount(info os.FileInfo) (uint64, error) {
+	return 0, errLinkCount
+}
@@ -0,0 +1,107 @@
+package unpacker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("garbage collection needs link counts")
+	}
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := ParseIniTree(writeSyntheticPackage(t))
+	out := t.TempDir()
+
+	first := &Config{ToBase: filepath.Join(out, "first"), Store: store}
+	second := &Config{ToBase: filepath.Join(out, "second"), Store: store, Workers: 4}
+	layered := &Config{ToBase: filepath.Join(out, "layered"), Store: store, Layered: true}
+	for _, config := range []*Config{first, second, layered} {
+		if err := ExtractTree(tree, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Same content, same file
+	a := filepath.Join("usr", "share", "app", "a.txt")
+	info, _ := os.Stat(filepath.Join(first.ToBase, a))
+	for _, other := range []string{filepath.Join(second.ToBase, a), filepath.Join(layered.ToBase, MergedDir, a)} {
+		if otherInfo, err := os.Stat(other); err != nil || !os.SameFile(info, otherInfo) {
+			t.Errorf("%s is not linked to the store", other)
+		}
+	}
+	if files := readTree(t, first.ToBase); files[a] != "second a\n" || files[filepath.Join("tmp", "setup.sh")] != "" {
+		t.Errorf("unexpected extraction %v", files)
+	}
+
+	// The first a.txt was replaced and setup.sh removed in every extraction,
+	// the layered one adds the empty /data/marker to the merged view
+	script := int64(len(syntheticFiles["bootstrap/e0000000001.dat.gz"]))
+	stats, err := store.GC()
+	if err != nil || stats != (StoreStats{Blobs: 5, Removed: 2, Freed: script + int64(len("first a\n"))}) {
+		t.Errorf("first gc: got %+v %v", stats, err)
+	}
+
+	os.RemoveAll(layered.ToBase)
+	stats, _ = store.GC()
+	if stats != (StoreStats{Blobs: 3, Removed: 1}) {
+		t.Errorf("gc after removing the layered extraction: got %+v", stats)
+	}
+
+	os.RemoveAll(first.ToBase)
+	if stats, _ = store.GC(); stats.Removed != 0 {
+		t.Errorf("gc removed files still linked from the second extraction: %+v", stats)
+	}
+
+	os.RemoveAll(second.ToBase)
+	if stats, _ = store.GC(); stats != (StoreStats{Blobs: 2, Removed: 2, Freed: stats.Freed}) {
+		t.Errorf("last gc: got %+v", stats)
+	}
+}
+
+func TestEmulateFlashToolsBreaksStoreLinks(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	main := writeSyntheticPackage(t)
+	root := filepath.Dir(main)
+	writeFiles(t, root, map[string]string{
+		"bootstrap/execute.ini": `[Instructions]
+Count = 2
+1 = Copy, e0000000002.dat, /dev/mtd0
+2 = Execute, "dd if=/dev/zero of=/dev/mtd0 bs=1 count=2"
+`,
+		"bootstrap/e0000000002.dat": "u-boot",
+	})
+
+	tree := ParseIniTree(main)
+	config := &Config{ToBase: filepath.Join(t.TempDir(), "out"), Store: store}
+	if err := ExtractTree(tree, config); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, command := range EmulateFlashTools(tree, config.ToBase) {
+		if command.Error != "" {
+			t.Errorf("%s: %s", command.Command, command.Error)
+		}
+	}
+
+	if device, _ := os.ReadFile(filepath.Join(config.ToBase, "dev/mtd0")); string(device) != "\x00\x00boot" {
+		t.Errorf("dd was not applied: %q", device)
+	}
+	sum := sha256.Sum256([]byte("u-boot"))
+	if blob, err := os.ReadFile(store.blob(hex.EncodeToString(sum[:]))); err != nil || string(blob) != "u-boot" {
+		t.Errorf("stored content was written through: %q %v", blob, err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package unpacker
+
+import (
+	"os"
+	"syscall"
+)
+
+func linkCount(info os.FileInfo) (uint64, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errLinkCount
+	}
+
+	return uint64(stat.Nlink), nil
+}
@@ -48,6 +48,26 @@ const (
 	RemoveFolderContent
 )
 
+var instructionStepNames = []string{
+	"Execute",
+	"ImageUpdate",
+	"FileUpdate",
+	"BreakPoint",
+	"Copy",
+	"Remove",
+	"Create",
+	"RemoveFolderContent",
+}
+
+// String returns the name as used in the ini files
+func (step InstructionStep) String() string {
+	if int(step) < 0 || int(step) >= len(instructionStepNames) {
+		return "Unknown"
+	}
+
+	return instructionStepNames[step]
+}
+
 // InstructionSet distinguishes the different types of instruction files
 type InstructionSet int
 
@@ -72,8 +92,32 @@ type Ini struct {
 	RootDir          string
 	Filename         string
 	Folder           string
+	Step             Instruction
 	Instructions     Instructions
 	Settings         Settings
 	Instructions_Ext Instructions
 	DataStorage      DataStorage
 }
+
+// Config holds everything needed for a full extraction run
+type Config struct {
+	// ToBase is the folder the target filesystem is recreated in, see
+	// OutputPath for the default naming
+	ToBase string
+	// Progress is called after every processed instruction, can be nil
+	Progress ProgressFunc
+	// Workers is the number of parallel copies, 0 or 1 extracts sequentially
+	Workers int
+	// Sync fsyncs every extracted file before it is closed
+	Sync bool
+	// Resume continues an interrupted run found in the staging folder
+	Resume bool
+	// Mode decides what happens if ToBase already exists
+	Mode OutputMode
+	// Layered writes every sub ini into its own layer below LayersDir and
+	// merges them into MergedDir, Workers is ignored
+	Layered bool
+	// Store keeps the extracted files once by content and links them into
+	// the extraction, nil copies them as usual
+	Store *Store
+}
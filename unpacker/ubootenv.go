@@ -0,0 +1,178 @@
+package unpacker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"regexp"
+)
+
+// UBootEnv is a U-Boot environment, either a saved one with CRC or the
+// default environment compiled into U-Boot
+type UBootEnv struct {
+	Offset int64 `json:"offset"`
+	Size   int   `json:"size"`
+	// Redundant environments have a flags byte after the CRC, the copy with
+	// the higher flags is the active one
+	Redundant bool              `json:"redundant"`
+	Flags     byte              `json:"flags,omitempty"`
+	CRCValid  bool              `json:"crc_valid"`
+	Default   bool              `json:"default"`
+	Variables map[string]string `json:"variables"`
+}
+
+// envSizes are the CONFIG_ENV_SIZE values seen in the wild
+var envSizes = []int{0x1000, 0x2000, 0x4000, 0x8000, 0x10000, 0x20000, 0x40000}
+
+var envVariable = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*=`)
+
+func ParseUBootEnv(data []byte) (*UBootEnv, error) {
+	// ParseUBootEnv parses data as a complete saved environment, as found in
+	// an env partition or a fw_env image. Both the single and the redundant
+	// layout are tried, the CRC has to match one of them.
+
+	if len(data) < 8 {
+		return nil, fmt.Errorf("%d bytes are too short for an environment", len(data))
+	}
+
+	crc := binary.LittleEndian.Uint32(data)
+	for _, start := range []int{4, 5} {
+		if crc32.ChecksumIEEE(data[start:]) != crc {
+			continue
+		}
+
+		env := &UBootEnv{Size: len(data), Redundant: start == 5, CRCValid: true, Variables: envVariables(data[start:])}
+		if env.Redundant {
+			env.Flags = data[4]
+		}
+		return env, nil
+	}
+
+	return nil, fmt.Errorf("CRC %08x matches neither a single nor a redundant environment", crc)
+}
+
+func FindUBootEnvs(data []byte) []*UBootEnv {
+	// FindUBootEnvs finds environments inside a larger image like a flash
+	// dump or a bootloader: saved environments at any 4K boundary with one of
+	// the usual sizes, and the default environment U-Boot carries as a block
+	// of NUL terminated variables containing bootcmd.
+
+	envs := make([]*UBootEnv, 0)
+
+	if env, err := ParseUBootEnv(data); err == nil {
+		return append(envs, env)
+	}
+
+	covered := func(offset int) bool {
+		for _, env := range envs {
+			if int64(offset) >= env.Offset && int64(offset) < env.Offset+int64(env.Size) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for offset := 0; offset+8 < len(data); offset += 0x1000 {
+		// Only try offsets that look like an environment, a CRC over every
+		// 4K block of a flash dump is too slow
+		if !envVariable.Match(data[offset+4:]) && !envVariable.Match(data[offset+5:]) {
+			continue
+		}
+
+		for _, size := range envSizes {
+			if offset+size > len(data) {
+				break
+			}
+			if env, err := ParseUBootEnv(data[offset : offset+size]); err == nil {
+				env.Offset = int64(offset)
+				envs = append(envs, env)
+				break
+			}
+		}
+	}
+
+	for search := 0; ; {
+		i := bytes.Index(data[search:], []byte("bootcmd="))
+		if i < 0 {
+			break
+		}
+		i += search
+
+		if i > 0 && data[i-1] != 0 {
+			// Part of a longer string like a script
+			search = i + 1
+			continue
+		}
+
+		// Walk back over the variables in front of bootcmd
+		start := i
+		for start >= 2 && data[start-1] == 0 {
+			previous := envStringStart(data, start-2)
+			if !envVariable.Match(data[previous : start-1]) {
+				break
+			}
+			start = previous
+		}
+
+		end := bytes.Index(data[i:], []byte{0, 0})
+		if end < 0 {
+			end = len(data) - i
+		}
+		end += i
+
+		if !covered(i) {
+			envs = append(envs, &UBootEnv{
+				Offset:    int64(start),
+				Size:      end - start,
+				Default:   true,
+				Variables: envVariables(data[start:end]),
+			})
+		}
+
+		search = end + 1
+		if search >= len(data) {
+			break
+		}
+	}
+
+	return envs
+}
+
+func envStringStart(data []byte, end int) int {
+	// Returns the start of the NUL terminated string ending at end
+
+	start := end
+	for start > 0 && data[start-1] != 0 {
+		start--
+	}
+
+	return start
+}
+
+func envVariables(data []byte) map[string]string {
+	// The variables are NUL terminated name=value strings, an empty string
+	// ends the list
+
+	variables := make(map[string]string)
+
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if len(entry) == 0 {
+			break
+		}
+		if i := bytes.IndexByte(entry, '='); i > 0 {
+			variables[string(entry[:i])] = string(entry[i+1:])
+		}
+	}
+
+	return variables
+}
+
+func (env *UBootEnv) WriteText(w io.Writer) {
+	// WriteText prints the environment like fw_printenv
+
+	for _, name := range sortedKeys(env.Variables) {
+		fmt.Fprintf(w, "%s=%s\n", name, env.Variables[name])
+	}
+}
@@ -0,0 +1,51 @@
+package unpacker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseUBootEnv(t *testing.T) {
+	for _, redundant := range []bool{false, true} {
+		env, err := ParseUBootEnv(ubootEnv(0x2000, redundant, "bootdelay=3", "bootcmd=run nandboot"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if env.Redundant != redundant || !env.CRCValid || env.Size != 0x2000 || len(env.Variables) != 2 ||
+			env.Variables["bootcmd"] != "run nandboot" {
+			t.Errorf("unexpected environment: %+v", env)
+		}
+	}
+
+	corrupt := ubootEnv(0x1000, false, "bootcmd=boot")
+	corrupt[10] ^= 0xff
+	if _, err := ParseUBootEnv(corrupt); err == nil {
+		t.Error("expected a CRC error")
+	}
+}
+
+func TestFindUBootEnvs(t *testing.T) {
+	dump := make([]byte, 0x3000)
+	copy(dump[0x100:], "U-Boot 2018.03\x00arch=arm\x00bootcmd=run mmcboot\x00baudrate=115200\x00\x00")
+	dump = append(dump, ubootEnv(0x2000, true, "mtdparts=nand:4m(boot)")...)
+
+	envs := FindUBootEnvs(dump)
+	if len(envs) != 2 {
+		t.Fatalf("expected two environments, got %+v", envs)
+	}
+
+	if envs[0].Offset != 0x3000 || !envs[0].CRCValid || !envs[0].Redundant || envs[0].Variables["mtdparts"] != "nand:4m(boot)" {
+		t.Errorf("unexpected saved environment: %+v", envs[0])
+	}
+
+	if !envs[1].Default || envs[1].CRCValid || envs[1].Offset != 0x10f || len(envs[1].Variables) != 3 {
+		t.Errorf("unexpected default environment: %+v", envs[1])
+	}
+
+	var text bytes.Buffer
+	envs[1].WriteText(&text)
+	if text.String() != "arch=arm\nbaudrate=115200\nbootcmd=run mmcboot\n" {
+		t.Errorf("unexpected text:\n%s", text.String())
+	}
+}
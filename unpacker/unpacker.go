@@ -6,6 +6,7 @@ package unpacker
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -26,6 +27,75 @@ func check(err error) {
 	}
 }
 
+func ExtractTree(tree []*Ini, config *Config) error {
+	// ExtractTree extracts every files.ini and execute.ini of a parsed tree
+	// into config.ToBase, reporting progress along the way.
+	//
+	// Files are written to a staging folder next to config.ToBase first,
+	// together with a journal of finished steps. Only a complete run is
+	// renamed into place, an interrupted one or one with failed steps can be
+	// continued with config.Resume.
+	//
+	// With config.Workers > 1 the copies are spread over a worker pool, see
+	// extractParallel. config.Layered writes one layer per sub ini instead,
+	// see extractLayer.
+
+	if len(tree) == 0 {
+		return nil
+	}
+
+	run, err := newExtraction(tree, config)
+	if err != nil {
+		return err
+	}
+
+	if config.Layered {
+		for _, ini := range tree[1:] {
+			if ini != nil {
+				log.Printf("[+] Extracting layer %s", LayerName(ini))
+				extractLayer(ini, run)
+			}
+
+			run.tracker.finish(ini)
+		}
+
+		layers, err := Layers(run.staging)
+		if err != nil {
+			return err
+		}
+
+		// The merged view is computed from scratch, a resumed run may have
+		// left a half merged one behind
+		merged := filepath.Join(run.staging, MergedDir)
+		err = os.RemoveAll(merged)
+		if err != nil {
+			return err
+		}
+
+		err = mergeLayers(layers, merged, run.copy)
+		if err != nil {
+			return err
+		}
+	} else if config.Workers > 1 {
+		extractParallel(tree, run)
+	} else {
+		for _, ini := range tree[1:] {
+			if ini != nil {
+				log.Printf("[+] Extracting %s", filepath.Join(ini.Folder, ini.Filename))
+				extractFiles(ini, run)
+			}
+
+			run.tracker.finish(ini)
+		}
+	}
+
+	if err := run.failed(); err != nil {
+		return err
+	}
+
+	return run.commit()
+}
+
 func ExtractFiles(ini *Ini, toBase string) {
 	// ExtractFiles extracts all the files according to the files.ini
 	// instructions
@@ -34,58 +104,197 @@ func ExtractFiles(ini *Ini, toBase string) {
 	// ./tmp, since the updater also runs in /tmp. This creates the closest
 	// representation to the actual file system.
 
+	extractFiles(ini, &extraction{config: &Config{}, staging: toBase})
+}
+
+func extractFiles(ini *Ini, run *extraction) {
 	// Generate a new folder every time to avoid conflicts
-	os.Mkdir(toBase, 0755)
+	os.Mkdir(run.staging, 0755)
+
+	applySteps(ini, run.staging, run)
+}
+
+func applySteps(ini *Ini, root string, run *extraction) {
+	// Applies the steps of a sub ini below root that didn't finish in an
+	// earlier run. All steps are journaled, re-running a Remove after a
+	// skipped Copy would otherwise delete the copied file on resume. Once a
+	// step failed nothing is journaled anymore: the failed step runs again on
+	// resume and every later step has to run after it again, a skipped
+	// Remove would otherwise leave the file it copies.
 
 	for _, instruction := range ini.Instructions.Instructions {
-		switch instruction.InstructionStep {
-		case Copy:
-			// args: from, to
-			var folder string
-			if strings.HasPrefix(ini.Filename, "files.ini") {
-				// TODO: log.Printf("folder: %s rootdir %s arg0 %s",
-				//           ini.Folder, ini.RootDir, instruction.Arguments[0])
-				folder = ""
-			} else {
-				folder = ini.Folder
-			}
-			from := filepath.Join(ini.RootDir, folder, instruction.Arguments[0])
-
-			// If a relative path is defined, save in /tmp.  This is because
-			// the updater scripts are ran in /tmp
-			var to string
-			if filepath.Dir(instruction.Arguments[1]) == "." {
-				to = filepath.Join(toBase, "/tmp/", instruction.Arguments[1])
-			} else {
-				to = filepath.Join(toBase, instruction.Arguments[1])
-			}
+		if run.journal.done(ini, instruction) {
+			run.tracker.advance(ini, 1)
+			continue
+		}
 
-			err := os.MkdirAll(filepath.Dir(to), 0755)
-			if err != nil && !os.IsExist(err) {
-				// Only fail if it's an error other than existing directory
-				log.Fatal(err)
-			}
+		err := applyStep(ini, instruction, root, run)
+		if err != nil {
+			run.fail(newStepRef(ini, instruction).String(), err)
+		} else if !run.failing() {
+			check(run.journal.record(ini, instruction))
+		}
+
+		run.tracker.advance(ini, 1)
+	}
+}
 
-			var reader io.Reader
+func stepTarget(ini *Ini, instruction Instruction) (string, error) {
+	// The path on the device a step changes, empty for steps that don't
+	// change the filesystem. Copy steps only change it for the sub inis whose
+	// payloads end up there, see isExtractable.
 
-			reader, err = os.Open(from)
-			// handle implicit .gz
-			if os.IsNotExist(err) {
-				reader, err = os.Open(from + ".gz")
-				check(err)
-				reader, err = gzip.NewReader(reader)
-				check(err)
+	args := instruction.Arguments
+
+	switch instruction.InstructionStep {
+	case Copy:
+		if !isExtractable(ini) {
+			return "", nil
+		}
+		// args: from, to
+		if len(args) < 2 {
+			return "", fmt.Errorf("%s needs a source and a target", instruction.InstructionStep)
+		}
+		return devicePath(args[1]), nil
+	case Create, Remove, RemoveFolderContent:
+		// args: filepath
+		if len(args) < 1 {
+			return "", fmt.Errorf("%s needs a path", instruction.InstructionStep)
+		}
+		path := devicePath(args[0])
+		if path == "/" && instruction.InstructionStep != RemoveFolderContent {
+			return "", fmt.Errorf("%s of the filesystem root", instruction.InstructionStep)
+		}
+		return path, nil
+	}
+
+	return "", nil
+}
+
+func applyStep(ini *Ini, instruction Instruction, root string, run *extraction) error {
+	// Applies a step of a sub ini to the filesystem below root like the
+	// device would. This is the only place steps are applied, flat, parallel
+	// and layered extractions all end up with the same filesystem.
+	//
+	// In a layered run root is the layer of the sub ini: removing records a
+	// whiteout and a Create keeps a file of the layers below, like it keeps
+	// an existing file in a flat run.
+
+	target, err := stepTarget(ini, instruction)
+	if err != nil || target == "" {
+		return err
+	}
+	to := filepath.Join(root, target)
+	layered := run.config.Layered
+
+	switch instruction.InstructionStep {
+	case Copy:
+		if layered {
+			clearWhiteout(to)
+		}
+		return run.copy(sourcePath(ini, instruction.Arguments[0]), to)
+	case Create:
+		if layered && !fileExists(to) {
+			lower := lowerFile(root, target)
+			clearWhiteout(to)
+			if lower != "" {
+				return run.copy(lower, to)
 			}
+		}
+		return createFile(to)
+	case Remove:
+		if layered {
+			return whiteout(root, target)
+		}
+		return os.RemoveAll(to)
+	case RemoveFolderContent:
+		if layered {
+			return opaqueWhiteout(root, target)
+		}
+		return removeContent(to)
+	}
+
+	return nil
+}
+
+func removeContent(dir string) error {
+	// Removes everything in dir. The journal is the only file in the
+	// staging folder that isn't on the device, it survives emptying /.
 
-			writer, err := os.Create(to)
-			check(err)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-			_, err = io.Copy(writer, reader)
-			// TODO: check(err)
-			// TODO: log.Printf("copied %s to %s, bytes written: %d"
-			//         from, to, bytesWritten)
+	for _, entry := range entries {
+		if entry.Name() == JournalFilename {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
+}
+
+func isExtractable(ini *Ini) bool {
+	// Only files.ini and execute.ini contain Copy steps that end up on the
+	// target filesystem
+
+	return ini != nil && (strings.HasPrefix(ini.Filename, "files.ini") || strings.HasPrefix(ini.Filename, "execute.ini"))
+}
+
+func sourcePath(ini *Ini, name string) string {
+	// Copy sources of execute.ini are relative to its folder, files.ini
+	// already contains the folder in the path
+
+	var folder string
+	if strings.HasPrefix(ini.Filename, "files.ini") {
+		// TODO: log.Printf("folder: %s rootdir %s arg0 %s",
+		//           ini.Folder, ini.RootDir, instruction.Arguments[0])
+		folder = ""
+	} else {
+		folder = ini.Folder
+	}
+
+	return filepath.Join(ini.RootDir, folder, name)
+}
+
+func devicePath(name string) string {
+	// If a relative path is defined, save in /tmp.  This is because the
+	// updater scripts are ran in /tmp
+
+	if filepath.Dir(name) == "." {
+		return filepath.Join("/tmp/", name)
+	}
+
+	return filepath.Join("/", name)
+}
+
+func SimulateTree(tree []*Ini, progress ProgressFunc) []string {
+	// SimulateTree runs SimulateSteps over a whole parsed tree and reports
+	// progress per sub ini.
+
+	files := make([]string, 0)
+
+	if len(tree) == 0 {
+		return files
+	}
+
+	tracker := newProgressTracker(tree, progress)
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		files = append(files, SimulateSteps(ini)...)
+		tracker.finish(ini)
+	}
+
+	return files
 }
 
 func SimulateSteps(ini *Ini) []string {
@@ -127,19 +336,34 @@ func SimulateSteps(ini *Ini) []string {
 }
 
 func ParseIniTree(filename string) []*Ini {
+	// ParseIniTree parses the main ini and the sub ini of every main step.
+	// The tree is indexed by StepNo: tree[0] is the main ini and tree[i] the
+	// sub ini of main step i, nil where it's missing. The first main step
+	// has its sub ini like every other step, older versions skipped it and
+	// stored step i+1 at tree[i].
+
 	dir := filepath.Dir(filename)
 
 	main := ParseMainIni(ini.Load(filename))
 	main.RootDir = dir
 	main.Filename = filename
 
-	tree := make([]*Ini, main.Instructions.Count)
+	// tree[0] is the main ini itself, tree[i] belongs to step i. Steps that
+	// couldn't be parsed are missing from the instructions, so the last
+	// StepNo decides the size.
+	size := 1
+	if count := len(main.Instructions.Instructions); count > 0 {
+		size = main.Instructions.Instructions[count-1].StepNo + 1
+	}
+	tree := make([]*Ini, size)
 
 	tree[0] = main
 
-	for i := 1; i < main.Instructions.Count; i++ {
-		instruction := main.Instructions.Instructions[i]
-
+	for _, instruction := range main.Instructions.Instructions {
+		if len(instruction.Arguments) < 2 {
+			log.Printf("[!] step %d has no folder and ini", instruction.StepNo)
+			continue
+		}
 		candidate := filepath.Join(dir, instruction.Arguments[0], instruction.Arguments[1])
 
 		// Check if it's a normal file or compressed
@@ -158,18 +382,22 @@ func ParseIniTree(filename string) []*Ini {
 			reader, err = gzip.NewReader(file)
 			if err != nil {
 				log.Printf("[!] could not decompress file")
+				file.Close()
 				continue
 			}
 		}
 
 		subini := ini.Load(reader)
+		file.Close()
+
 		subini_ini := ParseSubIni(subini)
 
 		subini_ini.RootDir = dir
 		subini_ini.Folder = instruction.Arguments[0]
 		subini_ini.Filename = instruction.Arguments[1]
+		subini_ini.Step = instruction
 
-		tree[i] = subini_ini
+		tree[instruction.StepNo] = subini_ini
 	}
 
 	return tree
@@ -280,6 +508,7 @@ func ParseInstructions(in *ini.Ini, section string, has_steps bool) Instructions
 		line, err := in.GetValue(section, strconv.FormatInt(int64(i), 10))
 		if err != nil {
 			log.Printf("Could not get step %d: %q", i, err)
+			continue
 		}
 
 		r := csv.NewReader(strings.NewReader(line))
@@ -288,8 +517,9 @@ func ParseInstructions(in *ini.Ini, section string, has_steps bool) Instructions
 		r.TrimLeadingSpace = true
 
 		tokens, err := r.Read()
-		if err != nil {
+		if err != nil || len(tokens) == 0 {
 			log.Printf("Could not read line %s: %q", line, err)
+			continue
 		}
 
 		var step InstructionStep
@@ -318,7 +548,7 @@ func ParseInstructions(in *ini.Ini, section string, has_steps bool) Instructions
 		var args []string
 		var steps int
 
-		if has_steps {
+		if has_steps && len(tokens) > 1 {
 			args = tokens[1 : len(tokens)-1]
 			steps, err = strconv.Atoi(tokens[len(tokens)-1])
 			if err != nil {
@@ -119,6 +119,30 @@ func TestParseIniTree(t *testing.T) {
 	log.Printf("tree: %#v", got)
 }
 
+func TestParseIniTreeSteps(t *testing.T) {
+	main := writeSyntheticPackage(t)
+
+	tree := ParseIniTree(main)
+	want := []string{"", "bootstrap", "linux1", "resources"}
+	if len(tree) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(tree))
+	}
+	for step, folder := range want[1:] {
+		if ini := tree[step+1]; ini == nil || ini.Folder != folder || ini.Step.StepNo != step+1 {
+			t.Errorf("step %d: expected %s, got %+v", step+1, folder, ini)
+		}
+	}
+
+	// A step that can't be parsed leaves a gap instead of moving the others
+	content, _ := os.ReadFile(main)
+	os.WriteFile(main, []byte(strings.Replace(string(content), "2 = ImageUpdate, linux1, binary.ini, 2\n", "", 1)), 0644)
+
+	tree = ParseIniTree(main)
+	if len(tree) != 4 || tree[2] != nil || tree[3] == nil || tree[3].Folder != "resources" {
+		t.Errorf("unexpected tree with a missing step: %+v", tree)
+	}
+}
+
 func TestParseMainIni(t *testing.T) {
 	log.Print("TestParseMainIni")
 
@@ -0,0 +1,135 @@
+package unpacker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Severity of a validation finding
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityInfo    Severity = "info"
+)
+
+// Finding is a problem or oddity found in a package
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	Step     *StepRef `json:"step,omitempty"`
+}
+
+func Validate(tree []*Ini) []Finding {
+	// Validate checks a parsed tree for inconsistencies: step counts that
+	// don't add up, sub inis and payloads that are missing, unbalanced
+	// BreakPoints and an Instructions_Ext that doesn't match Instructions.
+	// The findings of BuildDataFlow are included.
+
+	findings := make([]Finding, 0)
+	main := tree[0]
+
+	add := func(severity Severity, step *StepRef, format string, args ...interface{}) {
+		findings = append(findings, Finding{Severity: severity, Message: fmt.Sprintf(format, args...), Step: step})
+	}
+
+	var sum int64
+	for _, instruction := range main.Instructions.Instructions {
+		sum += int64(instruction.Steps)
+	}
+	if main.Settings.TotalStepsCount != sum {
+		add(SeverityWarning, nil, "TotalStepsCount is %d, but the steps add up to %d", main.Settings.TotalStepsCount, sum)
+	}
+
+	for _, instruction := range main.Instructions.Instructions {
+		if len(instruction.Arguments) < 2 {
+			add(SeverityError, nil, "main ini step %d has %d arguments instead of folder and file", instruction.StepNo, len(instruction.Arguments))
+			continue
+		}
+		if instruction.StepNo >= len(tree) || tree[instruction.StepNo] == nil {
+			add(SeverityError, nil, "sub ini %s of step %d is missing", filepath.Join(instruction.Arguments...), instruction.StepNo)
+		}
+	}
+
+	// Ext contains the same steps plus BreakPoints
+	ext := make([]Instruction, 0)
+	open := make(map[string]int)
+	for _, instruction := range main.Instructions_Ext.Instructions {
+		if instruction.InstructionStep != BreakPoint {
+			ext = append(ext, instruction)
+			continue
+		}
+
+		if len(instruction.Arguments) < 2 {
+			add(SeverityWarning, nil, "BreakPoint at Instructions_Ext step %d has no name or marker", instruction.StepNo)
+			continue
+		}
+
+		name := instruction.Arguments[0]
+		switch instruction.Arguments[1] {
+		case "Start":
+			open[name]++
+		case "End":
+			if open[name] == 0 {
+				add(SeverityWarning, nil, "BreakPoint %s ends at step %d without start", name, instruction.StepNo)
+			} else {
+				open[name]--
+			}
+		default:
+			add(SeverityWarning, nil, "BreakPoint %s at step %d has unknown marker %s", name, instruction.StepNo, instruction.Arguments[1])
+		}
+	}
+	for _, name := range sortedKeys(open) {
+		if open[name] > 0 {
+			add(SeverityWarning, nil, "BreakPoint %s is never closed", name)
+		}
+	}
+
+	if len(main.Instructions_Ext.Instructions) > 0 {
+		if len(ext) != len(main.Instructions.Instructions) {
+			add(SeverityWarning, nil, "Instructions_Ext has %d steps besides BreakPoints, Instructions has %d",
+				len(ext), len(main.Instructions.Instructions))
+		}
+		for i := 0; i < len(ext) && i < len(main.Instructions.Instructions); i++ {
+			a, b := ext[i], main.Instructions.Instructions[i]
+			if a.InstructionStep != b.InstructionStep || fmt.Sprint(a.Arguments) != fmt.Sprint(b.Arguments) || a.Steps != b.Steps {
+				add(SeverityWarning, nil, "Instructions_Ext step %d (%v %v) differs from Instructions step %d (%v %v)",
+					a.StepNo, a.InstructionStep, a.Arguments, b.StepNo, b.InstructionStep, b.Arguments)
+			}
+		}
+	}
+
+	for _, ini := range tree[1:] {
+		if ini == nil {
+			continue
+		}
+
+		for _, instruction := range ini.Instructions.Instructions {
+			ref := newStepRef(ini, instruction)
+
+			want := map[InstructionStep]int{Copy: 2, Remove: 1, Create: 1, RemoveFolderContent: 1, Execute: 1}[instruction.InstructionStep]
+			if len(instruction.Arguments) < want {
+				add(SeverityError, &ref, "%v needs %d arguments, has %d", instruction.InstructionStep, want, len(instruction.Arguments))
+				continue
+			}
+
+			if instruction.InstructionStep == Copy && isExtractable(ini) {
+				from := sourcePath(ini, instruction.Arguments[0])
+				if !fileExists(from) && !fileExists(from+".gz") {
+					add(SeverityError, &ref, "payload %s is missing", instruction.Arguments[0])
+				}
+			}
+		}
+	}
+
+	findings = append(findings, BuildDataFlow(tree).Findings...)
+
+	return findings
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,49 @@
+package unpacker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	mainInstructions := writeSyntheticPackage(t)
+
+	if findings := Validate(ParseIniTree(mainInstructions)); len(findings) != 0 {
+		t.Errorf("synthetic package should be valid: %+v", findings)
+	}
+
+	root := filepath.Dir(mainInstructions)
+	os.Remove(filepath.Join(root, "resources/f0001.dat"))
+	os.Remove(filepath.Join(root, "linux1/binary.ini"))
+
+	content, _ := os.ReadFile(mainInstructions)
+	content = []byte(strings.Replace(string(content), "TotalStepsCount = 10", "TotalStepsCount = 11", 1))
+	content = []byte(strings.Replace(string(content), "5 = BreakPoint, reinstall, End, 0", "5 = BreakPoint, other, End, 0", 1))
+	os.WriteFile(mainInstructions, content, 0644)
+
+	findings := Validate(ParseIniTree(mainInstructions))
+
+	want := []string{
+		"TotalStepsCount is 11, but the steps add up to 10",
+		"sub ini linux1/binary.ini of step 2 is missing",
+		"BreakPoint other ends at step 5 without start",
+		"BreakPoint reinstall is never closed",
+		"payload resources/f0001.dat is missing",
+	}
+
+	if len(findings) != len(want) {
+		t.Fatalf("got %d findings, want %d: %+v", len(findings), len(want), findings)
+	}
+
+	for i, finding := range findings {
+		if finding.Message != want[i] {
+			t.Errorf("finding %d: got %q, want %q", i, finding.Message, want[i])
+		}
+	}
+
+	if findings[4].Step == nil || findings[4].Step.StepNo != 1 || findings[4].Step.Folder != "resources" {
+		t.Errorf("missing payload points to the wrong step: %+v", findings[4].Step)
+	}
+}
@@ -0,0 +1,323 @@
+package unpacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WatchResultsSuffix is appended to the folder of a package for the folder
+// its results are written to, next to the package
+const WatchResultsSuffix = ".upupandaway"
+
+// WatchStatusFilename is written last into the results folder, packages with
+// it are done and not processed again
+const WatchStatusFilename = "status.json"
+
+// Watcher finds packages dropped into a folder and hands them to a queue once
+// they are complete. A package is a folder directly below Dir with a
+// main_instructions.ini. Copies take a while, so a package is only complete
+// once nothing in its folder changed for Settle.
+type Watcher struct {
+	Dir string
+	// Settle is how long a package must stay unchanged before it's processed
+	Settle time.Duration
+	// Interval is the time between scans. inotify wakes the watcher early on
+	// Linux, elsewhere polling is the only way to find packages.
+	Interval time.Duration
+	// Jobs is the number of packages processed at the same time
+	Jobs int
+
+	packages map[string]*watchedPackage
+	notifier *notifier
+}
+
+// watchedPackage is the state of a package folder between scans
+type watchedPackage struct {
+	fingerprint folderFingerprint
+	changed     time.Time
+	queued      bool
+}
+
+// folderFingerprint changes whenever a file in a folder is added, removed or
+// written to
+type folderFingerprint struct {
+	files    int
+	size     int64
+	modified int64
+}
+
+// WatchStatus is the content of WatchStatusFilename
+type WatchStatus struct {
+	Package  string    `json:"package"`
+	Source   string    `json:"source"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+	// Extracted is the extraction relative to the results folder
+	Extracted string `json:"extracted,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func NewWatcher(dir string) *Watcher {
+	return &Watcher{
+		Dir:      dir,
+		Settle:   10 * time.Second,
+		Interval: 5 * time.Second,
+		Jobs:     1,
+		packages: make(map[string]*watchedPackage),
+	}
+}
+
+func (w *Watcher) Scan(now time.Time) ([]string, error) {
+	// Scan returns the packages that became complete since the last scan.
+	// Every package is only returned once, packages that already have results
+	// are skipped.
+
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make([]string, 0)
+
+	for _, entry := range entries {
+		dir := filepath.Join(w.Dir, entry.Name())
+		if !entry.IsDir() || filepath.Ext(dir) == WatchResultsSuffix {
+			continue
+		}
+
+		state := w.packages[dir]
+		if state != nil && state.queued {
+			continue
+		}
+		if !fileExists(filepath.Join(dir, "main_instructions.ini")) {
+			continue
+		}
+		if fileExists(filepath.Join(dir+WatchResultsSuffix, WatchStatusFilename)) {
+			w.packages[dir] = &watchedPackage{queued: true}
+			continue
+		}
+
+		fingerprint, err := fingerprintFolder(dir)
+		if err != nil {
+			// Vanished or unreadable while copying, the next scan tells
+			continue
+		}
+
+		if state == nil {
+			state = &watchedPackage{fingerprint: fingerprint, changed: now}
+			w.packages[dir] = state
+			if w.notifier != nil {
+				w.notifier.add(dir)
+			}
+		} else if state.fingerprint != fingerprint {
+			state.fingerprint, state.changed = fingerprint, now
+		}
+
+		if now.Sub(state.changed) >= w.Settle {
+			state.queued = true
+			ready = append(ready, dir)
+		}
+	}
+
+	// Forget packages that were removed, so they're processed again if they
+	// come back
+	for dir := range w.packages {
+		if !fileExists(dir) {
+			delete(w.packages, dir)
+		}
+	}
+
+	return ready, nil
+}
+
+func fingerprintFolder(dir string) (folderFingerprint, error) {
+	var fingerprint folderFingerprint
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fingerprint.files++
+		fingerprint.size += info.Size()
+		if modified := info.ModTime().UnixNano(); modified > fingerprint.modified {
+			fingerprint.modified = modified
+		}
+		return nil
+	})
+
+	return fingerprint, err
+}
+
+func (w *Watcher) Run(stop <-chan struct{}, process func(dir string)) error {
+	// Run scans until stop is closed and runs process for every complete
+	// package on Jobs workers. Packages wait in a queue in the order they
+	// were completed, packages being processed are finished before Run
+	// returns.
+
+	var err error
+	w.notifier, err = newNotifier(w.Dir)
+	if err != nil {
+		log.Printf("[!] Polling every %s, inotify is not available: %s", w.Interval, err)
+	} else {
+		defer w.notifier.close()
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+
+	workers := w.Jobs
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range jobs {
+				process(dir)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	var wake <-chan struct{}
+	if w.notifier != nil {
+		wake = w.notifier.events
+	}
+
+	queue := make([]string, 0)
+	scan := func() error {
+		ready, err := w.Scan(time.Now())
+		for _, dir := range ready {
+			log.Printf("[+] Queued %s", dir)
+		}
+		queue = append(queue, ready...)
+		return err
+	}
+
+	if err := scan(); err != nil {
+		return err
+	}
+
+	for {
+		// Only offer the head of the queue while there is one
+		var next chan<- string
+		head := ""
+		if len(queue) > 0 {
+			next, head = jobs, queue[0]
+		}
+
+		select {
+		case <-stop:
+			if len(queue) > 0 {
+				log.Printf("[!] Stopping with %d packages queued", len(queue))
+			}
+			return nil
+		case <-wake:
+			err = scan()
+		case <-ticker.C:
+			err = scan()
+		case next <- head:
+			queue = queue[1:]
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func ProcessPackage(dir string, extract Config) (status WatchStatus) {
+	// ProcessPackage parses, validates, extracts and reports a package into
+	// dir+WatchResultsSuffix: findings.json, the extraction, report.md and
+	// report.html. extract is the template for the extraction, its ToBase and
+	// Mode are set here. The status is written last, also if a step failed.
+
+	results := dir + WatchResultsSuffix
+	status = WatchStatus{Source: dir, Started: time.Now().UTC()}
+
+	defer func() {
+		// Broken packages are reported by validation and failed steps. This
+		// is a last resort for panics left on this goroutine, extraction
+		// workers recover on their own. Runtime errors like stack overflows
+		// can't be recovered and still end the watch.
+		if r := recover(); r != nil {
+			status.Error = fmt.Sprintf("panic: %v", r)
+		}
+		status.Finished = time.Now().UTC()
+
+		content, err := json.MarshalIndent(status, "", "  ")
+		if err == nil {
+			err = os.WriteFile(filepath.Join(results, WatchStatusFilename), append(content, '\n'), 0644)
+		}
+		if err != nil && status.Error == "" {
+			status.Error = err.Error()
+		}
+	}()
+
+	err := os.MkdirAll(results, 0755)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	tree := ParseIniTree(filepath.Join(dir, "main_instructions.ini"))
+	status.Package = PackageName(tree)
+
+	findings := Validate(tree)
+	for _, finding := range findings {
+		switch finding.Severity {
+		case SeverityError:
+			status.Errors++
+		case SeverityWarning:
+			status.Warnings++
+		}
+	}
+
+	content, err := json.MarshalIndent(findings, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(results, "findings.json"), append(content, '\n'), 0644)
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	// The results folder is ours, a staging folder left by an interrupted
+	// watch is thrown away
+	extract.ToBase = OutputPath(tree, results)
+	extract.Mode = Overwrite
+	extract.Resume = false
+	if err := os.RemoveAll(extract.ToBase + StagingSuffix); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if err := ExtractTree(tree, &extract); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Extracted = filepath.Base(extract.ToBase)
+
+	report, err := NewReport(tree, extract.ToBase)
+	if err == nil {
+		err = report.WriteFiles(filepath.Join(results, "report.md"), filepath.Join(results, "report.html"))
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	return status
+}
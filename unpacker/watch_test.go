@@ -0,0 +1,132 @@
+package unpacker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dropPackage moves the synthetic package into dir as name, like a copy to
+// the watched folder
+func dropPackage(t *testing.T, dir string, name string) string {
+	t.Helper()
+
+	target := filepath.Join(dir, name)
+	if err := os.Rename(filepath.Dir(writeSyntheticPackage(t)), target); err != nil {
+		t.Fatal(err)
+	}
+
+	return target
+}
+
+func TestWatcherScan(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWatcher(dir)
+	start := time.Now()
+
+	first := dropPackage(t, dir, "first")
+	done := dropPackage(t, dir, "done")
+	os.Mkdir(done+WatchResultsSuffix, 0755)
+	os.WriteFile(filepath.Join(done+WatchResultsSuffix, WatchStatusFilename), []byte("{}\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "empty"), 0755)
+
+	if ready, err := w.Scan(start); err != nil || len(ready) != 0 {
+		t.Fatalf("first scan: got %v %v", ready, err)
+	}
+
+	// Still being copied
+	os.WriteFile(filepath.Join(first, "late.dat"), []byte("late"), 0644)
+	if ready, _ := w.Scan(start.Add(w.Settle)); len(ready) != 0 {
+		t.Errorf("changed package is ready: %v", ready)
+	}
+
+	if ready, _ := w.Scan(start.Add(2 * w.Settle)); !reflect.DeepEqual(ready, []string{first}) {
+		t.Errorf("settled scan: got %v", ready)
+	}
+	if ready, _ := w.Scan(start.Add(3 * w.Settle)); len(ready) != 0 {
+		t.Errorf("package returned twice: %v", ready)
+	}
+}
+
+func TestProcessPackage(t *testing.T) {
+	dir := dropPackage(t, t.TempDir(), "package")
+
+	status := ProcessPackage(dir, Config{Workers: 2})
+	if status.Error != "" || status.Package != "up_1587449549" || status.Extracted != "up_1587449549" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	results := dir + WatchResultsSuffix
+	files := readTree(t, results)
+	for _, name := range []string{"findings.json", "report.md", "report.html", filepath.Join("up_1587449549", "usr", "share", "app", "a.txt")} {
+		if _, exists := files[name]; !exists {
+			t.Errorf("%s is missing", name)
+		}
+	}
+
+	var written WatchStatus
+	if err := json.Unmarshal([]byte(files[WatchStatusFilename]), &written); err != nil || written.Package != status.Package {
+		t.Errorf("unexpected status file %q", files[WatchStatusFilename])
+	}
+
+}
+
+func TestProcessBrokenPackage(t *testing.T) {
+	dir := dropPackage(t, t.TempDir(), "package")
+
+	// Missing lines and arguments everywhere, found by validation and failed
+	// steps instead of panics
+	writeFiles(t, dir, map[string]string{
+		"main_instructions.ini": "[Settings]\nPackageID = 1\n\n[Instructions]\nCount = 5\n1 = Execute\n" +
+			"2 = Execute, bootstrap, execute.ini, 6\n4 = ImageUpdate\n5 = FileUpdate, resources, files.ini, 3\n\n" +
+			"[Instructions_Ext]\nCount = 2\n1 = BreakPoint\n",
+		"bootstrap/execute.ini": "[Instructions]\nCount = 7\n1 = Copy\n2 = Copy, e0000000001.dat\n3 = Remove\n" +
+			"4 = Create\n5 = RemoveFolderContent\n6 = Execute\n7 = Remove, /\n",
+		"resources/files.ini": "[Instructions]\nCount = 3\n1 = Copy, resources/f0001.dat, /a\n2 = ImageUpdate\n3 = Copy, missing.dat, /b\n",
+	})
+
+	for _, workers := range []int{1, 4} {
+		os.RemoveAll(dir + WatchResultsSuffix)
+
+		status := ProcessPackage(dir, Config{Workers: workers})
+		if status.Errors == 0 || !strings.Contains(status.Error, "steps failed") || strings.HasPrefix(status.Error, "panic") {
+			t.Errorf("unexpected status with %d workers: %+v", workers, status)
+		}
+	}
+}
+
+func TestWatcherRun(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWatcher(dir)
+	w.Settle, w.Interval, w.Jobs = 50*time.Millisecond, 20*time.Millisecond, 2
+
+	processed := make(chan string, 2)
+	stop := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- w.Run(stop, func(dir string) { processed <- dir })
+	}()
+
+	packages := map[string]bool{dropPackage(t, dir, "a"): true, dropPackage(t, dir, "b"): true}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-processed:
+			if !packages[got] {
+				t.Errorf("unexpected package %s", got)
+			}
+			delete(packages, got)
+		case <-time.After(10 * time.Second):
+			t.Fatal("no package processed")
+		}
+	}
+
+	close(stop)
+	if err := <-finished; err != nil {
+		t.Error(err)
+	}
+}